@@ -3,13 +3,14 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
 	"os"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	cli "github.com/jawher/mow.cli"
+	"github.com/klauspost/compress/gzip"
 	log "github.com/sirupsen/logrus"
 )
 
@@ -19,14 +20,50 @@ const (
 )
 
 func main() {
-	app := cli.App("mongobackup", "Backup and restore mongodb collections to/from s3\nBackups are put in a directory structure /<base-dir>/<date>/database/collection")
+	app := cli.App("mongobackup", "Backup and restore mongodb collections to/from s3 or a local filesystem\nBackups are put in a directory structure /<base-dir>/<date>/database/collection")
 
 	connStr := app.String(cli.StringOpt{
 		Name:   "mongodb",
-		Desc:   "mongodb connection string",
+		Desc:   "mongodb connection string: a mongodb:// or mongodb+srv:// URI, or comma separated hosts",
 		EnvVar: "MONGODB",
 		Value:  "localhost:27017",
 	})
+	tlsCAFile := app.String(cli.StringOpt{
+		Name:   "tls-ca-file",
+		Desc:   "PEM file of the certificate authorities to verify the MongoDB servers with. Enables TLS",
+		EnvVar: "MONGODB_TLS_CA_FILE",
+	})
+	tlsCertificateKeyFile := app.String(cli.StringOpt{
+		Name:   "tls-certificate-key-file",
+		Desc:   "PEM file with the client certificate and its key, e.g. for MONGODB-X509 authentication. Enables TLS",
+		EnvVar: "MONGODB_TLS_CERTIFICATE_KEY_FILE",
+	})
+	authMechanism := app.String(cli.StringOpt{
+		Name:   "auth-mechanism",
+		Desc:   "Authentication mechanism: SCRAM-SHA-1, SCRAM-SHA-256 or MONGODB-X509. Empty uses the connection string or the server default",
+		EnvVar: "MONGODB_AUTH_MECHANISM",
+	})
+	authSource := app.String(cli.StringOpt{
+		Name:   "auth-source",
+		Desc:   "Database the user is defined in",
+		EnvVar: "MONGODB_AUTH_SOURCE",
+	})
+	username := app.String(cli.StringOpt{
+		Name:   "username",
+		Desc:   "User to authenticate as, instead of the one in the connection string",
+		EnvVar: "MONGODB_USERNAME",
+	})
+	passwordFile := app.String(cli.StringOpt{
+		Name:   "password-file",
+		Desc:   "File holding the password of the user, e.g. a mounted secret",
+		EnvVar: "MONGODB_PASSWORD_FILE",
+	})
+	storageBackend := app.String(cli.StringOpt{
+		Name:   "storage",
+		Desc:   "Storage backend to keep backups in (s3 or fs)",
+		EnvVar: "STORAGE",
+		Value:  "s3",
+	})
 	s3bucket := app.String(cli.StringOpt{
 		Name:   "bucket",
 		Desc:   "s3 bucket name",
@@ -41,13 +78,13 @@ func main() {
 	})
 	s3dir := app.String(cli.StringOpt{
 		Name:   "base-dir",
-		Desc:   "s3 base directory name",
+		Desc:   "Base directory name in the s3 bucket, or on the local filesystem for the fs storage backend",
 		EnvVar: "S3_DIR",
 		Value:  "/backups/",
 	})
 	colls := app.String(cli.StringOpt{
 		Name:   "collections",
-		Desc:   "Collections to process (comma separated <database>/<collection>)",
+		Desc:   "Collections to process (comma separated <database>/<collection>). Both sides may be glob patterns (e.g. upp-store/*), and entries starting with ! are excluded",
 		EnvVar: "MONGODB_COLLECTIONS",
 		Value:  "foo/content,foo/bar",
 	})
@@ -57,18 +94,144 @@ func main() {
 		EnvVar: "MONGO_TIMEOUT",
 		Value:  60,
 	})
+	readPreference := app.String(cli.StringOpt{
+		Name:   "read-preference",
+		Desc:   "Members backups read from: primary, primaryPreferred, secondary, secondaryPreferred or nearest. Overrides the connection string's readPreference, primary if it has none. Restores always write to the primary",
+		EnvVar: "READ_PREFERENCE",
+	})
+	readPreferenceTags := app.String(cli.StringOpt{
+		Name:   "read-preference-tags",
+		Desc:   "Tag sets of the members backups read from, tried in order (semicolon separated sets of comma separated name:value tags, e.g. dc:east,use:backup;dc:east)",
+		EnvVar: "READ_PREFERENCE_TAGS",
+	})
+	maxStaleness := app.String(cli.StringOpt{
+		Name:   "max-staleness",
+		Desc:   "Don't back up from secondaries lagging behind the primary by more than this (at least 90s)",
+		EnvVar: "MAX_STALENESS",
+	})
 	rateLimit := app.Int(cli.IntOpt{
 		Name:   "rateLimit",
 		Desc:   "Rate limit mongo operations in milliseconds. (e.g. 250)",
 		EnvVar: "RATE_LIMIT",
 		Value:  250,
 	})
+	snapshot := app.Bool(cli.BoolOpt{
+		Name:   "snapshot",
+		Desc:   "Read all collections of a backup at a single cluster time, using snapshot read concern. Needs MongoDB 5.0+, and a minSnapshotHistoryWindowInSeconds longer than the backup takes.",
+		EnvVar: "SNAPSHOT",
+		Value:  false,
+	})
+	parallelism := app.Int(cli.IntOpt{
+		Name:   "parallelism",
+		Desc:   "Number of collections backed up at once",
+		EnvVar: "PARALLELISM",
+		Value:  1,
+	})
+	partitionSize := app.Int(cli.IntOpt{
+		Name:   "partition-size",
+		Desc:   "Split collections larger than this many bytes into _id ranges of about this size, which are backed up and restored in parallel. 0 never splits collections",
+		EnvVar: "PARTITION_SIZE",
+		Value:  0,
+	})
+	maxPartitions := app.Int(cli.IntOpt{
+		Name:   "max-partitions",
+		Desc:   "Maximum number of parts a collection is split into",
+		EnvVar: "MAX_PARTITIONS",
+		Value:  8,
+	})
+	queries := app.String(cli.StringOpt{
+		Name:   "queries",
+		Desc:   `Back up only the documents and fields selected by a filter and projection, as a JSON object of <database>/<collection> entries (e.g. {"upp-store/pages": {"filter": {"type": "article"}, "projection": {"body": 0}}})`,
+		EnvVar: "COLLECTION_QUERIES",
+	})
+	masking := app.String(cli.StringOpt{
+		Name:   "masking-rules",
+		Desc:   `Mask personal data as backups are taken, or as they are restored, as a JSON object of <database>/<collection> entries mapping fields to hash, fake, null or drop (e.g. {"users/accounts": {"email": "hash", "address.street": "fake", "notes": "drop"}})`,
+		EnvVar: "MASKING_RULES",
+	})
+	maskingSalt := app.String(cli.StringOpt{
+		Name:   "masking-salt",
+		Desc:   "Secret the hashes and fake values of masked fields are keyed with",
+		EnvVar: "MASKING_SALT",
+	})
+	codecName := app.String(cli.StringOpt{
+		Name:   "codec",
+		Desc:   "Compression of new backups: snappy, zstd, gzip or none. Restores detect the codec of each backup",
+		EnvVar: "CODEC",
+		Value:  string(snappyCodec),
+	})
+	codecLevel := app.Int(cli.IntOpt{
+		Name:   "codec-level",
+		Desc:   "Compression level for zstd (1-22) or gzip (1-9), 0 for the default level of the codec",
+		EnvVar: "CODEC_LEVEL",
+		Value:  0,
+	})
+	backupFormat := app.String(cli.StringOpt{
+		Name:   "format",
+		Desc:   "Format recorded for new backups: native, or mongodump to make sure every run stays a mongodump output directory which stock mongorestore can restore (only allows the gzip or none codec, without encryption or partitioning)",
+		EnvVar: "BACKUP_FORMAT",
+		Value:  nativeFormat,
+	})
+	restoreWorkers := app.Int(cli.IntOpt{
+		Name:   "restore-workers",
+		Desc:   "Number of bulk writes a restore issues at once, all within the rate limit",
+		EnvVar: "RESTORE_WORKERS",
+		Value:  1,
+	})
 	batchLimit := app.Int(cli.IntOpt{
 		Name:   "batchLimit",
 		Desc:   "The size of data in bytes, that a bulk write is writing into mongodb at once. Not recommended to use more than 16MB (e.g. 15000000)",
 		EnvVar: "BATCH_LIMIT",
 		Value:  15000000,
 	})
+	keepDaily := app.Int(cli.IntOpt{
+		Name:   "keep-daily",
+		Desc:   "Number of days for which pruning keeps the newest complete backup",
+		EnvVar: "KEEP_DAILY",
+		Value:  7,
+	})
+	keepWeekly := app.Int(cli.IntOpt{
+		Name:   "keep-weekly",
+		Desc:   "Number of weeks for which pruning keeps the newest complete backup",
+		EnvVar: "KEEP_WEEKLY",
+		Value:  4,
+	})
+	keepMonthly := app.Int(cli.IntOpt{
+		Name:   "keep-monthly",
+		Desc:   "Number of months for which pruning keeps the newest complete backup",
+		EnvVar: "KEEP_MONTHLY",
+		Value:  12,
+	})
+	pruneUnfinishedAfter := app.String(cli.StringOpt{
+		Name:   "prune-unfinished-after",
+		Desc:   "How long pruning keeps backups without a manifest as possibly still in progress, after which they count as incomplete (e.g. 24h)",
+		EnvVar: "PRUNE_UNFINISHED_AFTER",
+		Value:  "24h",
+	})
+	encryptionKeyProvider := app.String(cli.StringOpt{
+		Name:   "encryption-key-provider",
+		Desc:   "Encrypt backups with a data key wrapped by this key provider: keyfile, or empty for no encryption",
+		EnvVar: "ENCRYPTION_KEY_PROVIDER",
+		Value:  "",
+	})
+	encryptionKeyfile := app.String(cli.StringOpt{
+		Name:   "encryption-keyfile",
+		Desc:   "Path of the file holding the 32 byte master key, raw or base64 encoded, for the keyfile key provider",
+		EnvVar: "ENCRYPTION_KEYFILE",
+		Value:  "",
+	})
+	shared := sharedOptions{
+		storageBackend:        storageBackend,
+		s3bucket:              s3bucket,
+		s3BucketRegion:        s3BucketRegion,
+		s3dir:                 s3dir,
+		encryptionKeyProvider: encryptionKeyProvider,
+		encryptionKeyfile:     encryptionKeyfile,
+		codecName:             codecName,
+		codecLevel:            codecLevel,
+		masking:               masking,
+		maskingSalt:           maskingSalt,
+	}
 
 	app.Command("scheduled-backup", "backup a set of mongodb collections", func(cmd *cli.Cmd) {
 		cronExpr := cmd.String(cli.StringOpt{
@@ -95,43 +258,122 @@ func main() {
 			EnvVar: "HEALTH_HOURS",
 			Value:  24,
 		})
+		oplog := cmd.Bool(cli.BoolOpt{
+			Name:   "oplog",
+			Desc:   "Continuously capture the oplog of the collections, to allow point-in-time restores",
+			EnvVar: "OPLOG",
+			Value:  false,
+		})
+		oplogSegment := cmd.String(cli.StringOpt{
+			Name:   "oplog-segment",
+			Desc:   "Length of time covered by each stored oplog segment (e.g. 10m)",
+			EnvVar: "OPLOG_SEGMENT",
+			Value:  "10m",
+		})
+		prune := cmd.Bool(cli.BoolOpt{
+			Name:   "prune",
+			Desc:   "Prune old backups according to the keep-daily, keep-weekly and keep-monthly policy after every backup",
+			EnvVar: "PRUNE",
+			Value:  false,
+		})
 
 		cmd.Action = func() {
-			parsedColls, err := parseCollections(*colls)
+			selection, err := parseCollectionSelection(*colls)
 			if err != nil {
 				log.Fatalf("error parsing collections parameter: %v", err)
 			}
 
+			readPref, err := parseReadPreference(*readPreference, *readPreferenceTags, *maxStaleness)
+			if err != nil {
+				log.Fatalf("error parsing read preference parameters: %v", err)
+			}
+
+			conn := connectionOptions{
+				tlsCAFile:             *tlsCAFile,
+				tlsCertificateKeyFile: *tlsCertificateKeyFile,
+				authMechanism:         *authMechanism,
+				authSource:            *authSource,
+				username:              *username,
+				passwordFile:          *passwordFile,
+			}
 			timeout := time.Duration(*mongoTimeout) * time.Second
 			ctx, cancel := context.WithTimeout(context.Background(), timeout)
 			defer cancel()
 
-			mongoClient, err := newMongoClient(ctx, *connStr, timeout)
+			mongoClient, err := newMongoClient(ctx, *connStr, timeout, conn, readPref)
 			if err != nil {
 				log.WithError(err).Fatal("Error establishing mongo connection")
 			}
 
-			dbService := newMongoService(mongoClient, &defaultBsonService{}, time.Duration(*rateLimit)*time.Millisecond, *batchLimit)
+			dbService := newMongoService(mongoClient, &defaultBsonService{}, time.Duration(*rateLimit)*time.Millisecond, *batchLimit, *restoreWorkers, throttleOptions{})
 			statusKeeper, err := newBoltStatusKeeper(*dbPath)
 			if err != nil {
 				log.Fatalf("failed setting up to read or write scheduled backup status results: %v", err)
 			}
 			defer statusKeeper.Close()
 
-			sess, err := session.NewSession(aws.NewConfig().WithRegion(*s3BucketRegion))
+			services, err := shared.services()
 			if err != nil {
-				log.WithError(err).Fatal("Creating AWS session failed")
+				log.Fatal(err)
 			}
 
-			storageService := newS3StorageService(*s3bucket, *s3dir, sess)
-			backupService := newMongoBackupService(dbService, storageService, statusKeeper)
-			scheduler := newCronScheduler(backupService, statusKeeper)
+			collectionQueries, err := parseCollectionQueries(*queries)
+			if err != nil {
+				log.Fatalf("error parsing queries parameter: %v", err)
+			}
+
+			options := backupOptions{
+				snapshot:      *snapshot,
+				keyProvider:   services.keyProvider,
+				compression:   services.compression,
+				parallelism:   *parallelism,
+				partitionSize: int64(*partitionSize),
+				maxPartitions: *maxPartitions,
+				queries:       collectionQueries,
+				masking:       services.maskingRules,
+				format:        *backupFormat,
+			}
+			if err := checkBackupFormat(options); err != nil {
+				log.Fatalf("error parsing format parameter: %v", err)
+			}
+			backupService := newMongoBackupService(dbService, services.storageService, statusKeeper, options)
+			var pruneService *pruneService
+			if *prune {
+				policy, err := parseRetentionPolicy(*keepDaily, *keepWeekly, *keepMonthly, *pruneUnfinishedAfter)
+				if err != nil {
+					log.Fatalf("error parsing retention policy: %v", err)
+				}
+				pruneService = newPruneService(services.storageService, policy)
+			}
+			scheduler := newCronScheduler(backupService, statusKeeper, pruneService)
+			// Every backup run matches the patterns again, the health checks
+			// and oplog capture cover the collections matched at start up.
+			parsedColls, err := selection.resolve(ctx, dbService.ListCollections)
+			if err != nil {
+				log.Fatalf("error resolving collections parameter: %v", err)
+			}
 			healthService := newHealthService(*healthHours, statusKeeper, parsedColls, healthConfig{
 				appSystemCode: systemCode,
 				appName:       "mongobackup",
 			})
+			if *oplog {
+				segmentLength, err := time.ParseDuration(*oplogSegment)
+				if err != nil {
+					log.Fatalf("error parsing oplog-segment parameter: %v", err)
+				}
+				// The oplog is captured unmasked, so it would store the
+				// values the backups mask.
+				for _, coll := range parsedColls {
+					if services.maskingRules.lookup(coll) != nil {
+						log.Fatalf("the oplog of %s can't be captured, its masking rules would not apply to it", coll)
+					}
+				}
+				oplogService := newOplogService(dbService, services.storageService, &defaultBsonService{}, services.keyProvider, segmentLength)
+				go oplogService.Run(context.Background(), parsedColls)
+			}
+
 			httpService := newScheduleHTTPService(scheduler, healthService)
-			httpService.ScheduleAndServe(parsedColls, *cronExpr, *run)
+			httpService.ScheduleAndServe(selection, *cronExpr, *run)
 		}
 	})
 
@@ -144,35 +386,66 @@ func main() {
 		})
 
 		cmd.Action = func() {
-			parsedColls, err := parseCollections(*colls)
+			selection, err := parseCollectionSelection(*colls)
 			if err != nil {
 				log.Fatalf("error parsing collections parameter: %v", err)
 			}
 
+			readPref, err := parseReadPreference(*readPreference, *readPreferenceTags, *maxStaleness)
+			if err != nil {
+				log.Fatalf("error parsing read preference parameters: %v", err)
+			}
+
+			conn := connectionOptions{
+				tlsCAFile:             *tlsCAFile,
+				tlsCertificateKeyFile: *tlsCertificateKeyFile,
+				authMechanism:         *authMechanism,
+				authSource:            *authSource,
+				username:              *username,
+				passwordFile:          *passwordFile,
+			}
 			timeout := time.Duration(*mongoTimeout) * time.Second
 			ctx, cancel := context.WithTimeout(context.Background(), timeout)
 			defer cancel()
 
-			mongoClient, err := newMongoClient(ctx, *connStr, timeout)
+			mongoClient, err := newMongoClient(ctx, *connStr, timeout, conn, readPref)
 			if err != nil {
 				log.WithError(err).Fatal("Error establishing mongo connection")
 			}
 
-			dbService := newMongoService(mongoClient, &defaultBsonService{}, time.Duration(*rateLimit)*time.Millisecond, *batchLimit)
+			dbService := newMongoService(mongoClient, &defaultBsonService{}, time.Duration(*rateLimit)*time.Millisecond, *batchLimit, *restoreWorkers, throttleOptions{})
 			statusKeeper, err := newBoltStatusKeeper(*dbPath)
 			if err != nil {
 				log.Fatalf("failed setting up to read or write scheduled backup status results: %v", err)
 			}
 			defer statusKeeper.Close()
 
-			sess, err := session.NewSession(aws.NewConfig().WithRegion(*s3BucketRegion))
+			services, err := shared.services()
 			if err != nil {
-				log.WithError(err).Fatal("Creating AWS session failed")
+				log.Fatal(err)
 			}
 
-			storageService := newS3StorageService(*s3bucket, *s3dir, sess)
-			backupService := newMongoBackupService(dbService, storageService, statusKeeper)
-			if err := backupService.Backup(context.Background(), parsedColls); err != nil {
+			collectionQueries, err := parseCollectionQueries(*queries)
+			if err != nil {
+				log.Fatalf("error parsing queries parameter: %v", err)
+			}
+
+			options := backupOptions{
+				snapshot:      *snapshot,
+				keyProvider:   services.keyProvider,
+				compression:   services.compression,
+				parallelism:   *parallelism,
+				partitionSize: int64(*partitionSize),
+				maxPartitions: *maxPartitions,
+				queries:       collectionQueries,
+				masking:       services.maskingRules,
+				format:        *backupFormat,
+			}
+			if err := checkBackupFormat(options); err != nil {
+				log.Fatalf("error parsing format parameter: %v", err)
+			}
+			backupService := newMongoBackupService(dbService, services.storageService, statusKeeper, options)
+			if err := backupService.Backup(context.Background(), selection); err != nil {
 				log.Fatalf("backup failed : %v", err)
 			}
 		}
@@ -184,51 +457,482 @@ func main() {
 			EnvVar: "DATE",
 			Value:  dateFormat,
 		})
+		restoreTo := cmd.String(cli.StringOpt{
+			Name:   "to",
+			Desc:   "Point in time to restore to (RFC 3339 or 2006-01-02T15-04-05), using the nearest backup before it and the captured oplog. Overrides date.",
+			EnvVar: "RESTORE_TO",
+		})
+		indexes := cmd.String(cli.StringOpt{
+			Name:   "indexes",
+			Desc:   "Build the indexes of a collection before or after loading its documents (before or after)",
+			EnvVar: "RESTORE_INDEXES",
+			Value:  string(indexesAfterData),
+		})
+		mode := cmd.String(cli.StringOpt{
+			Name:   "mode",
+			Desc:   "How to combine the backup with existing documents (replace, upsert, insert-missing, fail-if-not-empty or swap)",
+			EnvVar: "RESTORE_MODE",
+			Value:  string(restoreReplace),
+		})
+		targets := cmd.String(cli.StringOpt{
+			Name:   "target",
+			Desc:   "Restore collections into other namespaces (comma separated <database>/<collection>=<database>/<collection>)",
+			EnvVar: "RESTORE_TARGET",
+		})
+		maxLag := cmd.String(cli.StringOpt{
+			Name:   "max-replication-lag",
+			Desc:   "Slow down bulk writes while a secondary lags behind the primary by more than this (e.g. 10s), and pause them at twice as much. Empty doesn't check the lag",
+			EnvVar: "MAX_REPLICATION_LAG",
+		})
+		maxWriteQueue := cmd.Int(cli.IntOpt{
+			Name:   "max-write-queue",
+			Desc:   "Slow down bulk writes while more operations than this wait for a write lock on the primary, and pause them at twice as many. 0 doesn't check the queue",
+			EnvVar: "MAX_WRITE_QUEUE",
+			Value:  0,
+		})
+		ids := cmd.String(cli.StringOpt{
+			Name:   "ids",
+			Desc:   "Only restore the documents whose _id is listed in this file (one per line), upserting them and keeping the other documents",
+			EnvVar: "RESTORE_IDS",
+		})
+		filter := cmd.String(cli.StringOpt{
+			Name:   "filter",
+			Desc:   "Only restore the documents matching this query (relaxed extended JSON), upserting them and keeping the other documents",
+			EnvVar: "RESTORE_FILTER",
+		})
+		allowPartial := cmd.Bool(cli.BoolOpt{
+			Name:   "allow-partial",
+			Desc:   "Restore partial backups even in modes which remove the documents or fields their query left out",
+			EnvVar: "RESTORE_ALLOW_PARTIAL",
+			Value:  false,
+		})
 		cmd.Action = func() {
-			parsedColls, err := parseCollections(*colls)
+			selection, err := parseCollectionSelection(*colls)
 			if err != nil {
 				log.Fatalf("error parsing collections parameter: %v", err)
 			}
+			indexOrder, err := parseIndexBuildOrder(*indexes)
+			if err != nil {
+				log.Fatalf("error parsing indexes parameter: %v", err)
+			}
+			restoreMode, err := parseRestoreMode(*mode)
+			if err != nil {
+				log.Fatalf("error parsing mode parameter: %v", err)
+			}
+			throttle, err := parseThrottleOptions(*maxLag, *maxWriteQueue)
+			if err != nil {
+				log.Fatalf("error parsing restore throttle parameters: %v", err)
+			}
+			documents, err := newDocumentSelection(*ids, *filter)
+			if err != nil {
+				log.Fatalf("error parsing ids or filter parameter: %v", err)
+			}
+			if documents != nil {
+				if *restoreTo != "" {
+					log.Fatal("ids and filter can't be used with point-in-time restores")
+				}
+				if restoreMode, err = selectionRestoreMode(restoreMode); err != nil {
+					log.Fatalf("error parsing mode parameter: %v", err)
+				}
+			}
 
+			conn := connectionOptions{
+				tlsCAFile:             *tlsCAFile,
+				tlsCertificateKeyFile: *tlsCertificateKeyFile,
+				authMechanism:         *authMechanism,
+				authSource:            *authSource,
+				username:              *username,
+				passwordFile:          *passwordFile,
+			}
 			timeout := time.Duration(*mongoTimeout) * time.Second
 			ctx, cancel := context.WithTimeout(context.Background(), timeout)
 			defer cancel()
 
-			mongoClient, err := newMongoClient(ctx, *connStr, timeout)
+			mongoClient, err := newMongoClient(ctx, *connStr, timeout, conn, nil)
 			if err != nil {
 				log.WithError(err).Fatal("Error establishing mongo connection")
 			}
 
-			dbService := newMongoService(mongoClient, &defaultBsonService{}, time.Duration(*rateLimit)*time.Millisecond, *batchLimit)
+			dbService := newMongoService(mongoClient, &defaultBsonService{}, time.Duration(*rateLimit)*time.Millisecond, *batchLimit, *restoreWorkers, throttle)
 
-			sess, err := session.NewSession(aws.NewConfig().WithRegion(*s3BucketRegion))
+			services, err := shared.services()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			// Patterns are matched against the collections of the backup.
+			parsedColls, err := selection.resolve(context.Background(), func(ctx context.Context) ([]dbColl, error) {
+				if *restoreTo != "" {
+					return nil, fmt.Errorf("point-in-time restores need the collections named without patterns")
+				}
+				return storedCollections(ctx, services.storageService, *dateDir)
+			})
 			if err != nil {
-				log.WithError(err).Fatal("Creating AWS session failed")
+				log.Fatalf("error resolving collections parameter: %v", err)
 			}
+			targetMap, err := parseRestoreTargets(*targets, parsedColls)
+			if err != nil {
+				log.Fatalf("error parsing target parameter: %v", err)
+			}
+			if services.maskingRules != nil && *restoreTo != "" {
+				log.Fatal("masking rules can't be used with point-in-time restores, the oplog is replayed unmasked")
+			}
+			options := restoreOptions{indexes: indexOrder, targets: targetMap, mode: restoreMode, masking: services.maskingRules, documents: documents, allowPartial: *allowPartial}
+
+			backupService := newMongoBackupService(dbService, services.storageService, &boltStatusKeeper{}, backupOptions{keyProvider: services.keyProvider})
 
-			storageService := newS3StorageService(*s3bucket, *s3dir, sess)
-			backupService := newMongoBackupService(dbService, storageService, &boltStatusKeeper{})
-			if err := backupService.Restore(context.Background(), *dateDir, parsedColls); err != nil {
+			if *restoreTo != "" {
+				to, err := parseRestoreTime(*restoreTo)
+				if err != nil {
+					log.Fatalf("error parsing to parameter: %v", err)
+				}
+				oplogService := newOplogService(dbService, services.storageService, &defaultBsonService{}, services.keyProvider, 0)
+				if err := oplogService.RestoreTo(context.Background(), backupService, to, parsedColls, options); err != nil {
+					log.Fatalf("restore failed : %v", err)
+				}
+				return
+			}
+
+			if err := backupService.Restore(context.Background(), *dateDir, parsedColls, options); err != nil {
 				log.Fatalf("restore failed : %v", err)
 			}
 		}
 	})
 
+	app.Command("list", "list the backups available in the storage backend", func(cmd *cli.Cmd) {
+		jsonOutput := cmd.Bool(cli.BoolOpt{
+			Name:  "json",
+			Desc:  "Print the list as JSON",
+			Value: false,
+		})
+
+		cmd.Action = func() {
+			services, err := shared.services()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			listings, err := newCatalogService(services.storageService).List(context.Background())
+			if err != nil {
+				log.Fatalf("listing backups failed : %v", err)
+			}
+
+			if *jsonOutput {
+				err = printListingsJSON(os.Stdout, listings)
+			} else {
+				err = printListings(os.Stdout, listings)
+			}
+			if err != nil {
+				log.Fatalf("printing backups failed : %v", err)
+			}
+		}
+	})
+
+	app.Command("verify", "verify that a stored backup can be read back completely, without touching mongodb", func(cmd *cli.Cmd) {
+		dateDir := cmd.String(cli.StringOpt{
+			Name:   "date",
+			Desc:   "Date of the backup to verify",
+			EnvVar: "DATE",
+			Value:  dateFormat,
+		})
+
+		cmd.Action = func() {
+			services, err := shared.services()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			verifyService := newVerifyService(services.storageService, &defaultBsonService{}, services.keyProvider)
+			results, err := verifyService.Verify(context.Background(), *dateDir)
+			if err != nil {
+				log.Fatalf("verify failed : %v", err)
+			}
+
+			if err = printVerifyResults(os.Stdout, results); err != nil {
+				log.Fatalf("printing verify results failed : %v", err)
+			}
+			for _, result := range results {
+				if !result.OK() {
+					log.Fatalf("backup %s failed verification", *dateDir)
+				}
+			}
+		}
+	})
+
+	app.Command("export", "write the documents of a stored collection as newline delimited extended JSON, without touching mongodb", func(cmd *cli.Cmd) {
+		dateDir := cmd.String(cli.StringOpt{
+			Name:   "date",
+			Desc:   "Date of the backup to export from",
+			EnvVar: "DATE",
+			Value:  dateFormat,
+		})
+		collection := cmd.String(cli.StringOpt{
+			Name:   "collection",
+			Desc:   "Collection to export (<database>/<collection>)",
+			EnvVar: "EXPORT_COLLECTION",
+		})
+		where := cmd.String(cli.StringOpt{
+			Name:   "where",
+			Desc:   `Only export documents whose field compares to a value, as <field><operator><value> with =, !=, <, <=, > or >= (e.g. _id=62a1f0c2e4b0a1b2c3d4e5f6, address.city="London" or version>=3)`,
+			EnvVar: "EXPORT_WHERE",
+		})
+		canonical := cmd.Bool(cli.BoolOpt{
+			Name:   "canonical",
+			Desc:   "Write canonical extended JSON, which keeps every BSON type, instead of relaxed extended JSON",
+			EnvVar: "EXPORT_CANONICAL",
+			Value:  false,
+		})
+		output := cmd.String(cli.StringOpt{
+			Name:   "output",
+			Desc:   "File to write to, - for stdout",
+			EnvVar: "EXPORT_OUTPUT",
+			Value:  "-",
+		})
+
+		cmd.Action = func() {
+			coll, err := parseDBColl(*collection)
+			if err != nil {
+				log.Fatalf("error parsing collection parameter: %v", err)
+			}
+
+			options := exportOptions{canonical: *canonical}
+			if *where != "" {
+				if options.where, err = parseFieldPredicate(*where); err != nil {
+					log.Fatalf("error parsing where parameter: %v", err)
+				}
+			}
+
+			services, err := shared.services()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			out := os.Stdout
+			if *output != "-" {
+				if out, err = os.Create(*output); err != nil {
+					log.Fatalf("error creating output file: %v", err)
+				}
+			}
+
+			exported, err := newExportService(services.storageService, &defaultBsonService{}, services.keyProvider).Export(context.Background(), *dateDir, coll, options, out)
+			if err != nil {
+				log.Fatalf("export failed : %v", err)
+			}
+			if err = out.Close(); err != nil {
+				log.Fatalf("error closing output file: %v", err)
+			}
+
+			log.Infof("Exported %d documents of %s from the backup of %s", exported, coll, *dateDir)
+		}
+	})
+
+	app.Command("archive", "write stored collections as a mongodump --archive stream, which mongorestore --archive can restore", func(cmd *cli.Cmd) {
+		dateDir := cmd.String(cli.StringOpt{
+			Name:   "date",
+			Desc:   "Date of the backup to archive",
+			EnvVar: "DATE",
+			Value:  dateFormat,
+		})
+		gzipped := cmd.Bool(cli.BoolOpt{
+			Name:   "gzip",
+			Desc:   "Compress the archive with gzip, like mongodump --gzip",
+			EnvVar: "ARCHIVE_GZIP",
+			Value:  false,
+		})
+		output := cmd.String(cli.StringOpt{
+			Name:   "output",
+			Desc:   "File to write to, - for stdout",
+			EnvVar: "ARCHIVE_OUTPUT",
+			Value:  "-",
+		})
+
+		cmd.Action = func() {
+			selection, err := parseCollectionSelection(*colls)
+			if err != nil {
+				log.Fatalf("error parsing collections parameter: %v", err)
+			}
+
+			services, err := shared.services()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			parsedColls, err := selection.resolve(context.Background(), func(ctx context.Context) ([]dbColl, error) {
+				return storedCollections(ctx, services.storageService, *dateDir)
+			})
+			if err != nil {
+				log.Fatalf("error resolving collections parameter: %v", err)
+			}
+
+			out := os.Stdout
+			if *output != "-" {
+				if out, err = os.Create(*output); err != nil {
+					log.Fatalf("error creating output file: %v", err)
+				}
+			}
+			var w io.WriteCloser = out
+			if *gzipped {
+				w = gzip.NewWriter(out)
+			}
+
+			if err = newExportService(services.storageService, &defaultBsonService{}, services.keyProvider).Archive(context.Background(), *dateDir, parsedColls, w); err != nil {
+				log.Fatalf("archive failed : %v", err)
+			}
+			if *gzipped {
+				if err = w.Close(); err != nil {
+					log.Fatalf("error closing archive: %v", err)
+				}
+			}
+			if err = out.Close(); err != nil {
+				log.Fatalf("error closing output file: %v", err)
+			}
+
+			log.Infof("Archived %d collections of the backup of %s", len(parsedColls), *dateDir)
+		}
+	})
+
+	app.Command("import", "store a mongodump archive or output directory as a backup, which restore can then restore", func(cmd *cli.Cmd) {
+		archive := cmd.String(cli.StringOpt{
+			Name:   "archive",
+			Desc:   "mongodump --archive file to import, gzipped or not, - for stdin",
+			EnvVar: "IMPORT_ARCHIVE",
+		})
+		dir := cmd.String(cli.StringOpt{
+			Name:   "dir",
+			Desc:   "mongodump output directory to import, holding <database>/<collection>.bson and .metadata.json files, gzipped or not",
+			EnvVar: "IMPORT_DIR",
+		})
+
+		cmd.Action = func() {
+			if (*archive == "") == (*dir == "") {
+				log.Fatal("exactly one of archive and dir has to be given")
+			}
+
+			services, err := shared.services()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			options := backupOptions{keyProvider: services.keyProvider, compression: services.compression, masking: services.maskingRules}
+			backupService := newMongoBackupService(nil, services.storageService, &boltStatusKeeper{}, options)
+
+			var date string
+			if *dir != "" {
+				date, err = backupService.ImportDirectory(context.Background(), *dir)
+			} else {
+				in := os.Stdin
+				if *archive != "-" {
+					if in, err = os.Open(*archive); err != nil {
+						log.Fatalf("error opening archive: %v", err)
+					}
+				}
+				date, err = backupService.ImportArchive(context.Background(), in)
+				_ = in.Close()
+			}
+			if err != nil {
+				log.Fatalf("import failed : %v", err)
+			}
+
+			fmt.Println(date)
+		}
+	})
+
+	app.Command("prune", "delete the backups which the keep-daily, keep-weekly and keep-monthly retention policy doesn't keep", func(cmd *cli.Cmd) {
+		dryRun := cmd.Bool(cli.BoolOpt{
+			Name:   "dry-run",
+			Desc:   "Only print what would be deleted",
+			EnvVar: "DRY_RUN",
+			Value:  false,
+		})
+
+		cmd.Action = func() {
+			services, err := shared.services()
+			if err != nil {
+				log.Fatal(err)
+			}
+
+			policy, err := parseRetentionPolicy(*keepDaily, *keepWeekly, *keepMonthly, *pruneUnfinishedAfter)
+			if err != nil {
+				log.Fatalf("error parsing retention policy: %v", err)
+			}
+			pruneService := newPruneService(services.storageService, policy)
+			decisions, err := pruneService.Prune(context.Background(), *dryRun)
+			if err != nil {
+				log.Fatalf("prune failed : %v", err)
+			}
+
+			if err = printPruneDecisions(os.Stdout, decisions, *dryRun); err != nil {
+				log.Fatalf("printing prune results failed : %v", err)
+			}
+		}
+	})
+
 	err := app.Run(os.Args)
 	if err != nil {
 		log.Fatal(err)
 	}
 }
 
-func parseCollections(colls string) ([]dbColl, error) {
-	var cn []dbColl
-	for _, coll := range strings.Split(colls, ",") {
-		c := strings.Split(coll, "/")
-		if len(c) != 2 {
-			return nil, fmt.Errorf("failed to parse connections string: %s", colls)
-		}
-		cn = append(cn, dbColl{c[0], c[1]})
+// sharedOptions are the app options which set up the services most commands
+// share.
+type sharedOptions struct {
+	storageBackend        *string
+	s3bucket              *string
+	s3BucketRegion        *string
+	s3dir                 *string
+	encryptionKeyProvider *string
+	encryptionKeyfile     *string
+	codecName             *string
+	codecLevel            *int
+	masking               *string
+	maskingSalt           *string
+}
+
+type sharedServices struct {
+	storageService storageService
+	keyProvider    keyProvider
+	compression    compression
+	maskingRules   maskingRules
+}
+
+// services sets up the storage backend, encryption, compression and masking
+// rules the options ask for.
+func (o sharedOptions) services() (*sharedServices, error) {
+	storageService, err := newStorageService(*o.storageBackend, *o.s3bucket, *o.s3BucketRegion, *o.s3dir)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up storage backend: %v", err)
 	}
+	keyProvider, err := newKeyProvider(*o.encryptionKeyProvider, *o.encryptionKeyfile)
+	if err != nil {
+		return nil, fmt.Errorf("error setting up encryption: %v", err)
+	}
+	compression, err := parseCompression(*o.codecName, *o.codecLevel)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing codec parameters: %v", err)
+	}
+	maskingRules, err := parseMaskingRules(*o.masking, *o.maskingSalt)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing masking-rules parameter: %v", err)
+	}
+	return &sharedServices{
+		storageService: storageService,
+		keyProvider:    keyProvider,
+		compression:    compression,
+		maskingRules:   maskingRules,
+	}, nil
+}
 
-	return cn, nil
+func newStorageService(backend, bucket, region, dir string) (storageService, error) {
+	switch backend {
+	case "s3":
+		sess, err := session.NewSession(aws.NewConfig().WithRegion(region))
+		if err != nil {
+			return nil, fmt.Errorf("creating AWS session failed: %v", err)
+		}
+		return newS3StorageService(bucket, dir, sess), nil
+	case "fs":
+		return newFSStorageService(dir), nil
+	default:
+		return nil, fmt.Errorf("unknown storage backend: %s", backend)
+	}
 }
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"hash"
+	"hash/crc64"
+	"io"
+
+	"github.com/klauspost/compress/gzip"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// The layout of mongodump --archive streams: a magic number, a prelude with a
+// header and the metadata of every namespace, and a body of blocks. A block
+// is a namespace header followed by documents of the namespace, or, once all
+// of them are written, a header marking the end of the namespace. The prelude
+// and every block end with a terminator.
+const (
+	archiveMagic         uint32 = 0x8199e26d
+	archiveFormatVersion        = "0.1"
+	archiveTerminator    uint32 = 0xffffffff
+	// maxArchiveDocumentSize leaves room over the 16MB MongoDB allows, and
+	// keeps a corrupt size from allocating arbitrary memory.
+	maxArchiveDocumentSize = 48 * 1024 * 1024
+)
+
+var archiveCRCTable = crc64.MakeTable(crc64.ECMA)
+
+type archiveHeader struct {
+	ConcurrentCollections int32  `bson:"concurrent_collections"`
+	FormatVersion         string `bson:"version"`
+	ServerVersion         string `bson:"server_version"`
+	ToolVersion           string `bson:"tool_version"`
+}
+
+// archiveCollection is the prelude entry of a namespace. Metadata holds the
+// content of the .metadata.json file mongodump writes into a directory.
+type archiveCollection struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"collection"`
+	Metadata   string `bson:"metadata"`
+	Size       int64  `bson:"size"`
+	Type       string `bson:"type,omitempty"`
+}
+
+type archiveNamespaceHeader struct {
+	Database   string `bson:"db"`
+	Collection string `bson:"collection"`
+	EOF        bool   `bson:"EOF"`
+	CRC        int64  `bson:"CRC"`
+}
+
+// archiveWriter writes a mongodump --archive stream, one namespace after the
+// other.
+type archiveWriter struct {
+	writer io.Writer
+	header archiveNamespaceHeader
+	crc    hash.Hash64
+}
+
+// newArchiveWriter writes the prelude of an archive holding the given
+// collections.
+func newArchiveWriter(writer io.Writer, header archiveHeader, collections []archiveCollection) (*archiveWriter, error) {
+	header.FormatVersion = archiveFormatVersion
+	if header.ConcurrentCollections == 0 {
+		header.ConcurrentCollections = 1
+	}
+
+	a := &archiveWriter{writer: writer}
+	if err := a.writeUint32(archiveMagic); err != nil {
+		return nil, err
+	}
+	if err := a.writeBSON(header); err != nil {
+		return nil, err
+	}
+	for _, coll := range collections {
+		if err := a.writeBSON(coll); err != nil {
+			return nil, err
+		}
+	}
+	return a, a.writeUint32(archiveTerminator)
+}
+
+// beginCollection starts the block of documents of a namespace.
+func (a *archiveWriter) beginCollection(database, collection string) error {
+	a.header = archiveNamespaceHeader{Database: database, Collection: collection}
+	a.crc = crc64.New(archiveCRCTable)
+	return a.writeBSON(a.header)
+}
+
+func (a *archiveWriter) writeDocument(doc []byte) error {
+	_, _ = a.crc.Write(doc)
+	_, err := a.writer.Write(doc)
+	return err
+}
+
+// endCollection ends the block of documents of the namespace, and marks the
+// end of the namespace with the checksum of its documents.
+func (a *archiveWriter) endCollection() error {
+	if err := a.writeUint32(archiveTerminator); err != nil {
+		return err
+	}
+	a.header.EOF = true
+	a.header.CRC = int64(a.crc.Sum64())
+	if err := a.writeBSON(a.header); err != nil {
+		return err
+	}
+	return a.writeUint32(archiveTerminator)
+}
+
+func (a *archiveWriter) writeBSON(value interface{}) error {
+	data, err := bson.Marshal(value)
+	if err != nil {
+		return err
+	}
+	_, err = a.writer.Write(data)
+	return err
+}
+
+func (a *archiveWriter) writeUint32(value uint32) error {
+	var b [4]byte
+	binary.LittleEndian.PutUint32(b[:], value)
+	_, err := a.writer.Write(b[:])
+	return err
+}
+
+// archiveReader reads a mongodump --archive stream.
+type archiveReader struct {
+	reader      io.Reader
+	header      archiveHeader
+	collections []archiveCollection
+	crcs        map[dbColl]hash.Hash64
+	current     archiveNamespaceHeader
+}
+
+// newArchiveReader reads the prelude of an archive. Archives written with
+// mongodump --gzip are detected and decompressed.
+func newArchiveReader(reader io.Reader) (*archiveReader, error) {
+	buffered := bufio.NewReader(reader)
+	if magic, err := buffered.Peek(2); err == nil && bytes.Equal(magic, []byte{0x1f, 0x8b}) {
+		gz, err := gzip.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read gzipped archive: %v", err)
+		}
+		reader = gz
+	} else {
+		reader = buffered
+	}
+
+	a := &archiveReader{reader: reader, crcs: map[dbColl]hash.Hash64{}}
+	var magic [4]byte
+	if _, err := io.ReadFull(reader, magic[:]); err != nil {
+		return nil, fmt.Errorf("couldn't read archive: %v", err)
+	}
+	if binary.LittleEndian.Uint32(magic[:]) != archiveMagic {
+		return nil, fmt.Errorf("not a mongodump archive")
+	}
+
+	header, err := a.readDocument()
+	if err != nil || header == nil {
+		return nil, fmt.Errorf("couldn't read archive header: %v", err)
+	}
+	if err = bson.Unmarshal(header, &a.header); err != nil {
+		return nil, fmt.Errorf("couldn't read archive header: %v", err)
+	}
+	if a.header.FormatVersion != archiveFormatVersion {
+		return nil, fmt.Errorf("unsupported archive format version %s", a.header.FormatVersion)
+	}
+
+	for {
+		doc, err := a.readDocument()
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read archive prelude: %v", err)
+		}
+		if doc == nil {
+			return a, nil
+		}
+		var coll archiveCollection
+		if err = bson.Unmarshal(doc, &coll); err != nil {
+			return nil, fmt.Errorf("couldn't read archive prelude: %v", err)
+		}
+		a.collections = append(a.collections, coll)
+	}
+}
+
+// nextBlock reads the header of the next block of the body, and returns
+// io.EOF at the end of the archive. The documents of a block are read with
+// readBlock. A header marking the end of a namespace is checked against the
+// documents read for the namespace, and has no documents.
+func (a *archiveReader) nextBlock() (archiveNamespaceHeader, error) {
+	doc, err := a.readDocument()
+	if err == io.EOF {
+		return archiveNamespaceHeader{}, io.EOF
+	}
+	if err != nil || doc == nil {
+		return archiveNamespaceHeader{}, fmt.Errorf("couldn't read archive block: %v", err)
+	}
+	var header archiveNamespaceHeader
+	if err = bson.Unmarshal(doc, &header); err != nil {
+		return archiveNamespaceHeader{}, fmt.Errorf("couldn't read archive block: %v", err)
+	}
+
+	coll := dbColl{header.Database, header.Collection}
+	if _, ok := a.crcs[coll]; !ok {
+		a.crcs[coll] = crc64.New(archiveCRCTable)
+	}
+	a.current = header
+	if !header.EOF {
+		return header, nil
+	}
+
+	if header.CRC != 0 && uint64(header.CRC) != a.crcs[coll].Sum64() {
+		return archiveNamespaceHeader{}, fmt.Errorf("checksum of %s/%s doesn't match its documents", header.Database, header.Collection)
+	}
+	if doc, err = a.readDocument(); err != nil || doc != nil {
+		return archiveNamespaceHeader{}, fmt.Errorf("end of %s/%s is not terminated", header.Database, header.Collection)
+	}
+	return header, nil
+}
+
+// readBlock passes each document of the current block to document.
+func (a *archiveReader) readBlock(document func(doc []byte) error) error {
+	crc := a.crcs[dbColl{a.current.Database, a.current.Collection}]
+	for {
+		doc, err := a.readDocument()
+		if err != nil {
+			return fmt.Errorf("couldn't read documents of %s/%s: %v", a.current.Database, a.current.Collection, err)
+		}
+		if doc == nil {
+			return nil
+		}
+		_, _ = crc.Write(doc)
+		if err = document(doc); err != nil {
+			return err
+		}
+	}
+}
+
+// readDocument reads the next BSON document, or returns nil at a terminator.
+// It returns io.EOF only if the stream ends before the document.
+func (a *archiveReader) readDocument() ([]byte, error) {
+	var size [4]byte
+	if _, err := io.ReadFull(a.reader, size[:]); err != nil {
+		if err == io.EOF {
+			return nil, io.EOF
+		}
+		return nil, io.ErrUnexpectedEOF
+	}
+	n := binary.LittleEndian.Uint32(size[:])
+	if n == archiveTerminator {
+		return nil, nil
+	}
+	if n < 5 || n > maxArchiveDocumentSize {
+		return nil, fmt.Errorf("invalid document size: %v bytes", n)
+	}
+
+	doc := make([]byte, n)
+	copy(doc, size[:])
+	if _, err := io.ReadFull(a.reader, doc[4:]); err != nil {
+		return nil, io.ErrUnexpectedEOF
+	}
+	return doc, nil
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func testArchive(t *testing.T, docs ...[]byte) []byte {
+	buf := new(bytes.Buffer)
+	archive, err := newArchiveWriter(buf, archiveHeader{ToolVersion: "test"}, []archiveCollection{
+		{Database: "database1", Collection: "collection1", Metadata: `{"indexes":[],"collectionName":"collection1","type":"collection"}`, Type: "collection"},
+	})
+	assert.NoError(t, err)
+	assert.NoError(t, archive.beginCollection("database1", "collection1"))
+	for _, doc := range docs {
+		assert.NoError(t, archive.writeDocument(doc))
+	}
+	assert.NoError(t, archive.endCollection())
+	return buf.Bytes()
+}
+
+func readTestArchive(t *testing.T, reader io.Reader) (*archiveReader, [][]byte) {
+	archive, err := newArchiveReader(reader)
+	assert.NoError(t, err)
+
+	var docs [][]byte
+	for {
+		header, err := archive.nextBlock()
+		if err == io.EOF {
+			return archive, docs
+		}
+		assert.NoError(t, err)
+		if header.EOF {
+			continue
+		}
+		assert.NoError(t, archive.readBlock(func(doc []byte) error {
+			docs = append(docs, doc)
+			return nil
+		}))
+	}
+}
+
+func TestArchive_RoundTrip(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	data := testArchive(t, doc, doc)
+
+	assert.Equal(t, uint32(archiveMagic), binary.LittleEndian.Uint32(data))
+	assert.True(t, bytes.HasSuffix(data, []byte{0xff, 0xff, 0xff, 0xff}))
+
+	archive, docs := readTestArchive(t, bytes.NewReader(data))
+	assert.Equal(t, archiveFormatVersion, archive.header.FormatVersion)
+	assert.Equal(t, int32(1), archive.header.ConcurrentCollections)
+	assert.Len(t, archive.collections, 1)
+	assert.Equal(t, "collection1", archive.collections[0].Collection)
+	assert.Equal(t, [][]byte{doc, doc}, docs)
+}
+
+func TestArchive_Gzipped(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	buf := new(bytes.Buffer)
+	gz := gzip.NewWriter(buf)
+	_, err := gz.Write(testArchive(t, doc))
+	assert.NoError(t, err)
+	assert.NoError(t, gz.Close())
+
+	_, docs := readTestArchive(t, buf)
+	assert.Equal(t, [][]byte{doc}, docs)
+}
+
+func TestArchive_ChecksumMismatch(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{{Key: "n", Value: int32(1)}})
+	assert.NoError(t, err)
+	data := testArchive(t, doc)
+	// Flip the value of the document.
+	i := bytes.Index(data, doc)
+	data[i+len(doc)-5] = 2
+
+	archive, err := newArchiveReader(bytes.NewReader(data))
+	assert.NoError(t, err)
+	_, err = archive.nextBlock()
+	assert.NoError(t, err)
+	assert.NoError(t, archive.readBlock(func([]byte) error { return nil }))
+	_, err = archive.nextBlock()
+	assert.EqualError(t, err, "checksum of database1/collection1 doesn't match its documents")
+}
+
+func TestArchive_Errors(t *testing.T) {
+	_, err := newArchiveReader(bytes.NewReader([]byte("\x16\x00\x00\x00\x02hello\x00")))
+	assert.EqualError(t, err, "not a mongodump archive")
+
+	data := testArchive(t, []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00"))
+	archive, err := newArchiveReader(bytes.NewReader(data[:len(data)-30]))
+	assert.NoError(t, err)
+	_, err = archive.nextBlock()
+	assert.NoError(t, err)
+	assert.NoError(t, archive.readBlock(func([]byte) error { return nil }))
+	_, err = archive.nextBlock()
+	assert.Error(t, err)
+	assert.NotEqual(t, io.EOF, err)
+}
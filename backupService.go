@@ -1,17 +1,24 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
 	"golang.org/x/sync/errgroup"
 )
 
 type backupService interface {
-	Backup(ctx context.Context, collections []dbColl) error
-	Restore(ctx context.Context, dateDir string, collections []dbColl) error
+	Backup(ctx context.Context, selection collectionSelection) error
+	Restore(ctx context.Context, dateDir string, collections []dbColl, options restoreOptions) error
 }
 
 type dbColl struct {
@@ -19,17 +26,175 @@ type dbColl struct {
 	collection string
 }
 
+type backupOptions struct {
+	// snapshot makes all collections of a run be read at a single cluster
+	// time, using a snapshot session.
+	snapshot bool
+	// keyProvider, if set, wraps the data key every backup run is encrypted
+	// with, and unwraps it to restore encrypted backups.
+	keyProvider keyProvider
+	// compression is what collections are stored with. Restores find the
+	// codec of each collection from its object name instead.
+	compression compression
+	// parallelism is the number of collections backed up at once. Snapshot
+	// backups always read one collection at a time.
+	parallelism int
+	// partitionSize, if set, splits collections larger than it into _id
+	// ranges of about that many bytes, which are saved as separate parts at
+	// once. No collection is split into more than maxPartitions parts.
+	partitionSize int64
+	maxPartitions int
+	// queries narrow down the documents and fields saved of some
+	// collections.
+	queries collectionQueries
+	// masking hashes, fakes, nulls or drops personal data fields of some
+	// collections before they are saved.
+	masking maskingRules
+	// format is recorded in the manifest of every run, checkBackupFormat
+	// makes sure the other options fit it.
+	format string
+}
+
+// Backups are stored in the native format by default. A run in the mongodump
+// format is laid out the same, but only uses settings which keep it a
+// mongodump output directory that stock mongorestore restores without this
+// service. Runs recorded without a format are native.
+const (
+	nativeFormat    = "native"
+	mongodumpFormat = "mongodump"
+)
+
+// checkBackupFormat checks that backups taken with the options are in their
+// format. mongorestore reads collections from a single .bson or .bson.gz file
+// each, so mongodump backups need the gzip or none codec, and can't be
+// encrypted or partitioned.
+func checkBackupFormat(options backupOptions) error {
+	switch options.format {
+	case nativeFormat:
+		return nil
+	case mongodumpFormat:
+		if options.compression.codec != gzipCodec && options.compression.codec != noCodec {
+			return fmt.Errorf("mongodump backups need the gzip or none codec, not %s", options.compression.codec)
+		}
+		if options.keyProvider != nil {
+			return fmt.Errorf("mongodump backups can't be encrypted, mongorestore couldn't read them")
+		}
+		if options.partitionSize > 0 {
+			return fmt.Errorf("mongodump backups can't be partitioned, mongorestore needs each collection in one file")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown backup format: %s", options.format)
+}
+
+// partAttempts is the number of times saving a part of a partitioned
+// collection is attempted.
+const partAttempts = 3
+
+type restoreOptions struct {
+	// indexes decides whether the indexes of a collection are built before or
+	// after its documents are loaded. Building them afterwards is faster.
+	indexes indexBuildOrder
+	// targets maps collections of the backup to the namespaces they are
+	// restored into. Collections without a mapping are restored in place.
+	targets map[dbColl]dbColl
+	// mode decides how the backup is combined with documents already in the
+	// target collections.
+	mode restoreMode
+	// masking hashes, fakes, nulls or drops personal data fields of some
+	// collections as they are loaded.
+	masking maskingRules
+	// documents, if set, restricts the restore to the documents it selects,
+	// which are written into the target collections without touching their
+	// other documents, options or indexes.
+	documents *documentSelection
+	// allowPartial allows restoring partial backups in modes which lose the
+	// documents or fields their query left out.
+	allowPartial bool
+}
+
+// target returns the namespace the given collection is restored into.
+func (o restoreOptions) target(coll dbColl) dbColl {
+	if target, ok := o.targets[coll]; ok {
+		return target
+	}
+	return coll
+}
+
+// parseRestoreTargets parses comma separated <database>/<collection>=<database>/<collection>
+// mappings, and checks they only refer to collections being restored.
+func parseRestoreTargets(value string, colls []dbColl) (map[dbColl]dbColl, error) {
+	targets := map[dbColl]dbColl{}
+	if value == "" {
+		return targets, nil
+	}
+
+	restored := map[dbColl]bool{}
+	for _, coll := range colls {
+		restored[coll] = true
+	}
+	used := map[dbColl]bool{}
+
+	for _, mapping := range strings.Split(value, ",") {
+		parts := strings.Split(mapping, "=")
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("failed to parse target mapping: %s", mapping)
+		}
+		source, err := parseDBColl(parts[0])
+		if err != nil {
+			return nil, err
+		}
+		target, err := parseDBColl(parts[1])
+		if err != nil {
+			return nil, err
+		}
+
+		if !restored[source] {
+			return nil, fmt.Errorf("target mapping for %s/%s, which is not being restored", source.database, source.collection)
+		}
+		if _, ok := targets[source]; ok {
+			return nil, fmt.Errorf("more than one target for %s/%s", source.database, source.collection)
+		}
+		if used[target] {
+			return nil, fmt.Errorf("more than one collection restored into %s/%s", target.database, target.collection)
+		}
+		targets[source] = target
+		used[target] = true
+	}
+
+	// A collection restored in place must not be the target of another one.
+	for _, coll := range colls {
+		if _, ok := targets[coll]; !ok && used[coll] {
+			return nil, fmt.Errorf("%s/%s is both restored in place and a target of another collection", coll.database, coll.collection)
+		}
+	}
+	return targets, nil
+}
+
+func parseDBColl(value string) (dbColl, error) {
+	c := strings.Split(value, "/")
+	if len(c) != 2 || c[0] == "" || c[1] == "" {
+		return dbColl{}, fmt.Errorf("failed to parse collection: %s", value)
+	}
+	return dbColl{c[0], c[1]}, nil
+}
+
 type mongoBackupService struct {
 	dbService      dbService
 	storageService storageService
 	statusKeeper   statusKeeper
+	options        backupOptions
 }
 
-func newMongoBackupService(dbService dbService, storageService storageService, statusKeeper statusKeeper) *mongoBackupService {
+func newMongoBackupService(dbService dbService, storageService storageService, statusKeeper statusKeeper, options backupOptions) *mongoBackupService {
+	if options.compression.codec == "" {
+		options.compression = snappyCompression
+	}
 	return &mongoBackupService{
 		dbService:      dbService,
 		storageService: storageService,
 		statusKeeper:   statusKeeper,
+		options:        options,
 	}
 }
 
@@ -39,17 +204,136 @@ type backupResult struct {
 	Collection dbColl
 }
 
-func (m *mongoBackupService) Backup(ctx context.Context, collections []dbColl) error {
+func (m *mongoBackupService) Backup(ctx context.Context, selection collectionSelection) error {
 	date := formattedNow()
+	manifest := newBackupManifest(date)
+	manifest.Format = m.options.format
+
+	collections, err := selection.resolve(ctx, m.dbService.ListCollections)
+	if err != nil {
+		return err
+	}
+	manifest.Selection = selection.String()
 	for _, coll := range collections {
-		if err := m.backup(ctx, date, coll); err != nil {
-			return err
+		manifest.Resolved = append(manifest.Resolved, coll.String())
+	}
+	if len(collections) == 0 {
+		log.Warnf("No collections match %s", manifest.Selection)
+	}
+
+	enc, err := newEncryption(m.options.keyProvider)
+	if err != nil {
+		return fmt.Errorf("couldn't set up encryption: %v", err)
+	}
+
+	// Snapshot sessions only allow reading documents, so the metadata of the
+	// collections is read outside of the session.
+	metadataCtx := ctx
+	var snapshot snapshot
+	if m.options.snapshot {
+		ctx, snapshot, err = m.dbService.StartSnapshot(ctx)
+		if err != nil {
+			return fmt.Errorf("couldn't start snapshot session: %v", err)
+		}
+		defer func() {
+			_ = snapshot.Close(context.Background())
+		}()
+	}
+
+	saveManifest := func() error {
+		if snapshot != nil {
+			if clusterTime, ok := snapshot.ClusterTime(); ok {
+				manifest.ClusterTime = &clusterTime
+			}
 		}
+		return m.saveManifest(ctx, manifest)
+	}
+
+	parallelism := m.options.parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+	if snapshot != nil && parallelism > 1 {
+		// A session can't be used by several operations at once.
+		log.Warnf("Snapshot backups read one collection at a time, ignoring parallelism of %d", parallelism)
+		parallelism = 1
+	}
+
+	// Every collection is attempted, even after others failed.
+	entries := make([]*collectionManifest, len(collections))
+	errs := make([]error, len(collections))
+	sem := make(chan struct{}, parallelism)
+	var wg sync.WaitGroup
+	for i, coll := range collections {
+		sem <- struct{}{}
+		wg.Add(1)
+		go func(i int, coll dbColl) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+			entry, err := m.backup(ctx, metadataCtx, date, coll, enc)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			entries[i] = &entry
+		}(i, coll)
+	}
+	wg.Wait()
+
+	var failed collectionErrors
+	for i := range collections {
+		if errs[i] != nil {
+			failed = append(failed, errs[i])
+		} else {
+			manifest.Collections = append(manifest.Collections, *entries[i])
+		}
+	}
+
+	if len(failed) > 0 {
+		if mErr := saveManifest(); mErr != nil {
+			log.WithError(mErr).Error("Saving manifest of failed backup failed")
+		}
+		return failed
+	}
+
+	manifest.Complete = true
+	return saveManifest()
+}
+
+// collectionErrors holds the errors of all collections which failed in a run.
+type collectionErrors []error
+
+func (e collectionErrors) Error() string {
+	if len(e) == 1 {
+		return e[0].Error()
+	}
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Error()
+	}
+	return fmt.Sprintf("%d collections failed: %s", len(e), strings.Join(messages, "; "))
+}
+
+func (m *mongoBackupService) saveManifest(ctx context.Context, manifest *backupManifest) error {
+	manifest.EndTime = time.Now().UTC()
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("couldn't marshal manifest: %v", err)
+	}
+
+	if err = m.storageService.Upload(ctx, manifestFilePath(manifest.Date), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("couldn't upload manifest: %v", err)
 	}
 	return nil
 }
 
-func (m *mongoBackupService) backup(ctx context.Context, date string, coll dbColl) error {
+// backup saves a collection. Its documents are read with ctx, and its
+// metadata and size with metadataCtx, which has no snapshot session. Its
+// errors name the collection, as a run reports those of all collections.
+func (m *mongoBackupService) backup(ctx, metadataCtx context.Context, date string, coll dbColl, enc *encryption) (collectionManifest, error) {
 	start := time.Now().UTC()
 
 	logEntry := log.
@@ -58,69 +342,437 @@ func (m *mongoBackupService) backup(ctx context.Context, date string, coll dbCol
 
 	logEntry.Info("Saving collection...")
 
-	reader, writer := newPipe(uploadOperation)
+	fail := func(err error) (collectionManifest, error) {
+		logEntry.WithError(err).Error("Saving collection failed")
+
+		result := backupResult{
+			Timestamp:  time.Now().UTC(),
+			Collection: coll,
+		}
+		_ = m.statusKeeper.Save(result)
+
+		return collectionManifest{}, fmt.Errorf("dumping failed for %s/%s: %v", coll.database, coll.collection, err)
+	}
+
+	query := m.options.queries.lookup(coll)
+	if query.partial() {
+		logEntry.Info("Saving the documents and fields selected by the collection query")
+	}
+
+	mask := m.options.masking.lookup(coll)
+	if mask != nil {
+		logEntry.Infof("Masking fields %v", mask)
+	}
+
+	if err := m.backupMetadata(metadataCtx, date, coll, query, mask); err != nil {
+		return fail(err)
+	}
+
+	partitions := []idRange{{}}
+	if m.options.partitionSize > 0 {
+		var err error
+		partitions, err = m.dbService.PartitionCollection(metadataCtx, coll.database, coll.collection, m.options.partitionSize, m.options.maxPartitions)
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	var object partManifest
+	var parts []partManifest
+	if len(partitions) == 1 {
+		var err error
+		object, err = m.saveObject(ctx, collectionFilePath(date, coll.database, coll.collection, m.options.compression.codec), enc,
+			func(ctx context.Context, writer io.Writer) error {
+				return m.dbService.SaveCollection(ctx, coll.database, coll.collection, query, newMaskingWriter(writer, mask))
+			})
+		if err != nil {
+			return fail(err)
+		}
+	} else {
+		logEntry.Infof("Saving collection in %d parts", len(partitions))
+
+		var err error
+		parts, err = m.backupPartitions(ctx, date, coll, partitions, query, mask, enc)
+		if err != nil {
+			return fail(err)
+		}
+		for _, part := range parts {
+			object.Documents += part.Documents
+			object.BSONBytes += part.BSONBytes
+			object.StoredBytes += part.StoredBytes
+		}
+	}
+
+	logEntry.Infof("Collection successfully saved. Duration: %v", time.Since(start))
+
+	entry := collectionManifest{
+		Database:    coll.database,
+		Collection:  coll.collection,
+		Documents:   object.Documents,
+		BSONBytes:   object.BSONBytes,
+		StoredBytes: object.StoredBytes,
+		SHA256:      object.SHA256,
+		Parts:       parts,
+		StartTime:   start,
+		EndTime:     time.Now().UTC(),
+		ToolVersion: toolVersion(),
+		Codec:       m.options.compression.codec,
+		Partial:     query.partial(),
+		Masked:      mask != nil,
+	}
+	if enc != nil {
+		entry.Encryption = aesGCMEncryption
+	}
+
+	// The collection is stored by now, so it stays in the manifest even if
+	// its status can't be saved, which only affects the health checks.
+	result := backupResult{
+		Success:    true,
+		Timestamp:  time.Now().UTC(),
+		Collection: coll,
+	}
+	if err := m.statusKeeper.Save(result); err != nil {
+		logEntry.WithError(err).Error("Saving status of collection backup failed")
+	}
+	return entry, nil
+}
+
+// backupPartitions saves each _id range of a collection into its own part
+// object, all at once unless the run reads from a snapshot session.
+func (m *mongoBackupService) backupPartitions(ctx context.Context, date string, coll dbColl, partitions []idRange, query collectionQuery, mask *collectionMask, enc *encryption) ([]partManifest, error) {
+	parallelism := len(partitions)
+	if m.options.snapshot {
+		parallelism = 1
+	}
+
+	parts := make([]partManifest, len(partitions))
+	sem := make(chan struct{}, parallelism)
+	g, ctx := errgroup.WithContext(ctx)
+	for i := range partitions {
+		i := i
+		g.Go(func() error {
+			sem <- struct{}{}
+			defer func() {
+				<-sem
+			}()
+
+			part, err := m.backupPartition(ctx, date, coll, i, partitions[i], query, mask, enc)
+			parts[i] = part
+			return err
+		})
+	}
+	return parts, g.Wait()
+}
+
+// backupPartition saves one part of a collection. A failed part is retried on
+// its own, so it doesn't cost the whole collection.
+func (m *mongoBackupService) backupPartition(ctx context.Context, date string, coll dbColl, i int, partition idRange, query collectionQuery, mask *collectionMask, enc *encryption) (partManifest, error) {
+	path := collectionPartPath(date, coll.database, coll.collection, i, m.options.compression.codec)
+
+	var err error
+	for attempt := 1; attempt <= partAttempts; attempt++ {
+		var part partManifest
+		part, err = m.saveObject(ctx, path, enc, func(ctx context.Context, writer io.Writer) error {
+			return m.dbService.SavePartition(ctx, coll.database, coll.collection, partition, query, newMaskingWriter(writer, mask))
+		})
+		if err == nil {
+			part.Part = i
+			return part, nil
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		log.WithError(err).Warnf("Saving part %d of %s/%s failed, attempt %d of %d", i, coll.database, coll.collection, attempt, partAttempts)
+	}
+	return partManifest{}, fmt.Errorf("part %d: %v", i, err)
+}
+
+// saveObject stores the documents written by save at path, and returns what
+// the manifest records about the object.
+func (m *mongoBackupService) saveObject(ctx context.Context, path string, enc *encryption, save func(ctx context.Context, writer io.Writer) error) (partManifest, error) {
+	reader, writer := newPipe(uploadOperation, m.options.compression, enc)
 	defer func() {
 		_ = reader.Close()
 	}()
 
+	stored := newDigestReader(reader)
+	raw := newCountingWriter(writer)
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
-		return m.storageService.Upload(ctx, date, coll.database, coll.collection, reader)
+		// An upload which stops reading early, e.g. once it failed, mustn't
+		// leave save blocked on writing into the pipe.
+		defer func() {
+			_ = reader.Close()
+		}()
+
+		return m.storageService.Upload(ctx, path, stored)
 	})
 	g.Go(func() error {
 		defer func() {
 			_ = writer.Close()
 		}()
 
-		return m.dbService.SaveCollection(ctx, coll.database, coll.collection, writer)
+		return save(ctx, raw)
 	})
 
 	if err := g.Wait(); err != nil {
-		logEntry.WithError(err).Error("Saving collection failed")
-
-		result := backupResult{
-			Timestamp:  time.Now().UTC(),
-			Collection: coll,
-		}
-		_ = m.statusKeeper.Save(result)
-
-		return fmt.Errorf("dumping failed for %s/%s: %v", coll.database, coll.collection, err)
+		return partManifest{}, err
 	}
 
-	logEntry.Infof("Collection successfully saved. Duration: %v", time.Since(start))
+	return partManifest{
+		Documents:   raw.documents,
+		BSONBytes:   raw.bytes,
+		StoredBytes: stored.bytes,
+		SHA256:      stored.Sum(),
+	}, nil
+}
 
-	result := backupResult{
-		Success:    true,
-		Timestamp:  time.Now().UTC(),
-		Collection: coll,
+// backupMetadata stores the options and indexes of the collection next to
+// its documents, along with the query and mask the documents are saved with.
+func (m *mongoBackupService) backupMetadata(ctx context.Context, date string, coll dbColl, query collectionQuery, mask *collectionMask) error {
+	metadata, err := m.dbService.CollectionMetadata(ctx, coll.database, coll.collection)
+	if err != nil {
+		return err
+	}
+	metadata.Filter = query.filter
+	metadata.Projection = query.projection
+	if mask != nil {
+		metadata.Masking = mask.String()
 	}
-	return m.statusKeeper.Save(result)
+	return uploadMetadata(ctx, m.storageService, date, coll, metadata)
 }
 
-func (m *mongoBackupService) Restore(ctx context.Context, date string, collections []dbColl) error {
+func (m *mongoBackupService) Restore(ctx context.Context, date string, collections []dbColl, options restoreOptions) error {
 	for _, coll := range collections {
-		if err := m.restore(ctx, date, coll); err != nil {
+		if err := m.restore(ctx, date, coll, options); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
-func (m *mongoBackupService) restore(ctx context.Context, date string, coll dbColl) error {
+func (m *mongoBackupService) restore(ctx context.Context, date string, coll dbColl, options restoreOptions) error {
 	start := time.Now().UTC()
 
 	logEntry := log.
 		WithField("database", coll.database).
 		WithField("collection", coll.collection)
+	if target := options.target(coll); target != coll {
+		logEntry = logEntry.
+			WithField("targetDatabase", target.database).
+			WithField("targetCollection", target.collection)
+	}
 
 	logEntry.Info("Restoring collection...")
 
-	reader, writer := newPipe(downloadOperation)
+	if err := m.restoreCollection(ctx, date, coll, options); err != nil {
+		logEntry.WithError(err).Error("Restoring collection failed")
+
+		return err
+	}
+
+	logEntry.Infof("Finished restoration. Duration: %v", time.Since(start))
+
+	return nil
+}
+
+// restoreCollection restores the collection from the backup into its target
+// namespace, in the way the restore mode asks for.
+func (m *mongoBackupService) restoreCollection(ctx context.Context, date string, coll dbColl, options restoreOptions) error {
+	target := options.target(coll)
+
+	metadata, err := downloadMetadata(ctx, m.storageService, date, coll)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		log.Warnf("Backup of %s/%s has no collection metadata, restoring documents only", coll.database, coll.collection)
+	} else if metadata.partial() {
+		if err := checkPartialRestore(coll, *metadata, options); err != nil {
+			return err
+		}
+		log.Warnf("Backup of %s/%s is partial, it only holds the documents of filter %v with the fields of projection %v", coll.database, coll.collection, metadata.Filter, metadata.Projection)
+	}
+	if metadata != nil && metadata.Masking != "" {
+		log.Infof("Backup of %s/%s was taken with fields masked %s", coll.database, coll.collection, metadata.Masking)
+	}
+
+	mask := options.masking.lookup(coll)
+	if mask != nil {
+		log.Infof("Masking fields %v of %s/%s", mask, coll.database, coll.collection)
+	}
+
+	if options.documents != nil {
+		return m.restoreDocuments(ctx, date, coll, target, options.documents, options.mode, mask)
+	}
+
+	var transform func(doc bson.Raw) (bson.Raw, error)
+	if mask != nil {
+		transform = mask.apply
+	}
+	if options.mode == restoreSwap {
+		return m.swap(ctx, date, coll, target, metadata, options.indexes, transform)
+	}
+	return m.load(ctx, date, coll, target, metadata, options.indexes, options.mode, transform)
+}
+
+// restoreDocuments loads the documents of the backup which the selection
+// matches into target, in upsert or insert-missing mode.
+func (m *mongoBackupService) restoreDocuments(ctx context.Context, date string, coll, target dbColl, documents *documentSelection, mode restoreMode, mask *collectionMask) error {
+	var matched int64
+	err := m.restoreData(ctx, date, coll, target, mode, func(doc bson.Raw) (bson.Raw, error) {
+		if !documents.matches(doc) {
+			return nil, nil
+		}
+		atomic.AddInt64(&matched, 1)
+		if mask == nil {
+			return doc, nil
+		}
+		return mask.apply(doc)
+	})
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restored %d selected documents into %s/%s", matched, target.database, target.collection)
+	if documents.ids != nil && matched < int64(documents.idCount) {
+		log.Warnf("%d of the %d listed ids weren't restored into %s/%s", int64(documents.idCount)-matched, documents.idCount, target.database, target.collection)
+	}
+	return nil
+}
+
+// checkPartialRestore refuses to restore a partial backup in a mode which
+// removes the documents its filter left out, or replaces documents with ones
+// missing the fields its projection left out, unless allowPartial is set.
+func checkPartialRestore(coll dbColl, metadata collectionMetadata, options restoreOptions) error {
+	if options.allowPartial {
+		return nil
+	}
+	switch options.mode {
+	case restoreInsertMissing, restoreFailIfNotEmpty:
+		return nil
+	case restoreUpsert:
+		if len(metadata.Projection) == 0 {
+			return nil
+		}
+		return fmt.Errorf("backup of %s only holds the fields of projection %v, upserting it would drop the other fields of existing documents, use insert-missing mode or allow partial restores", coll, metadata.Projection)
+	}
+	mode := options.mode
+	if mode == "" {
+		mode = restoreReplace
+	}
+	return fmt.Errorf("backup of %s is partial, restoring it in %s mode would remove what its filter %v and projection %v left out, use upsert or insert-missing mode or allow partial restores", coll, mode, metadata.Filter, metadata.Projection)
+}
+
+// load recreates the collection with its options and indexes, if the backup
+// recorded them, and loads its documents into target.
+func (m *mongoBackupService) load(ctx context.Context, date string, coll, target dbColl, metadata *collectionMetadata, indexes indexBuildOrder, mode restoreMode, transform func(doc bson.Raw) (bson.Raw, error)) error {
+	if metadata == nil {
+		return m.restoreData(ctx, date, coll, target, mode, transform)
+	}
+
+	if err := m.dbService.CreateCollection(ctx, target.database, target.collection, *metadata); err != nil {
+		return err
+	}
+	if indexes == indexesBeforeData {
+		if err := m.dbService.CreateIndexes(ctx, target.database, target.collection, metadata.Indexes); err != nil {
+			return err
+		}
+	}
+
+	if err := m.restoreData(ctx, date, coll, target, mode, transform); err != nil {
+		return err
+	}
+
+	if indexes != indexesBeforeData {
+		return m.dbService.CreateIndexes(ctx, target.database, target.collection, metadata.Indexes)
+	}
+	return nil
+}
+
+// swap loads the backup into a temporary collection next to target, and only
+// renames it over target once it is complete, so readers never see a partially
+// restored collection. If loading fails, target is left untouched.
+func (m *mongoBackupService) swap(ctx context.Context, date string, coll, target dbColl, metadata *collectionMetadata, indexes indexBuildOrder, transform func(doc bson.Raw) (bson.Raw, error)) error {
+	// The temporary collection would have none of the indexes of target, and
+	// renaming it over target would silently drop them.
+	if metadata == nil {
+		return fmt.Errorf("backup of %s has no collection metadata, swapping it in would drop the options and indexes of %s, use another mode", coll, target)
+	}
+
+	temp := dbColl{target.database, swapCollectionName(target.collection, date)}
+
+	// Clean up after an earlier swap restore which failed half way.
+	if err := m.dbService.DropCollection(ctx, temp.database, temp.collection); err != nil {
+		return err
+	}
+
+	if err := m.load(ctx, date, coll, temp, metadata, indexes, restoreReplace, transform); err != nil {
+		if dErr := m.dbService.DropCollection(context.Background(), temp.database, temp.collection); dErr != nil {
+			log.WithError(dErr).Errorf("Dropping temporary collection %s/%s failed", temp.database, temp.collection)
+		}
+		return err
+	}
+
+	return m.dbService.RenameCollection(ctx, target.database, temp.collection, target.collection)
+}
+
+func swapCollectionName(collection, date string) string {
+	return collection + "_restore_" + date
+}
+
+// restoreData loads the documents of coll from the backup into target,
+// passing them through transform if it is set. Documents transform returns
+// nil for are skipped.
+func (m *mongoBackupService) restoreData(ctx context.Context, date string, coll, target dbColl, mode restoreMode, transform func(doc bson.Raw) (bson.Raw, error)) error {
+	paths, c, err := findCollectionFiles(ctx, m.storageService, date, coll.database, coll.collection)
+	if err != nil {
+		return err
+	}
+	enc, err := collectionEncryption(ctx, m.storageService, m.options.keyProvider, date, coll)
+	if err != nil {
+		return err
+	}
+	if _, partitioned := collectionPart(paths[0]); !partitioned {
+		return m.restoreObject(ctx, paths[0], c, enc, target, mode, transform)
+	}
+
+	// Parts are loaded at once, so the collection is prepared only once, and
+	// the parts are appended to it.
+	if err = m.dbService.PrepareRestore(ctx, target.database, target.collection, mode); err != nil {
+		return err
+	}
+	partMode := restoreAppend
+	if mode == restoreUpsert || mode == restoreInsertMissing {
+		partMode = mode
+	}
+
+	log.Infof("Restoring %d parts of %s/%s", len(paths), coll.database, coll.collection)
+
+	g, ctx := errgroup.WithContext(ctx)
+	for _, path := range paths {
+		path := path
+		g.Go(func() error {
+			return m.restoreObject(ctx, path, c, enc, target, partMode, transform)
+		})
+	}
+	return g.Wait()
+}
+
+// restoreObject loads the documents of one stored object into target.
+func (m *mongoBackupService) restoreObject(ctx context.Context, path string, c codec, enc *encryption, target dbColl, mode restoreMode, transform func(doc bson.Raw) (bson.Raw, error)) error {
+	pipeReader, writer := newPipe(downloadOperation, compression{codec: c}, enc)
 	defer func() {
-		_ = reader.Close()
+		_ = pipeReader.Close()
 	}()
 
+	var reader io.Reader = pipeReader
+	if transform != nil {
+		reader = newBSONTransformReader(pipeReader, &defaultBsonService{}, transform)
+	}
+
 	g, ctx := errgroup.WithContext(ctx)
 
 	g.Go(func() error {
@@ -128,21 +780,13 @@ func (m *mongoBackupService) restore(ctx context.Context, date string, coll dbCo
 			_ = writer.Close()
 		}()
 
-		return m.storageService.Download(ctx, date, coll.database, coll.collection, writer)
+		return m.storageService.Download(ctx, path, writer)
 	})
 	g.Go(func() error {
-		return m.dbService.RestoreCollection(ctx, coll.database, coll.collection, reader)
+		return m.dbService.RestoreCollection(ctx, target.database, target.collection, reader, mode)
 	})
 
-	if err := g.Wait(); err != nil {
-		logEntry.WithError(err).Error("Restoring collection failed")
-
-		return err
-	}
-
-	logEntry.Infof("Finished restoration. Duration: %v", time.Since(start))
-
-	return nil
+	return g.Wait()
 }
 
 func formattedNow() string {
@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
+	"io"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 )
 
 func TestBackup_Ok(t *testing.T) {
@@ -15,17 +23,22 @@ func TestBackup_Ok(t *testing.T) {
 	mockedStorageService := new(mockStorageService)
 	mockedStorageService.On("Upload",
 		mock.MatchedBy(isTestContext),
-		mock.AnythingOfType("string"),
-		"database1",
-		"collection1",
-		mock.AnythingOfType("*io.PipeReader"),
+		mock.MatchedBy(isCollectionPath("database1", "collection1")),
+		mock.AnythingOfType("*main.digestReader"),
+	).Return(nil)
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader"),
 	).Return(nil)
 	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
 	mockedMongoService.On("SaveCollection",
 		mock.MatchedBy(isTestContext),
 		"database1",
 		"collection1",
-		mock.AnythingOfType("*main.snappyWriteCloser"),
+		collectionQuery{},
+		mock.AnythingOfType("*main.countingWriter"),
 	).Return(nil)
 	mockedStatusKeeper := new(mockStatusKeeper)
 	mockedStatusKeeper.On("Save",
@@ -35,8 +48,8 @@ func TestBackup_Ok(t *testing.T) {
 				result.Collection.database == "database1"
 		})).Return(nil)
 
-	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper)
-	err := backupService.Backup(ctx, []dbColl{{"database1", "collection1"}})
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}))
 
 	assert.NoError(t, err, "Error wasn't expected during backup.")
 }
@@ -47,17 +60,22 @@ func TestBackup_ErrorOnSavingCollection(t *testing.T) {
 	mockedStorageService := new(mockStorageService)
 	mockedStorageService.On("Upload",
 		mock.MatchedBy(isTestContext),
-		mock.AnythingOfType("string"),
-		"database1",
-		"collection1",
-		mock.AnythingOfType("*io.PipeReader")).
+		mock.MatchedBy(isCollectionPath("database1", "collection1")),
+		mock.AnythingOfType("*main.digestReader")).
+		Return(nil)
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader")).
 		Return(nil)
 	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
 	mockedMongoService.On("SaveCollection",
 		mock.MatchedBy(isTestContext),
 		"database1",
 		"collection1",
-		mock.AnythingOfType("*main.snappyWriteCloser")).
+		collectionQuery{},
+		mock.AnythingOfType("*main.countingWriter")).
 		Return(fmt.Errorf("error saving collection"))
 	mockedStatusKeeper := new(mockStatusKeeper)
 	mockedStatusKeeper.On("Save",
@@ -67,8 +85,8 @@ func TestBackup_ErrorOnSavingCollection(t *testing.T) {
 				result.Collection.database == "database1"
 		})).Return(nil)
 
-	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper)
-	err := backupService.Backup(ctx, []dbColl{{"database1", "collection1"}})
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}))
 
 	assert.Error(t, err, "Error was expected during backup.")
 	assert.EqualError(t, err, "dumping failed for database1/collection1: error saving collection")
@@ -80,17 +98,22 @@ func TestBackup_ErrorOnUploadingCollection(t *testing.T) {
 	mockedStorageService := new(mockStorageService)
 	mockedStorageService.On("Upload",
 		mock.MatchedBy(isTestContext),
-		mock.AnythingOfType("string"),
-		"database1",
-		"collection1",
-		mock.AnythingOfType("*io.PipeReader")).
+		mock.MatchedBy(isCollectionPath("database1", "collection1")),
+		mock.AnythingOfType("*main.digestReader")).
 		Return(fmt.Errorf("error uploading collection"))
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader")).
+		Return(nil)
 	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
 	mockedMongoService.On("SaveCollection",
 		mock.MatchedBy(isTestContext),
 		"database1",
 		"collection1",
-		mock.AnythingOfType("*main.snappyWriteCloser")).
+		collectionQuery{},
+		mock.AnythingOfType("*main.countingWriter")).
 		Return(nil)
 	mockedStatusKeeper := new(mockStatusKeeper)
 	mockedStatusKeeper.On("Save",
@@ -100,30 +123,67 @@ func TestBackup_ErrorOnUploadingCollection(t *testing.T) {
 				result.Collection.database == "database1"
 		})).Return(nil)
 
-	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper)
-	err := backupService.Backup(ctx, []dbColl{{"database1", "collection1"}})
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}))
 
 	assert.Error(t, err, "Error was expected during backup.")
 	assert.EqualError(t, err, "dumping failed for database1/collection1: error uploading collection")
 }
 
+func TestBackup_RetriesPartAfterFailedUpload(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	mockedStorageService := new(mockStorageService)
+	mockedStorageService.On("Upload", mock.Anything, mock.Anything, mock.Anything).
+		Return(fmt.Errorf("error uploading part")).
+		Once()
+	mockedStorageService.On("Upload", mock.Anything, mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = io.Copy(io.Discard, args.Get(2).(io.Reader))
+		}).
+		Return(nil).
+		Once()
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("SavePartition", mock.Anything, "database1", "collection1", idRange{}, collectionQuery{}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = args.Get(5).(io.Writer).Write(doc)
+		}).
+		Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	part, err := backupService.backupPartition(context.Background(), "2022-08-31T15-00-00", dbColl{"database1", "collection1"}, 2, idRange{}, collectionQuery{}, nil, nil)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 2, part.Part)
+	assert.Equal(t, int64(1), part.Documents)
+	mockedStorageService.AssertNumberOfCalls(t, "Upload", 2)
+	mockedMongoService.AssertNumberOfCalls(t, "SavePartition", 2)
+}
+
 func TestBackup_ErrorOnSavingStatus(t *testing.T) {
 	//nolint: staticcheck
 	ctx := context.WithValue(context.Background(), "source", "test")
 	mockedStorageService := new(mockStorageService)
 	mockedStorageService.On("Upload",
 		mock.MatchedBy(isTestContext),
-		mock.AnythingOfType("string"),
-		"database1",
-		"collection1",
-		mock.AnythingOfType("*io.PipeReader"),
+		mock.MatchedBy(isCollectionPath("database1", "collection1")),
+		mock.AnythingOfType("*main.digestReader"),
 	).Return(nil)
+	var manifest backupManifest
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Run(func(args mock.Arguments) {
+		_ = json.NewDecoder(args.Get(2).(io.Reader)).Decode(&manifest)
+	}).Return(nil)
 	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
 	mockedMongoService.On("SaveCollection",
 		mock.MatchedBy(isTestContext),
 		"database1",
 		"collection1",
-		mock.AnythingOfType("*main.snappyWriteCloser"),
+		collectionQuery{},
+		mock.AnythingOfType("*main.countingWriter"),
 	).Return(nil)
 	mockedStatusKeeper := new(mockStatusKeeper)
 	mockedStatusKeeper.On("Save",
@@ -133,22 +193,262 @@ func TestBackup_ErrorOnSavingStatus(t *testing.T) {
 				result.Collection.database == "database1"
 		})).Return(fmt.Errorf("couldn't save status of backup"))
 
-	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper)
-	err := backupService.Backup(ctx, []dbColl{{"database1", "collection1"}})
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}))
 
-	assert.Error(t, err, "Error was expected during backup.")
-	assert.EqualError(t, err, "couldn't save status of backup")
+	// The stored collection is kept, only its status is lost.
+	assert.NoError(t, err, "Failing to save the status shouldn't fail the backup.")
+	assert.True(t, manifest.Complete)
+	assert.Len(t, manifest.Collections, 1)
+	mockedStatusKeeper.AssertExpectations(t)
 }
 
-func TestRestore_OK(t *testing.T) {
+func TestBackup_WritesManifest(t *testing.T) {
 	//nolint: staticcheck
 	ctx := context.WithValue(context.Background(), "source", "test")
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
 	mockedStorageService := new(mockStorageService)
-	mockedStorageService.On("Download",
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isCollectionPath("database1", "collection1")),
+		mock.AnythingOfType("*main.digestReader"),
+	).Run(func(args mock.Arguments) {
+		_, _ = io.Copy(io.Discard, args.Get(2).(io.Reader))
+	}).Return(nil)
+	var manifest backupManifest
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Run(func(args mock.Arguments) {
+		_ = json.NewDecoder(args.Get(2).(io.Reader)).Decode(&manifest)
+	}).Return(nil)
+	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
+	mockedMongoService.On("SaveCollection",
 		mock.MatchedBy(isTestContext),
-		"2017-09-04T12-40-36",
 		"database1",
 		"collection1",
+		collectionQuery{},
+		mock.AnythingOfType("*main.countingWriter"),
+	).Run(func(args mock.Arguments) {
+		writer := args.Get(4).(io.Writer)
+		_, _ = writer.Write(doc)
+		_, _ = writer.Write(doc)
+	}).Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}))
+
+	assert.NoError(t, err, "Error wasn't expected during backup.")
+	assert.True(t, manifest.Complete)
+	assert.Len(t, manifest.Collections, 1)
+	entry := manifest.Collections[0]
+	assert.Equal(t, "database1", entry.Database)
+	assert.Equal(t, "collection1", entry.Collection)
+	assert.Equal(t, int64(2), entry.Documents)
+	assert.Equal(t, int64(2*len(doc)), entry.BSONBytes)
+	assert.NotZero(t, entry.StoredBytes)
+	assert.Len(t, entry.SHA256, 64)
+	assert.Equal(t, snappyCodec, entry.Codec)
+	assert.False(t, entry.EndTime.Before(entry.StartTime))
+}
+
+func TestBackup_WritesIncompleteManifestOnFailure(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	mockedStorageService := new(mockStorageService)
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isCollectionPath("database1", "collection1")),
+		mock.AnythingOfType("*main.digestReader"),
+	).Return(nil)
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isCollectionPath("database1", "collection2")),
+		mock.AnythingOfType("*main.digestReader"),
+	).Return(fmt.Errorf("error uploading collection"))
+	var manifest backupManifest
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Run(func(args mock.Arguments) {
+		_ = json.NewDecoder(args.Get(2).(io.Reader)).Decode(&manifest)
+	}).Return(nil)
+	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
+	mockedMongoService.On("SaveCollection", mock.MatchedBy(isTestContext), "database1", mock.Anything, collectionQuery{}, mock.Anything).Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}, dbColl{"database1", "collection2"}))
+
+	assert.EqualError(t, err, "dumping failed for database1/collection2: error uploading collection")
+	assert.False(t, manifest.Complete)
+	assert.Len(t, manifest.Collections, 1)
+	assert.Equal(t, "collection1", manifest.Collections[0].Collection)
+}
+
+func TestBackup_ResolvesPatterns(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	mockedStorageService := new(mockStorageService)
+	mockedStorageService.On("Upload", mock.MatchedBy(isTestContext), mock.Anything, mock.AnythingOfType("*main.digestReader")).Return(nil)
+	var manifest backupManifest
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Run(func(args mock.Arguments) {
+		_ = json.NewDecoder(args.Get(2).(io.Reader)).Decode(&manifest)
+	}).Return(nil)
+	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
+	mockedMongoService.On("ListCollections", mock.MatchedBy(isTestContext)).Return([]dbColl{
+		{"database1", "collection1"},
+		{"database1", "tmp_collection"},
+		{"database2", "collection2"},
+	}, nil)
+	mockedMongoService.On("SaveCollection", mock.MatchedBy(isTestContext), mock.Anything, mock.Anything, collectionQuery{}, mock.Anything).Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	selection, err := parseCollectionSelection("database1/*,!*/tmp_*")
+	assert.NoError(t, err)
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{})
+	err = backupService.Backup(ctx, selection)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "database1/*,!*/tmp_*", manifest.Selection)
+	assert.Equal(t, []string{"database1/collection1"}, manifest.Resolved)
+	assert.True(t, manifest.Complete)
+	mockedMongoService.AssertNumberOfCalls(t, "SaveCollection", 1)
+}
+
+func TestBackup_ParallelAttemptsEveryCollection(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	mockedStorageService := new(mockStorageService)
+	mockedStorageService.On("Upload", mock.MatchedBy(isTestContext), mock.Anything, mock.AnythingOfType("*main.digestReader")).Return(nil)
+	var manifest backupManifest
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Run(func(args mock.Arguments) {
+		_ = json.NewDecoder(args.Get(2).(io.Reader)).Decode(&manifest)
+	}).Return(nil)
+	mockedMongoService := new(mockMongoService)
+	mockCollectionMetadata(mockedMongoService, mockedStorageService)
+
+	var mu sync.Mutex
+	running, maxRunning := 0, 0
+	track := func(mock.Arguments) {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		mu.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+	}
+	for _, coll := range []string{"collection1", "collection3", "collection5"} {
+		mockedMongoService.On("SaveCollection", mock.MatchedBy(isTestContext), "database1", coll, collectionQuery{}, mock.Anything).Run(track).Return(nil)
+	}
+	for _, coll := range []string{"collection2", "collection4"} {
+		mockedMongoService.On("SaveCollection", mock.MatchedBy(isTestContext), "database1", coll, collectionQuery{}, mock.Anything).Run(track).Return(fmt.Errorf("error saving collection"))
+	}
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{parallelism: 2})
+	err := backupService.Backup(ctx, selectCollections(
+		dbColl{"database1", "collection1"},
+		dbColl{"database1", "collection2"},
+		dbColl{"database1", "collection3"},
+		dbColl{"database1", "collection4"},
+		dbColl{"database1", "collection5"},
+	))
+
+	assert.EqualError(t, err, "2 collections failed: "+
+		"dumping failed for database1/collection2: error saving collection; "+
+		"dumping failed for database1/collection4: error saving collection")
+	mockedMongoService.AssertNumberOfCalls(t, "SaveCollection", 5)
+	assert.Equal(t, 2, maxRunning, "Two collections should have been backed up at once.")
+	assert.False(t, manifest.Complete)
+	assert.Len(t, manifest.Collections, 3)
+	assert.Equal(t, "collection5", manifest.Collections[2].Collection)
+}
+
+func TestBackup_Snapshot(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	//nolint: staticcheck
+	snapshotCtx := context.WithValue(ctx, "snapshot", true)
+	isSnapshotContext := func(ctx context.Context) bool {
+		return ctx.Value("snapshot") == true
+	}
+	mockedSnapshot := new(mockSnapshot)
+	mockedSnapshot.On("ClusterTime").Return(primitive.Timestamp{T: 1000, I: 3}, true)
+	mockedSnapshot.On("Close", mock.Anything).Return(nil)
+	mockedStorageService := new(mockStorageService)
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(func(path string) bool { return strings.HasSuffix(path, ".bson.snappy") }),
+		mock.AnythingOfType("*main.digestReader"),
+	).Return(nil)
+	var manifest backupManifest
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(isManifestPath),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Run(func(args mock.Arguments) {
+		_ = json.NewDecoder(args.Get(2).(io.Reader)).Decode(&manifest)
+	}).Return(nil)
+	mockedStorageService.On("Upload",
+		mock.MatchedBy(isTestContext),
+		mock.MatchedBy(func(path string) bool { return strings.HasSuffix(path, ".metadata.json") }),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Return(nil)
+	mockedMongoService := new(mockMongoService)
+	// listCollections, listIndexes and collStats aren't allowed in a
+	// snapshot session.
+	isMetadataContext := func(ctx context.Context) bool {
+		return isTestContext(ctx) && !isSnapshotContext(ctx)
+	}
+	mockedMongoService.On("CollectionMetadata", mock.MatchedBy(isMetadataContext), "database1", mock.Anything).Return(collectionMetadata{Type: "collection"}, nil)
+	mockedMongoService.On("PartitionCollection", mock.MatchedBy(isMetadataContext), "database1", mock.Anything, int64(1<<30), 0).Return([]idRange{{}}, nil)
+	mockedMongoService.On("StartSnapshot", mock.MatchedBy(isTestContext)).Return(snapshotCtx, mockedSnapshot, nil)
+	mockedMongoService.On("SaveCollection", mock.MatchedBy(isSnapshotContext), "database1", "collection1", collectionQuery{}, mock.Anything).Return(nil)
+	mockedMongoService.On("SaveCollection", mock.MatchedBy(isSnapshotContext), "database1", "collection2", collectionQuery{}, mock.Anything).Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, mockedStatusKeeper, backupOptions{snapshot: true, partitionSize: 1 << 30})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}, dbColl{"database1", "collection2"}))
+
+	assert.NoError(t, err, "Error wasn't expected during backup.")
+	mockedMongoService.AssertExpectations(t)
+	mockedSnapshot.AssertCalled(t, "Close", mock.Anything)
+	assert.Equal(t, &primitive.Timestamp{T: 1000, I: 3}, manifest.ClusterTime)
+}
+
+func TestRestore_OK(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	mockedStorageService := new(mockStorageService)
+	mockNoManifest(mockedStorageService, "2017-09-04T12-40-36")
+	mockedStorageService.On("List", mock.MatchedBy(isTestContext), "2017-09-04T12-40-36/database1").Return([]storedObject{{Path: "2017-09-04T12-40-36/database1/collection1.bson.snappy"}}, nil)
+	mockedStorageService.On("Download",
+		mock.MatchedBy(isTestContext),
+		"2017-09-04T12-40-36/database1/collection1.bson.snappy",
 		mock.AnythingOfType("*io.PipeWriter"),
 	).Return(nil)
 	mockedMongoService := new(mockMongoService)
@@ -157,10 +457,11 @@ func TestRestore_OK(t *testing.T) {
 		"database1",
 		"collection1",
 		mock.AnythingOfType("*main.snappyReadCloser"),
+		restoreMode(""),
 	).Return(nil)
 
-	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil)
-	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}})
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{})
 
 	assert.NoError(t, err, "Error wasn't expected during backup.")
 }
@@ -169,11 +470,11 @@ func TestRestore_ErrorOnRestoringCollection(t *testing.T) {
 	//nolint: staticcheck
 	ctx := context.WithValue(context.Background(), "source", "test")
 	mockedStorageService := new(mockStorageService)
+	mockNoManifest(mockedStorageService, "2017-09-04T12-40-36")
+	mockedStorageService.On("List", mock.MatchedBy(isTestContext), "2017-09-04T12-40-36/database1").Return([]storedObject{{Path: "2017-09-04T12-40-36/database1/collection1.bson.snappy"}}, nil)
 	mockedStorageService.On("Download",
 		mock.MatchedBy(isTestContext),
-		"2017-09-04T12-40-36",
-		"database1",
-		"collection1",
+		"2017-09-04T12-40-36/database1/collection1.bson.snappy",
 		mock.AnythingOfType("*io.PipeWriter"),
 	).Return(nil)
 	mockedMongoService := new(mockMongoService)
@@ -182,10 +483,11 @@ func TestRestore_ErrorOnRestoringCollection(t *testing.T) {
 		"database1",
 		"collection1",
 		mock.AnythingOfType("*main.snappyReadCloser"),
+		restoreMode(""),
 	).Return(fmt.Errorf("error restoring collection"))
 
-	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil)
-	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}})
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{})
 
 	assert.Error(t, err)
 	assert.EqualError(t, err, "error restoring collection")
@@ -195,11 +497,11 @@ func TestRestore_ErrorOnDownloadingCollection(t *testing.T) {
 	//nolint: staticcheck
 	ctx := context.WithValue(context.Background(), "source", "test")
 	mockedStorageService := new(mockStorageService)
+	mockNoManifest(mockedStorageService, "2017-09-04T12-40-36")
+	mockedStorageService.On("List", mock.MatchedBy(isTestContext), "2017-09-04T12-40-36/database1").Return([]storedObject{{Path: "2017-09-04T12-40-36/database1/collection1.bson.snappy"}}, nil)
 	mockedStorageService.On("Download",
 		mock.MatchedBy(isTestContext),
-		"2017-09-04T12-40-36",
-		"database1",
-		"collection1",
+		"2017-09-04T12-40-36/database1/collection1.bson.snappy",
 		mock.AnythingOfType("*io.PipeWriter"),
 	).Return(fmt.Errorf("error downloading collection"))
 	mockedMongoService := new(mockMongoService)
@@ -208,15 +510,230 @@ func TestRestore_ErrorOnDownloadingCollection(t *testing.T) {
 		"database1",
 		"collection1",
 		mock.AnythingOfType("*main.snappyReadCloser"),
+		restoreMode(""),
 	).Return(nil)
 
-	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil)
-	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}})
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{})
 
 	assert.Error(t, err)
 	assert.EqualError(t, err, "error downloading collection")
 }
 
+func TestRestore_RecreatesCollectionMetadata(t *testing.T) {
+	for _, order := range []indexBuildOrder{indexesAfterData, indexesBeforeData} {
+		t.Run(string(order), func(t *testing.T) {
+			ctx := context.Background()
+			storageService := newFSStorageService(t.TempDir())
+			index, _ := bson.Marshal(bson.D{
+				{Key: "v", Value: 2},
+				{Key: "key", Value: bson.D{{Key: "uuid", Value: 1}}},
+				{Key: "name", Value: "uuid_1"},
+			})
+			options, _ := bson.Marshal(bson.D{{Key: "capped", Value: true}, {Key: "size", Value: int64(4096)}})
+			metadata := collectionMetadata{Options: options, Indexes: []bson.Raw{index}, CollectionName: "collection1", Type: "collection"}
+			data, err := marshalMetadata(metadata)
+			assert.NoError(t, err)
+			assert.NoError(t, storageService.Upload(ctx, metadataFilePath("2017-09-04T12-40-36", "database1", "collection1"), bytes.NewReader(data)))
+			assert.NoError(t, storageService.Upload(ctx, collectionFilePath("2017-09-04T12-40-36", "database1", "collection1", snappyCodec), bytes.NewReader(nil)))
+
+			var calls []string
+			mockedMongoService := new(mockMongoService)
+			mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", metadata).
+				Run(func(mock.Arguments) { calls = append(calls, "CreateCollection") }).
+				Return(nil)
+			mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", []bson.Raw{index}).
+				Run(func(mock.Arguments) { calls = append(calls, "CreateIndexes") }).
+				Return(nil)
+			mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, mock.Anything).
+				Run(func(args mock.Arguments) {
+					_, _ = io.Copy(io.Discard, args.Get(3).(io.Reader))
+					calls = append(calls, "RestoreCollection")
+				}).
+				Return(nil)
+
+			backupService := newMongoBackupService(mockedMongoService, storageService, nil, backupOptions{})
+			err = backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{indexes: order})
+
+			assert.NoError(t, err, "Error wasn't expected during restore.")
+			if order == indexesBeforeData {
+				assert.Equal(t, []string{"CreateCollection", "CreateIndexes", "RestoreCollection"}, calls)
+			} else {
+				assert.Equal(t, []string{"CreateCollection", "RestoreCollection", "CreateIndexes"}, calls)
+			}
+		})
+	}
+}
+
+func TestRestore_IntoTarget(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	mockedStorageService := new(mockStorageService)
+	mockNoManifest(mockedStorageService, "2017-09-04T12-40-36")
+	mockedStorageService.On("List", mock.MatchedBy(isTestContext), "2017-09-04T12-40-36/database1").Return([]storedObject{{Path: "2017-09-04T12-40-36/database1/collection1.bson.snappy"}}, nil)
+	mockedStorageService.On("Download",
+		mock.MatchedBy(isTestContext),
+		"2017-09-04T12-40-36/database1/collection1.bson.snappy",
+		mock.AnythingOfType("*io.PipeWriter"),
+	).Return(nil)
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("RestoreCollection",
+		mock.MatchedBy(isTestContext),
+		"database1-restore",
+		"collection1_20170904",
+		mock.AnythingOfType("*main.snappyReadCloser"),
+		restoreMode(""),
+	).Return(nil)
+
+	targets, err := parseRestoreTargets("database1/collection1=database1-restore/collection1_20170904", []dbColl{{"database1", "collection1"}})
+	assert.NoError(t, err)
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	err = backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{targets: targets})
+
+	assert.NoError(t, err, "Error wasn't expected during restore.")
+	mockedMongoService.AssertExpectations(t)
+}
+
+func TestRestore_Swap(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	mockedStorageService := new(mockStorageService)
+	mockNoManifest(mockedStorageService, "2017-09-04T12-40-36")
+	mockStoredMetadata(t, mockedStorageService, "2017-09-04T12-40-36/database1/collection1.bson.snappy")
+	mockedStorageService.On("Download",
+		mock.MatchedBy(isTestContext),
+		"2017-09-04T12-40-36/database1/collection1.bson.snappy",
+		mock.AnythingOfType("*io.PipeWriter"),
+	).Return(nil)
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1_restore_2017-09-04T12-40-36", mock.Anything).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1_restore_2017-09-04T12-40-36", mock.Anything).Return(nil)
+	mockedMongoService.On("DropCollection", mock.MatchedBy(isTestContext), "database1", "collection1_restore_2017-09-04T12-40-36").Return(nil).Once()
+	mockedMongoService.On("RestoreCollection",
+		mock.MatchedBy(isTestContext),
+		"database1",
+		"collection1_restore_2017-09-04T12-40-36",
+		mock.AnythingOfType("*main.snappyReadCloser"),
+		restoreReplace,
+	).Return(nil)
+	mockedMongoService.On("RenameCollection", mock.MatchedBy(isTestContext), "database1", "collection1_restore_2017-09-04T12-40-36", "collection1").Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{mode: restoreSwap})
+
+	assert.NoError(t, err, "Error wasn't expected during restore.")
+	mockedMongoService.AssertExpectations(t)
+}
+
+func TestRestore_SwapLeavesTargetOnFailure(t *testing.T) {
+	//nolint: staticcheck
+	ctx := context.WithValue(context.Background(), "source", "test")
+	mockedStorageService := new(mockStorageService)
+	mockNoManifest(mockedStorageService, "2017-09-04T12-40-36")
+	mockStoredMetadata(t, mockedStorageService, "2017-09-04T12-40-36/database1/collection1.bson.snappy")
+	mockedStorageService.On("Download",
+		mock.MatchedBy(isTestContext),
+		"2017-09-04T12-40-36/database1/collection1.bson.snappy",
+		mock.AnythingOfType("*io.PipeWriter"),
+	).Return(fmt.Errorf("error downloading collection"))
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1_restore_2017-09-04T12-40-36", mock.Anything).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1_restore_2017-09-04T12-40-36", mock.Anything).Return(nil)
+	mockedMongoService.On("DropCollection", mock.Anything, "database1", "collection1_restore_2017-09-04T12-40-36").Return(nil)
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1_restore_2017-09-04T12-40-36", mock.Anything, restoreReplace).
+		Run(func(args mock.Arguments) {
+			_, _ = io.Copy(io.Discard, args.Get(3).(io.Reader))
+		}).
+		Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	err := backupService.Restore(ctx, "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{mode: restoreSwap})
+
+	assert.EqualError(t, err, "error downloading collection")
+	mockedMongoService.AssertNumberOfCalls(t, "DropCollection", 2)
+	mockedMongoService.AssertNotCalled(t, "RenameCollection", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRestore_SwapRefusesBackupWithoutMetadata(t *testing.T) {
+	mockedStorageService := new(mockStorageService)
+	mockedStorageService.On("List", mock.Anything, "2017-09-04T12-40-36/database1").Return([]storedObject{{Path: "2017-09-04T12-40-36/database1/collection1.bson.snappy"}}, nil)
+	mockedMongoService := new(mockMongoService)
+
+	backupService := newMongoBackupService(mockedMongoService, mockedStorageService, nil, backupOptions{})
+	err := backupService.Restore(context.Background(), "2017-09-04T12-40-36", []dbColl{{"database1", "collection1"}}, restoreOptions{mode: restoreSwap})
+
+	assert.EqualError(t, err, "backup of database1/collection1 has no collection metadata, swapping it in would drop the options and indexes of database1/collection1, use another mode")
+	mockedMongoService.AssertNotCalled(t, "DropCollection", mock.Anything, mock.Anything, mock.Anything)
+	mockedMongoService.AssertNotCalled(t, "RenameCollection", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCheckPartialRestore(t *testing.T) {
+	filter, _ := bson.Marshal(bson.D{{Key: "type", Value: "article"}})
+	projection, _ := bson.Marshal(bson.D{{Key: "body", Value: 0}})
+	filtered := collectionMetadata{Filter: filter}
+	projected := collectionMetadata{Filter: filter, Projection: projection}
+
+	for _, tc := range []struct {
+		metadata collectionMetadata
+		options  restoreOptions
+		ok       bool
+	}{
+		{filtered, restoreOptions{}, false},
+		{filtered, restoreOptions{mode: restoreSwap}, false},
+		{filtered, restoreOptions{mode: restoreUpsert}, true},
+		{filtered, restoreOptions{mode: restoreInsertMissing}, true},
+		{filtered, restoreOptions{mode: restoreFailIfNotEmpty}, true},
+		{filtered, restoreOptions{mode: restoreReplace, allowPartial: true}, true},
+		{projected, restoreOptions{mode: restoreUpsert}, false},
+		{projected, restoreOptions{mode: restoreInsertMissing}, true},
+		{projected, restoreOptions{mode: restoreUpsert, allowPartial: true}, true},
+	} {
+		err := checkPartialRestore(dbColl{"database1", "collection1"}, tc.metadata, tc.options)
+		assert.Equal(t, tc.ok, err == nil, "%v %+v: %v", tc.metadata.Projection, tc.options, err)
+	}
+}
+
+func TestParseRestoreTargets(t *testing.T) {
+	colls := []dbColl{{"database1", "collection1"}, {"database1", "collection2"}}
+
+	targets, err := parseRestoreTargets("database1/collection1=database2/collection1,database1/collection2=database1/collection2_copy", colls)
+	assert.NoError(t, err)
+	assert.Equal(t, map[dbColl]dbColl{
+		{"database1", "collection1"}: {"database2", "collection1"},
+		{"database1", "collection2"}: {"database1", "collection2_copy"},
+	}, targets)
+
+	for value, expected := range map[string]string{
+		"database1/collection1":                                 "failed to parse target mapping: database1/collection1",
+		"database1/collection1=database2":                       "failed to parse collection: database2",
+		"database1/collection3=database2/collection3":           "target mapping for database1/collection3, which is not being restored",
+		"database1/collection1=database1/collection2":           "database1/collection2 is both restored in place and a target of another collection",
+		"database1/collection1=db/c,database1/collection2=db/c": "more than one collection restored into db/c",
+	} {
+		_, err := parseRestoreTargets(value, colls)
+		assert.EqualError(t, err, expected)
+	}
+}
+
+func mockCollectionMetadata(mongoService *mockMongoService, storageService *mockStorageService) {
+	mongoService.On("CollectionMetadata", mock.Anything, mock.Anything, mock.Anything).Return(collectionMetadata{Type: "collection"}, nil)
+	storageService.On("Upload",
+		mock.Anything,
+		mock.MatchedBy(func(path string) bool { return strings.HasSuffix(path, ".metadata.json") }),
+		mock.AnythingOfType("*bytes.Reader"),
+	).Return(nil)
+}
+
+func isCollectionPath(database, collection string) func(string) bool {
+	return func(path string) bool {
+		return strings.HasSuffix(path, database+"/"+collection+".bson.snappy")
+	}
+}
+
+func isManifestPath(path string) bool {
+	return strings.HasSuffix(path, "/manifest.json")
+}
+
 func isTestContext(ctx context.Context) bool {
 	if value := ctx.Value("source"); value == "test" {
 		return true
@@ -224,3 +741,23 @@ func isTestContext(ctx context.Context) bool {
 
 	return false
 }
+
+// mockNoManifest makes the storage list nothing at the top of the backup, as
+// for backups taken before manifests were written.
+func mockNoManifest(storageService *mockStorageService, date string) {
+	storageService.On("List", mock.Anything, date).Return([]storedObject{}, nil)
+}
+
+// mockStoredMetadata makes the storage list the collection file and the
+// metadata of database1/collection1, and serve the metadata.
+func mockStoredMetadata(t *testing.T, storageService *mockStorageService, collectionPath string) {
+	data, err := marshalMetadata(collectionMetadata{CollectionName: "collection1", Type: "collection"})
+	assert.NoError(t, err)
+	metadataPath := metadataFilePath("2017-09-04T12-40-36", "database1", "collection1")
+	storageService.On("List", mock.Anything, "2017-09-04T12-40-36/database1").Return([]storedObject{{Path: collectionPath}, {Path: metadataPath}}, nil)
+	storageService.On("Download", mock.Anything, metadataPath, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = args.Get(2).(io.Writer).Write(data)
+		}).
+		Return(nil)
+}
@@ -4,6 +4,8 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+
+	"go.mongodb.org/mongo-driver/bson"
 )
 
 type bsonService interface {
@@ -42,3 +44,39 @@ func (m *defaultBsonService) ReadNextBSON(reader io.Reader) ([]byte, error) {
 	}
 	return buf, nil
 }
+
+// bsonTransformReader passes the documents of a BSON stream through a
+// transform. Documents for which the transform returns nil are dropped.
+type bsonTransformReader struct {
+	reader      io.Reader
+	bsonService bsonService
+	transform   func(doc bson.Raw) (bson.Raw, error)
+	buf         []byte
+}
+
+func newBSONTransformReader(reader io.Reader, bsonService bsonService, transform func(doc bson.Raw) (bson.Raw, error)) *bsonTransformReader {
+	return &bsonTransformReader{
+		reader:      reader,
+		bsonService: bsonService,
+		transform:   transform,
+	}
+}
+
+func (r *bsonTransformReader) Read(p []byte) (int, error) {
+	for len(r.buf) == 0 {
+		next, err := r.bsonService.ReadNextBSON(r.reader)
+		if err != nil {
+			return 0, err
+		}
+		if next == nil {
+			return 0, io.EOF
+		}
+		if r.buf, err = r.transform(next); err != nil {
+			return 0, err
+		}
+	}
+
+	n := copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return n, nil
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+const (
+	backupComplete   = "complete"
+	backupIncomplete = "incomplete"
+	// backupUnknown is reported for runs without a manifest, either because
+	// they are still in progress or because they predate manifests.
+	backupUnknown = "unknown"
+)
+
+type backupListing struct {
+	Date   string `json:"date"`
+	Status string `json:"status"`
+	// Format is the format the manifest records, empty for runs without
+	// a manifest.
+	Format      string              `json:"format,omitempty"`
+	Collections []collectionListing `json:"collections"`
+}
+
+type collectionListing struct {
+	Database   string `json:"database"`
+	Collection string `json:"collection"`
+	Size       int64  `json:"size"`
+	// InManifest tells whether the collection was recorded as successfully
+	// saved by the run.
+	InManifest bool `json:"inManifest"`
+}
+
+func (l *backupListing) collection(database, collection string) *collectionListing {
+	for i, coll := range l.Collections {
+		if coll.Database == database && coll.Collection == collection {
+			return &l.Collections[i]
+		}
+	}
+	return nil
+}
+
+// catalogService reads what is available in the storage backend, without
+// needing a connection to MongoDB.
+type catalogService struct {
+	storageService storageService
+}
+
+func newCatalogService(storageService storageService) *catalogService {
+	return &catalogService{
+		storageService: storageService,
+	}
+}
+
+// List returns every backup run found under the base directory, oldest first.
+func (c *catalogService) List(ctx context.Context) ([]backupListing, error) {
+	objects, err := c.storageService.List(ctx, "")
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list backups: %v", err)
+	}
+
+	listings := map[string]*backupListing{}
+	manifests := map[string]bool{}
+	listing := func(date string) *backupListing {
+		if _, ok := listings[date]; !ok {
+			listings[date] = &backupListing{Date: date, Status: backupUnknown, Collections: []collectionListing{}}
+		}
+		return listings[date]
+	}
+
+	for _, obj := range objects {
+		if date, database, collection, ok := parseCollectionFilePath(obj.Path); ok && isBackupDate(date) {
+			l := listing(date)
+			// The parts of a partitioned collection are listed as one.
+			if coll := l.collection(database, collection); coll != nil {
+				coll.Size += obj.Size
+				continue
+			}
+			l.Collections = append(l.Collections, collectionListing{
+				Database:   database,
+				Collection: collection,
+				Size:       obj.Size,
+			})
+			continue
+		}
+
+		date, name := filepath.Split(obj.Path)
+		date = strings.TrimSuffix(date, "/")
+		if name == manifestFileName && isBackupDate(date) {
+			listing(date)
+			manifests[date] = true
+		}
+	}
+
+	var result []backupListing
+	for date, l := range listings {
+		if manifests[date] {
+			manifest, err := c.downloadManifest(ctx, date)
+			if err != nil {
+				return nil, err
+			}
+			l.Status = backupIncomplete
+			if manifest.Complete {
+				l.Status = backupComplete
+			}
+			l.Format = manifest.format()
+			for i, coll := range l.Collections {
+				l.Collections[i].InManifest = manifest.hasCollection(coll.Database, coll.Collection)
+			}
+		}
+
+		sort.Slice(l.Collections, func(i, j int) bool {
+			if l.Collections[i].Database != l.Collections[j].Database {
+				return l.Collections[i].Database < l.Collections[j].Database
+			}
+			return l.Collections[i].Collection < l.Collections[j].Collection
+		})
+		result = append(result, *l)
+	}
+
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Date < result[j].Date
+	})
+	return result, nil
+}
+
+var errManifestNotFound = errors.New("manifest not found")
+
+// Manifest reads the manifest of a backup run. It returns errManifestNotFound
+// if the run has none.
+func (c *catalogService) Manifest(ctx context.Context, date string) (*backupManifest, error) {
+	found, err := objectExists(ctx, c.storageService, manifestFilePath(date))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list backup %s: %v", date, err)
+	}
+	if !found {
+		return nil, errManifestNotFound
+	}
+
+	return c.downloadManifest(ctx, date)
+}
+
+func (c *catalogService) downloadManifest(ctx context.Context, date string) (*backupManifest, error) {
+	buf := new(bytes.Buffer)
+	if err := c.storageService.Download(ctx, manifestFilePath(date), buf); err != nil {
+		return nil, fmt.Errorf("couldn't download manifest of backup %s: %v", date, err)
+	}
+
+	var manifest backupManifest
+	if err := json.Unmarshal(buf.Bytes(), &manifest); err != nil {
+		return nil, fmt.Errorf("couldn't parse manifest of backup %s: %v", date, err)
+	}
+	return &manifest, nil
+}
+
+func printListings(w io.Writer, listings []backupListing) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tSTATUS\tFORMAT\tCOLLECTION\tSIZE\tIN MANIFEST")
+	for _, l := range listings {
+		format := l.Format
+		if format == "" {
+			format = "-"
+		}
+		if len(l.Collections) == 0 {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t-\t-\t-\n", l.Date, l.Status, format)
+		}
+		for _, coll := range l.Collections {
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s/%s\t%d\t%v\n", l.Date, l.Status, format, coll.Database, coll.Collection, coll.Size, coll.InManifest)
+		}
+	}
+	return tw.Flush()
+}
+
+func printListingsJSON(w io.Writer, listings []backupListing) error {
+	if listings == nil {
+		listings = []backupListing{}
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(listings)
+}
+
+func isBackupDate(date string) bool {
+	_, err := time.Parse(dateFormat, date)
+	return err == nil
+}
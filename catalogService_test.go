@@ -0,0 +1,98 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func uploadTestManifest(t *testing.T, storageService storageService, manifest backupManifest) {
+	data, err := json.Marshal(manifest)
+	assert.NoError(t, err)
+	assert.NoError(t, storageService.Upload(context.Background(), manifestFilePath(manifest.Date), bytes.NewReader(data)))
+}
+
+func TestCatalogList_Ok(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	for _, path := range []string{
+		collectionFilePath("2017-09-04T12-40-36", "database1", "collection1", snappyCodec),
+		collectionFilePath("2017-09-04T12-40-36", "database1", "collection2", snappyCodec),
+		collectionFilePath("2017-09-05T12-40-36", "database1", "collection1", snappyCodec),
+		collectionFilePath("2017-09-06T12-40-36", "database1", "collection1", snappyCodec),
+		"not-a-date/database1/collection1.bson.snappy",
+	} {
+		assert.NoError(t, storageService.Upload(ctx, path, strings.NewReader("data")))
+	}
+	uploadTestManifest(t, storageService, backupManifest{
+		Date:     "2017-09-04T12-40-36",
+		Complete: true,
+		Collections: []collectionManifest{
+			{Database: "database1", Collection: "collection1"},
+			{Database: "database1", Collection: "collection2"},
+		},
+	})
+	uploadTestManifest(t, storageService, backupManifest{
+		Date:        "2017-09-05T12-40-36",
+		Collections: []collectionManifest{},
+	})
+
+	listings, err := newCatalogService(storageService).List(ctx)
+
+	assert.NoError(t, err, "Error wasn't expected during listing.")
+	assert.Equal(t, []backupListing{
+		{
+			Date:   "2017-09-04T12-40-36",
+			Status: backupComplete,
+			Format: nativeFormat,
+			Collections: []collectionListing{
+				{Database: "database1", Collection: "collection1", Size: 4, InManifest: true},
+				{Database: "database1", Collection: "collection2", Size: 4, InManifest: true},
+			},
+		},
+		{
+			Date:   "2017-09-05T12-40-36",
+			Status: backupIncomplete,
+			Format: nativeFormat,
+			Collections: []collectionListing{
+				{Database: "database1", Collection: "collection1", Size: 4},
+			},
+		},
+		{
+			Date:   "2017-09-06T12-40-36",
+			Status: backupUnknown,
+			Collections: []collectionListing{
+				{Database: "database1", Collection: "collection1", Size: 4},
+			},
+		},
+	}, listings)
+}
+
+func TestCatalogManifest_NotFound(t *testing.T) {
+	storageService := newFSStorageService(t.TempDir())
+
+	_, err := newCatalogService(storageService).Manifest(context.Background(), "2017-09-04T12-40-36")
+
+	assert.Equal(t, errManifestNotFound, err)
+}
+
+func TestPrintListings(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	err := printListings(buf, []backupListing{
+		{
+			Date:        "2017-09-04T12-40-36",
+			Status:      backupComplete,
+			Format:      nativeFormat,
+			Collections: []collectionListing{{Database: "database1", Collection: "collection1", Size: 4, InManifest: true}},
+		},
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, "DATE                 STATUS    FORMAT  COLLECTION             SIZE  IN MANIFEST\n"+
+		"2017-09-04T12-40-36  complete  native  database1/collection1  4     true\n", buf.String())
+}
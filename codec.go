@@ -0,0 +1,195 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec is the compression a collection object is stored with. It is part of
+// the object name, e.g. <date>/<database>/<collection>.bson.zst, so restores
+// can tell how to read an object without any other information.
+type codec string
+
+const (
+	snappyCodec codec = "snappy"
+	zstdCodec   codec = "zstd"
+	gzipCodec   codec = "gzip"
+	noCodec     codec = "none"
+)
+
+var codecs = []codec{snappyCodec, zstdCodec, gzipCodec, noCodec}
+
+func (c codec) extension() string {
+	switch c {
+	case snappyCodec:
+		return ".bson.snappy"
+	case zstdCodec:
+		return ".bson.zst"
+	case gzipCodec:
+		return ".bson.gz"
+	default:
+		return ".bson"
+	}
+}
+
+// codecOfFile returns the codec a collection object was stored with, going by
+// its name.
+func codecOfFile(name string) (codec, bool) {
+	for _, c := range codecs {
+		if strings.HasSuffix(name, c.extension()) {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// compression is the codec, and the level if the codec has any, that backups
+// are written with. A zero level is the default level of the codec.
+type compression struct {
+	codec codec
+	level int
+}
+
+var snappyCompression = compression{codec: snappyCodec}
+
+func parseCompression(name string, level int) (compression, error) {
+	c := compression{codec: codec(name), level: level}
+	switch c.codec {
+	case zstdCodec:
+		if level < 0 || level > 22 {
+			return compression{}, fmt.Errorf("zstd level must be between 1 and 22, got %d", level)
+		}
+	case gzipCodec:
+		if level < 0 || level > gzip.BestCompression {
+			return compression{}, fmt.Errorf("gzip level must be between 1 and %d, got %d", gzip.BestCompression, level)
+		}
+	case snappyCodec, noCodec:
+		if level != 0 {
+			return compression{}, fmt.Errorf("codec %s has no levels", name)
+		}
+	default:
+		return compression{}, fmt.Errorf("unknown codec: %s", name)
+	}
+	return c, nil
+}
+
+func (c compression) newWriteCloser(writeCloser io.WriteCloser) io.WriteCloser {
+	switch c.codec {
+	case snappyCodec:
+		return newSnappyWriteCloser(writeCloser)
+	case noCodec:
+		return writeCloser
+	}
+	return &codecWriteCloser{compression: c, writeCloser: writeCloser}
+}
+
+func (c codec) newReadCloser(readCloser io.ReadCloser) io.ReadCloser {
+	switch c {
+	case snappyCodec:
+		return newSnappyReadCloser(readCloser)
+	case noCodec:
+		return readCloser
+	}
+	return &codecReadCloser{codec: c, readCloser: readCloser}
+}
+
+// codecWriteCloser compresses with zstd or gzip. The encoder is created on the
+// first write, so setting it up can't fail when the pipe is created.
+type codecWriteCloser struct {
+	compression compression
+	writeCloser io.WriteCloser
+	encoder     io.WriteCloser
+}
+
+func (cwc *codecWriteCloser) init() (err error) {
+	if cwc.encoder != nil {
+		return nil
+	}
+	switch cwc.compression.codec {
+	case zstdCodec:
+		var options []zstd.EOption
+		if cwc.compression.level != 0 {
+			options = append(options, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(cwc.compression.level)))
+		}
+		cwc.encoder, err = zstd.NewWriter(cwc.writeCloser, options...)
+	case gzipCodec:
+		level := gzip.DefaultCompression
+		if cwc.compression.level != 0 {
+			level = cwc.compression.level
+		}
+		cwc.encoder, err = gzip.NewWriterLevel(cwc.writeCloser, level)
+	default:
+		err = fmt.Errorf("unknown codec: %s", cwc.compression.codec)
+	}
+	return err
+}
+
+func (cwc *codecWriteCloser) Write(p []byte) (int, error) {
+	if err := cwc.init(); err != nil {
+		return 0, err
+	}
+	return cwc.encoder.Write(p)
+}
+
+func (cwc *codecWriteCloser) Close() error {
+	if err := cwc.init(); err != nil {
+		_ = cwc.writeCloser.Close()
+		return err
+	}
+	if err := cwc.encoder.Close(); err != nil {
+		_ = cwc.writeCloser.Close()
+		return err
+	}
+	return cwc.writeCloser.Close()
+}
+
+// codecReadCloser decompresses zstd or gzip. The decoder is created on the
+// first read, as gzip reads its header straight away.
+type codecReadCloser struct {
+	codec      codec
+	readCloser io.ReadCloser
+	decoder    io.Reader
+	zstd       *zstd.Decoder
+}
+
+func (crc *codecReadCloser) init() error {
+	if crc.decoder != nil {
+		return nil
+	}
+	switch crc.codec {
+	case zstdCodec:
+		decoder, err := zstd.NewReader(crc.readCloser, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return err
+		}
+		crc.zstd = decoder
+		crc.decoder = decoder
+	case gzipCodec:
+		decoder, err := gzip.NewReader(crc.readCloser)
+		if err != nil {
+			return err
+		}
+		crc.decoder = decoder
+	default:
+		return fmt.Errorf("unknown codec: %s", crc.codec)
+	}
+	return nil
+}
+
+func (crc *codecReadCloser) Read(p []byte) (int, error) {
+	if err := crc.init(); err != nil {
+		return 0, err
+	}
+	return crc.decoder.Read(p)
+}
+
+func (crc *codecReadCloser) Close() error {
+	if crc.zstd != nil {
+		crc.zstd.Close()
+	}
+	return crc.readCloser.Close()
+}
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"golang.org/x/sync/errgroup"
+)
+
+// pipeRoundTrip sends data through an upload pipe and back through a
+// download pipe, returning the stored form and what was read back.
+func pipeRoundTrip(t *testing.T, c compression, data []byte) ([]byte, []byte) {
+	stored := new(bytes.Buffer)
+	reader, writer := newPipe(uploadOperation, c, nil)
+	g := new(errgroup.Group)
+	g.Go(func() error {
+		_, err := io.Copy(stored, reader)
+		return err
+	})
+	_, err := writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	assert.NoError(t, g.Wait())
+
+	restored := new(bytes.Buffer)
+	reader, writer = newPipe(downloadOperation, compression{codec: c.codec}, nil)
+	g.Go(func() error {
+		defer func() {
+			_ = writer.Close()
+		}()
+		_, err := writer.Write(stored.Bytes())
+		return err
+	})
+	_, err = io.Copy(restored, reader)
+	assert.NoError(t, err)
+	assert.NoError(t, g.Wait())
+	return stored.Bytes(), restored.Bytes()
+}
+
+func TestCodecs_RoundTrip(t *testing.T) {
+	data := bytes.Repeat([]byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00"), 10000)
+
+	for _, c := range []compression{
+		{codec: snappyCodec},
+		{codec: zstdCodec},
+		{codec: zstdCodec, level: 19},
+		{codec: gzipCodec},
+		{codec: gzipCodec, level: 1},
+		{codec: noCodec},
+	} {
+		stored, restored := pipeRoundTrip(t, c, data)
+		assert.Equal(t, data, restored, "%s level %d", c.codec, c.level)
+		if c.codec == noCodec {
+			assert.Equal(t, data, stored)
+		} else {
+			assert.Less(t, len(stored), len(data)/10, "%s level %d", c.codec, c.level)
+		}
+	}
+}
+
+func TestParseCompression(t *testing.T) {
+	c, err := parseCompression("zstd", 9)
+	assert.NoError(t, err)
+	assert.Equal(t, compression{codec: zstdCodec, level: 9}, c)
+
+	_, err = parseCompression("lz4", 0)
+	assert.EqualError(t, err, "unknown codec: lz4")
+	_, err = parseCompression("zstd", 23)
+	assert.Error(t, err)
+	_, err = parseCompression("gzip", 10)
+	assert.Error(t, err)
+	_, err = parseCompression("snappy", 3)
+	assert.EqualError(t, err, "codec snappy has no levels")
+}
+
+func TestParseCollectionFilePath_Codecs(t *testing.T) {
+	for _, c := range codecs {
+		path := collectionFilePath("2017-09-04T12-40-36", "database1", "collection.1", c)
+		date, database, collection, ok := parseCollectionFilePath(path)
+		assert.True(t, ok, path)
+		assert.Equal(t, "2017-09-04T12-40-36", date)
+		assert.Equal(t, "database1", database)
+		assert.Equal(t, "collection.1", collection)
+
+		found, _ := codecOfFile(path)
+		assert.Equal(t, c, found, path)
+	}
+
+	_, _, _, ok := parseCollectionFilePath(metadataFilePath("2017-09-04T12-40-36", "database1", "collection1"))
+	assert.False(t, ok)
+}
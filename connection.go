@@ -0,0 +1,109 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/options"
+)
+
+// connectionOptions are the TLS and authentication settings given next to
+// the connection string. Empty values keep what the connection string says.
+type connectionOptions struct {
+	tlsCAFile             string
+	tlsCertificateKeyFile string
+	authMechanism         string
+	authSource            string
+	username              string
+	passwordFile          string
+}
+
+// clientOptions builds the driver options from a connection string and the
+// connection options. The connection string is either a full mongodb:// or
+// mongodb+srv:// URI, which is used unchanged, or a bare comma separated
+// list of hosts.
+func clientOptions(uri string, timeout time.Duration, conn connectionOptions) (*options.ClientOptions, error) {
+	if !strings.Contains(uri, "://") {
+		uri = fmt.Sprintf("mongodb://%s", uri)
+	}
+	opts := options.Client().
+		ApplyURI(uri).
+		SetSocketTimeout(timeout)
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid connection string: %v", err)
+	}
+
+	if conn.tlsCAFile != "" || conn.tlsCertificateKeyFile != "" {
+		tlsConfig, err := newTLSConfig(opts.TLSConfig, conn)
+		if err != nil {
+			return nil, err
+		}
+		opts.SetTLSConfig(tlsConfig)
+	}
+
+	if conn.authMechanism == "" && conn.authSource == "" && conn.username == "" && conn.passwordFile == "" {
+		return opts, nil
+	}
+	var credential options.Credential
+	if opts.Auth != nil {
+		credential = *opts.Auth
+	}
+	if conn.authMechanism != "" {
+		credential.AuthMechanism = strings.ToUpper(conn.authMechanism)
+	}
+	if conn.authSource != "" {
+		credential.AuthSource = conn.authSource
+	}
+	if conn.username != "" {
+		credential.Username = conn.username
+	}
+	if conn.passwordFile != "" {
+		password, err := os.ReadFile(conn.passwordFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading password file: %v", err)
+		}
+		credential.Password = strings.TrimRight(string(password), "\r\n")
+		credential.PasswordSet = true
+	}
+	opts.SetAuth(credential)
+
+	if err := opts.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid authentication options: %v", err)
+	}
+	return opts, nil
+}
+
+// newTLSConfig adds the CA and client certificate files to the TLS settings
+// of the connection string, if it has any.
+func newTLSConfig(base *tls.Config, conn connectionOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{MinVersion: tls.VersionTLS12}
+	if base != nil {
+		tlsConfig = base.Clone()
+	}
+
+	if conn.tlsCAFile != "" {
+		pem, err := os.ReadFile(conn.tlsCAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS CA file: %v", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in TLS CA file %s", conn.tlsCAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if conn.tlsCertificateKeyFile != "" {
+		// Like the mongo shell, the file holds both the certificate and the key.
+		certificate, err := tls.LoadX509KeyPair(conn.tlsCertificateKeyFile, conn.tlsCertificateKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading TLS certificate key file: %v", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{certificate}
+	}
+	return tlsConfig, nil
+}
@@ -2,70 +2,217 @@ package main
 
 import (
 	"context"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"strings"
 	"time"
 
 	log "github.com/sirupsen/logrus"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
-	"golang.org/x/time/rate"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+	"golang.org/x/sync/errgroup"
 )
 
 type dbService interface {
-	SaveCollection(ctx context.Context, database, collection string, writer io.Writer) error
-	RestoreCollection(ctx context.Context, database, collection string, reader io.Reader) error
+	SaveCollection(ctx context.Context, database, collection string, query collectionQuery, writer io.Writer) error
+	PartitionCollection(ctx context.Context, database, collection string, partitionSize int64, maxPartitions int) ([]idRange, error)
+	SavePartition(ctx context.Context, database, collection string, partition idRange, query collectionQuery, writer io.Writer) error
+	PrepareRestore(ctx context.Context, database, collection string, mode restoreMode) error
+	RestoreCollection(ctx context.Context, database, collection string, reader io.Reader, mode restoreMode) error
+	TailOplog(ctx context.Context, namespaces []string, after primitive.Timestamp, entries chan<- []byte) error
+	LastOplogTimestamp(ctx context.Context) (primitive.Timestamp, error)
+	FirstOplogTimestamp(ctx context.Context) (primitive.Timestamp, error)
+	ApplyOplog(ctx context.Context, reader io.Reader) error
+	StartSnapshot(ctx context.Context) (context.Context, snapshot, error)
+	CollectionMetadata(ctx context.Context, database, collection string) (collectionMetadata, error)
+	CreateCollection(ctx context.Context, database, collection string, metadata collectionMetadata) error
+	CreateIndexes(ctx context.Context, database, collection string, indexes []bson.Raw) error
+	DropCollection(ctx context.Context, database, collection string) error
+	RenameCollection(ctx context.Context, database, from, to string) error
+	ListCollections(ctx context.Context) ([]dbColl, error)
+}
+
+// restoreMode decides how restored documents are combined with the documents
+// already in the collection.
+type restoreMode string
+
+const (
+	// restoreReplace empties the collection before loading the backup.
+	restoreReplace restoreMode = "replace"
+	// restoreUpsert replaces documents with the same _id, and keeps the others.
+	restoreUpsert restoreMode = "upsert"
+	// restoreInsertMissing only inserts documents whose _id doesn't exist.
+	restoreInsertMissing restoreMode = "insert-missing"
+	// restoreFailIfNotEmpty refuses to restore into a collection with documents.
+	restoreFailIfNotEmpty restoreMode = "fail-if-not-empty"
+	// restoreSwap loads the backup into a temporary collection, then renames
+	// it over the collection. It is handled by the backup service, documents
+	// are loaded into the temporary collection in replace mode.
+	restoreSwap restoreMode = "swap"
+	// restoreAppend inserts without touching the documents already in the
+	// collection. It is used internally to load the parts of a partitioned
+	// backup, after PrepareRestore prepared the collection once.
+	restoreAppend restoreMode = "append"
+)
+
+func parseRestoreMode(value string) (restoreMode, error) {
+	switch mode := restoreMode(strings.ToLower(value)); mode {
+	case restoreReplace, restoreUpsert, restoreInsertMissing, restoreFailIfNotEmpty, restoreSwap:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("unknown restore mode: %s", value)
+	}
 }
 
 type mongoService struct {
 	session     mongoSession
 	bsonService bsonService
-	rateLimit   time.Duration
 	batchLimit  int
+	// restoreWorkers is the number of bulk writes a restore issues at once.
+	restoreWorkers int
+	// restoreThrottle spaces out the bulk writes of all restores.
+	restoreThrottle restoreThrottle
 }
 
-func newMongoService(mongoClient mongoSession, bsonService bsonService, rateLimit time.Duration, batchLimit int) *mongoService {
+func newMongoService(mongoClient mongoSession, bsonService bsonService, rateLimit time.Duration, batchLimit int, restoreWorkers int, throttle throttleOptions) *mongoService {
 	return &mongoService{
-		session:     mongoClient,
-		bsonService: bsonService,
-		rateLimit:   rateLimit,
-		batchLimit:  batchLimit,
+		session:         mongoClient,
+		bsonService:     bsonService,
+		batchLimit:      batchLimit,
+		restoreWorkers:  restoreWorkers,
+		restoreThrottle: newRestoreThrottle(mongoClient, rateLimit, throttle),
 	}
 }
 
-func (m *mongoService) SaveCollection(ctx context.Context, database, collection string, writer io.Writer) error {
-	cur, err := m.session.FindAll(ctx, database, collection)
+func (m *mongoService) SaveCollection(ctx context.Context, database, collection string, query collectionQuery, writer io.Writer) error {
+	cur, err := m.session.FindAll(ctx, database, collection, query)
 	if err != nil {
 		return fmt.Errorf("couldn't obtain iterator over collection=%v/%v: %v", database, collection, err)
 	}
 
+	return m.save(ctx, cur, database, collection, writer)
+}
+
+// PartitionCollection splits a collection into _id ranges of about
+// partitionSize bytes each, but no more than maxPartitions of them. It
+// returns a single range covering the whole collection if it is smaller.
+func (m *mongoService) PartitionCollection(ctx context.Context, database, collection string, partitionSize int64, maxPartitions int) ([]idRange, error) {
+	size, err := m.session.CollectionSize(ctx, database, collection)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read size of collection=%v/%v: %v", database, collection, err)
+	}
+
+	parts := int((size + partitionSize - 1) / partitionSize)
+	if parts > maxPartitions {
+		parts = maxPartitions
+	}
+	if parts < 2 {
+		return []idRange{{}}, nil
+	}
+
+	ids, err := m.session.SampleIDs(ctx, database, collection, parts*samplesPerPartition)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't sample collection=%v/%v: %v", database, collection, err)
+	}
+	return partitionRanges(ids, parts), nil
+}
+
+// SavePartition writes the documents of one _id range of a collection.
+func (m *mongoService) SavePartition(ctx context.Context, database, collection string, partition idRange, query collectionQuery, writer io.Writer) error {
+	cur, err := m.session.FindRange(ctx, database, collection, partition, query)
+	if err != nil {
+		return fmt.Errorf("couldn't obtain iterator over partition of collection=%v/%v: %v", database, collection, err)
+	}
+
+	return m.save(ctx, cur, database, collection, writer)
+}
+
+func (m *mongoService) save(ctx context.Context, cur mongoCursor, database, collection string, writer io.Writer) error {
 	defer func() {
 		_ = cur.Close(context.Background())
 	}()
 
 	for cur.Next(ctx) {
-		if _, err = writer.Write(cur.Current()); err != nil {
+		if _, err := writer.Write(cur.Current()); err != nil {
 			return err
 		}
 	}
 
-	if err = cur.Err(); err != nil {
+	if err := cur.Err(); err != nil {
 		return fmt.Errorf("error while iterating over collection=%v/%v noticed only at the end: %v", database, collection, err)
 	}
 	return nil
 }
 
-func (m *mongoService) RestoreCollection(ctx context.Context, database, collection string, reader io.Reader) error {
-	err := m.session.RemoveAll(ctx, database, collection)
-	if err != nil {
-		return fmt.Errorf("error while clearing collection=%v/%v: %v", database, collection, err)
+// PrepareRestore gets a collection ready for documents to be restored into
+// it in the given mode, e.g. by emptying it.
+func (m *mongoService) PrepareRestore(ctx context.Context, database, collection string, mode restoreMode) error {
+	switch mode {
+	case restoreUpsert, restoreInsertMissing, restoreAppend:
+	case restoreFailIfNotEmpty:
+		hasDocuments, err := m.session.HasDocuments(ctx, database, collection)
+		if err != nil {
+			return fmt.Errorf("error while checking collection=%v/%v: %v", database, collection, err)
+		}
+		if hasDocuments {
+			return fmt.Errorf("collection=%v/%v is not empty", database, collection)
+		}
+	default:
+		if err := m.session.RemoveAll(ctx, database, collection); err != nil {
+			return fmt.Errorf("error while clearing collection=%v/%v: %v", database, collection, err)
+		}
 	}
+	return nil
+}
 
-	var batchBytes int
-	batchStart := time.Now().UTC()
+func (m *mongoService) RestoreCollection(ctx context.Context, database, collection string, reader io.Reader, mode restoreMode) error {
+	if err := m.PrepareRestore(ctx, database, collection, mode); err != nil {
+		return err
+	}
+
+	if m.restoreWorkers <= 1 {
+		return m.readBatches(reader, mode, func(models []mongo.WriteModel) error {
+			return m.writeBatch(ctx, database, collection, mode, models)
+		})
+	}
 
-	limiter := rate.NewLimiter(rate.Every(m.rateLimit), 1)
+	// The reader fills batches into a bounded channel, which the workers
+	// write out at the same time.
+	g, gctx := errgroup.WithContext(ctx)
+	batches := make(chan []mongo.WriteModel, m.restoreWorkers)
+	for i := 0; i < m.restoreWorkers; i++ {
+		g.Go(func() error {
+			for models := range batches {
+				if err := m.writeBatch(gctx, database, collection, mode, models); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+	g.Go(func() error {
+		defer close(batches)
 
+		return m.readBatches(reader, mode, func(models []mongo.WriteModel) error {
+			select {
+			case batches <- models:
+				return nil
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		})
+	})
+	return g.Wait()
+}
+
+// readBatches reads the documents to restore, and hands them to flush in
+// batches of up to batchLimit bytes.
+func (m *mongoService) readBatches(reader io.Reader, mode restoreMode, flush func(models []mongo.WriteModel) error) error {
+	var batchBytes int
 	var models []mongo.WriteModel
 
 	for {
@@ -81,30 +228,311 @@ func (m *mongoService) RestoreCollection(ctx context.Context, database, collecti
 		// the limit, write the batch out now. 15000000 is intended to be within the
 		// expected 16MB limit
 		if batchBytes > 0 && batchBytes+len(next) > m.batchLimit {
-			if err = m.session.BulkWrite(ctx, database, collection, models); err != nil {
-				return fmt.Errorf("error while writing bulk: %w", err)
+			if err = flush(models); err != nil {
+				return err
 			}
 
-			var duration = time.Since(batchStart)
-			log.Infof("Written bulk restore batch for %s/%s. Took %v", database, collection, duration)
-
-			// rate limit between writes to prevent overloading MongoDB
-			_ = limiter.Wait(context.Background())
-
 			models = nil
 			batchBytes = 0
-			batchStart = time.Now().UTC()
 		}
 
-		document := bson.Raw(next)
-		models = append(models, mongo.NewInsertOneModel().SetDocument(document))
+		model, err := restoreModel(mode, bson.Raw(next))
+		if err != nil {
+			return err
+		}
+		models = append(models, model)
 
 		batchBytes += len(next)
 	}
 
-	if err = m.session.BulkWrite(ctx, database, collection, models); err != nil {
-		return fmt.Errorf("error while writing bulk: %w", err)
+	if len(models) == 0 {
+		return nil
+	}
+	return flush(models)
+}
+
+// writeBatch writes a batch once the throttle allows, which is shared by all
+// writers to prevent overloading MongoDB. In insert-missing mode the
+// documents whose _id is already in the collection are left out.
+func (m *mongoService) writeBatch(ctx context.Context, database, collection string, mode restoreMode, models []mongo.WriteModel) error {
+	if err := m.restoreThrottle.Wait(ctx); err != nil {
+		return err
 	}
 
+	batchStart := time.Now().UTC()
+	if err := m.session.BulkWrite(ctx, database, collection, models); err != nil {
+		if mode != restoreInsertMissing || !duplicateKeysOnly(err) {
+			return fmt.Errorf("error while writing bulk: %w", err)
+		}
+	}
+
+	log.Infof("Written bulk restore batch for %s/%s. Took %v", database, collection, time.Since(batchStart))
 	return nil
 }
+
+// duplicateKeyCode is the code of the write errors of inserts whose _id, or
+// another unique key, is already in the collection.
+const duplicateKeyCode = 11000
+
+// duplicateKeysOnly tells whether every write a bulk write failed on was an
+// insert of an _id already in the collection. Bulk writes are unordered, so
+// all the other writes were still made.
+func duplicateKeysOnly(err error) bool {
+	var bulkErr mongo.BulkWriteException
+	if !errors.As(err, &bulkErr) || bulkErr.WriteConcernError != nil || len(bulkErr.WriteErrors) == 0 {
+		return false
+	}
+	for _, writeErr := range bulkErr.WriteErrors {
+		if writeErr.Code != duplicateKeyCode {
+			return false
+		}
+	}
+	return true
+}
+
+// restoreModel returns the write which restores the document in the given
+// mode. Insert-missing plainly inserts, writeBatch skips the documents which
+// are already there.
+func restoreModel(mode restoreMode, document bson.Raw) (mongo.WriteModel, error) {
+	switch mode {
+	case restoreUpsert:
+		id, err := document.LookupErr("_id")
+		if err != nil {
+			return nil, fmt.Errorf("error while reading _id of document: %v", err)
+		}
+		filter := bson.D{{Key: "_id", Value: id}}
+		return mongo.NewReplaceOneModel().SetFilter(filter).SetReplacement(document).SetUpsert(true), nil
+	default:
+		return mongo.NewInsertOneModel().SetDocument(document), nil
+	}
+}
+
+// TailOplog sends the oplog entries of the given namespaces written after the
+// given timestamp to the entries channel, until the context is done or the
+// cursor fails.
+func (m *mongoService) TailOplog(ctx context.Context, namespaces []string, after primitive.Timestamp, entries chan<- []byte) error {
+	cur, err := m.session.TailOplog(ctx, namespaces, after)
+	if err != nil {
+		return fmt.Errorf("couldn't tail oplog after %v: %v", after, err)
+	}
+
+	defer func() {
+		_ = cur.Close(context.Background())
+	}()
+
+	for cur.Next(ctx) {
+		// The cursor reuses its buffer between batches.
+		entry := make([]byte, len(cur.Current()))
+		copy(entry, cur.Current())
+
+		select {
+		case entries <- entry:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	if err = cur.Err(); err != nil {
+		return fmt.Errorf("error while tailing oplog: %v", err)
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("oplog cursor was closed by the server")
+}
+
+func (m *mongoService) LastOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	return m.session.LastOplogTimestamp(ctx)
+}
+
+func (m *mongoService) FirstOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	return m.session.FirstOplogTimestamp(ctx)
+}
+
+func (m *mongoService) StartSnapshot(ctx context.Context) (context.Context, snapshot, error) {
+	return m.session.StartSnapshot(ctx)
+}
+
+// CollectionMetadata reads the options and index definitions of a collection.
+func (m *mongoService) CollectionMetadata(ctx context.Context, database, collection string) (collectionMetadata, error) {
+	metadata := collectionMetadata{CollectionName: collection, Type: "collection"}
+
+	spec, err := m.session.CollectionSpec(ctx, database, collection)
+	if err != nil {
+		return metadata, fmt.Errorf("couldn't read options of collection=%v/%v: %v", database, collection, err)
+	}
+	if spec == nil {
+		// Nothing to describe, the backup of a missing collection is empty.
+		return metadata, nil
+	}
+
+	if kind, ok := spec.Lookup("type").StringValueOK(); ok {
+		metadata.Type = kind
+	}
+	if options, ok := spec.Lookup("options").DocumentOK(); ok {
+		metadata.Options = options
+	}
+	if _, uuid, ok := spec.Lookup("info", "uuid").BinaryOK(); ok {
+		metadata.UUID = hex.EncodeToString(uuid)
+	}
+
+	if metadata.Type != "collection" {
+		return metadata, nil
+	}
+	metadata.Indexes, err = m.session.ListIndexes(ctx, database, collection)
+	if err != nil {
+		return metadata, fmt.Errorf("couldn't list indexes of collection=%v/%v: %v", database, collection, err)
+	}
+	return metadata, nil
+}
+
+// CreateCollection creates the collection with the options recorded in the
+// metadata. An existing collection is left as it is.
+func (m *mongoService) CreateCollection(ctx context.Context, database, collection string, metadata collectionMetadata) error {
+	spec, err := m.session.CollectionSpec(ctx, database, collection)
+	if err != nil {
+		return fmt.Errorf("couldn't check collection=%v/%v: %v", database, collection, err)
+	}
+	if spec != nil {
+		log.Infof("Collection %s/%s already exists, keeping its options", database, collection)
+		return nil
+	}
+
+	options := metadata.Options
+	if options == nil {
+		options = emptyDocument()
+	}
+	if err = m.session.CreateCollection(ctx, database, collection, options); err != nil {
+		return fmt.Errorf("couldn't create collection=%v/%v: %v", database, collection, err)
+	}
+	return nil
+}
+
+// CreateIndexes builds the given indexes, apart from the _id index which every
+// collection has anyway.
+func (m *mongoService) CreateIndexes(ctx context.Context, database, collection string, indexes []bson.Raw) error {
+	indexes, err := restorableIndexes(indexes)
+	if err != nil {
+		return err
+	}
+	if len(indexes) == 0 {
+		return nil
+	}
+
+	start := time.Now().UTC()
+	if err = m.session.CreateIndexes(ctx, database, collection, indexes); err != nil {
+		return fmt.Errorf("couldn't create indexes on collection=%v/%v: %v", database, collection, err)
+	}
+	log.Infof("Built %d indexes for %s/%s. Took %v", len(indexes), database, collection, time.Since(start))
+	return nil
+}
+
+func (m *mongoService) DropCollection(ctx context.Context, database, collection string) error {
+	if err := m.session.DropCollection(ctx, database, collection); err != nil {
+		return fmt.Errorf("couldn't drop collection=%v/%v: %v", database, collection, err)
+	}
+	return nil
+}
+
+// RenameCollection renames the collection from over the collection to,
+// dropping the latter.
+func (m *mongoService) RenameCollection(ctx context.Context, database, from, to string) error {
+	if err := m.session.RenameCollection(ctx, database, from, to); err != nil {
+		return fmt.Errorf("couldn't rename collection=%v/%v to %v: %v", database, from, to, err)
+	}
+	log.Infof("Renamed %s/%s over %s/%s", database, from, database, to)
+	return nil
+}
+
+// ListCollections returns the collections of all databases, leaving out views
+// and system collections.
+func (m *mongoService) ListCollections(ctx context.Context) ([]dbColl, error) {
+	databases, err := m.session.ListDatabases(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("error while listing databases: %v", err)
+	}
+
+	var colls []dbColl
+	for _, database := range databases {
+		collections, err := m.session.ListCollections(ctx, database)
+		if err != nil {
+			return nil, fmt.Errorf("error while listing collections of %s: %v", database, err)
+		}
+		for _, collection := range collections {
+			if !isSystemCollection(collection) {
+				colls = append(colls, dbColl{database, collection})
+			}
+		}
+	}
+	return colls, nil
+}
+
+// ApplyOplog replays the oplog entries read from the reader with applyOps,
+// batched and throttled the same way as restored documents.
+func (m *mongoService) ApplyOplog(ctx context.Context, reader io.Reader) error {
+	var batchBytes int
+	var ops []bson.Raw
+
+	for {
+		next, err := m.bsonService.ReadNextBSON(reader)
+		if err != nil {
+			return fmt.Errorf("error while reading oplog entry: %v", err)
+		}
+		if next == nil {
+			break
+		}
+
+		op, err := applicableOp(next)
+		if err != nil {
+			return err
+		}
+
+		if batchBytes > 0 && batchBytes+len(op) > m.batchLimit {
+			if err = m.applyOps(ctx, ops); err != nil {
+				return err
+			}
+
+			ops = nil
+			batchBytes = 0
+		}
+
+		ops = append(ops, op)
+		batchBytes += len(op)
+	}
+
+	if len(ops) == 0 {
+		return nil
+	}
+	return m.applyOps(ctx, ops)
+}
+
+// applyOps applies a batch of oplog entries once the restore throttle allows.
+func (m *mongoService) applyOps(ctx context.Context, ops []bson.Raw) error {
+	if err := m.restoreThrottle.Wait(ctx); err != nil {
+		return err
+	}
+	if err := m.session.ApplyOps(ctx, ops); err != nil {
+		return fmt.Errorf("error while applying oplog entries: %w", err)
+	}
+	return nil
+}
+
+// applicableOp keeps only the fields of an oplog entry which applyOps needs.
+// Notably the collection UUID is dropped, as restored collections don't have
+// the same UUID as the ones the oplog was captured from.
+func applicableOp(entry []byte) (bson.Raw, error) {
+	raw := bson.Raw(entry)
+	var op bson.D
+	for _, key := range []string{"op", "ns", "o", "o2"} {
+		value, err := raw.LookupErr(key)
+		if err == bsoncore.ErrElementNotFound {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("invalid oplog entry: %v", err)
+		}
+		op = append(op, bson.E{Key: key, Value: value})
+	}
+
+	return bson.Marshal(op)
+}
@@ -6,12 +6,14 @@ import (
 	"fmt"
 	"io"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/mock"
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -20,33 +22,79 @@ func TestSaveCollection_Ok(t *testing.T) {
 	stringWriter := bytes.NewBufferString("")
 	mockedMongoSession := new(mockMongoSession)
 	mockedMongoIter := new(mockMongoCur)
-	mockedMongoSession.On("FindAll", ctx, "database1", "collection1").Return(mockedMongoIter, nil)
+	mockedMongoSession.On("FindAll", ctx, "database1", "collection1", collectionQuery{}).Return(mockedMongoIter, nil)
 	mockedMongoIter.On("Next", ctx).Times(3).Return(true)
 	mockedMongoIter.On("Current").Times(3).Return([]byte("data"))
 	mockedMongoIter.On("Next", ctx).Return(false)
 	mockedMongoIter.On("Err").Return(nil)
 	mockedMongoIter.On("Close", ctx).Return(nil)
 
-	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000)
-	err := mongoService.SaveCollection(ctx, "database1", "collection1", stringWriter)
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.SaveCollection(ctx, "database1", "collection1", collectionQuery{}, stringWriter)
 
 	assert.NoError(t, err, "Error wasn't expected during dump.")
 	assert.Equal(t, "datadatadata", stringWriter.String())
 }
 
+func TestSavePartition_Ok(t *testing.T) {
+	ctx := context.Background()
+	stringWriter := bytes.NewBufferString("")
+	partition := partitionRanges(int32IDs(1, 2, 3, 4), 2)[1]
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoIter := new(mockMongoCur)
+	mockedMongoSession.On("FindRange", ctx, "database1", "collection1", partition, collectionQuery{}).Return(mockedMongoIter, nil)
+	mockedMongoIter.On("Next", ctx).Times(2).Return(true)
+	mockedMongoIter.On("Current").Times(2).Return([]byte("data"))
+	mockedMongoIter.On("Next", ctx).Return(false)
+	mockedMongoIter.On("Err").Return(nil)
+	mockedMongoIter.On("Close", ctx).Return(nil)
+
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.SavePartition(ctx, "database1", "collection1", partition, collectionQuery{}, stringWriter)
+
+	assert.NoError(t, err, "Error wasn't expected during dump.")
+	assert.Equal(t, "datadata", stringWriter.String())
+}
+
+func TestPartitionCollection_Small(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("CollectionSize", ctx, "database1", "collection1").Return(int64(900), nil)
+
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	partitions, err := mongoService.PartitionCollection(ctx, "database1", "collection1", 1000, 8)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []idRange{{}}, partitions, "A collection smaller than a partition shouldn't be split.")
+	mockedMongoSession.AssertNotCalled(t, "SampleIDs", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestPartitionCollection_Splits(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("CollectionSize", ctx, "database1", "collection1").Return(int64(100000), nil)
+	mockedMongoSession.On("SampleIDs", ctx, "database1", "collection1", 3*samplesPerPartition).Return(int32IDs(1, 2, 3, 4, 5, 6), nil)
+
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	partitions, err := mongoService.PartitionCollection(ctx, "database1", "collection1", 1000, 3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, [][2]interface{}{{nil, int32(3)}, {int32(3), int32(5)}, {int32(5), nil}}, rangeBounds(partitions))
+}
+
 func TestSaveCollection_WriterErr(t *testing.T) {
 	ctx := context.Background()
 	cappedStringWriter := newCappedBuffer(make([]byte, 0, 4), 11)
 	mockedMongoSession := new(mockMongoSession)
 	mockedMongoIter := new(mockMongoCur)
-	mockedMongoSession.On("FindAll", ctx, "database1", "collection1").Return(mockedMongoIter, nil)
+	mockedMongoSession.On("FindAll", ctx, "database1", "collection1", collectionQuery{}).Return(mockedMongoIter, nil)
 	mockedMongoIter.On("Next", ctx).Return(true)
 	mockedMongoIter.On("Current").Return([]byte("data"))
 	mockedMongoIter.On("Err").Return(nil)
 	mockedMongoIter.On("Close", ctx).Return(nil)
 
-	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000)
-	err := mongoService.SaveCollection(ctx, "database1", "collection1", cappedStringWriter)
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.SaveCollection(ctx, "database1", "collection1", collectionQuery{}, cappedStringWriter)
 
 	assert.Error(t, err, "Error expected during write.")
 	assert.EqualError(t, err, "buffer overflow")
@@ -57,15 +105,15 @@ func TestSaveCollection_IterationErr(t *testing.T) {
 	stringWriter := bytes.NewBufferString("")
 	mockedMongoSession := new(mockMongoSession)
 	mockedMongoIter := new(mockMongoCur)
-	mockedMongoSession.On("FindAll", ctx, "database1", "collection1").Return(mockedMongoIter, nil)
+	mockedMongoSession.On("FindAll", ctx, "database1", "collection1", collectionQuery{}).Return(mockedMongoIter, nil)
 	mockedMongoIter.On("Next", ctx).Times(3).Return(true)
 	mockedMongoIter.On("Current").Times(3).Return([]byte("data"))
 	mockedMongoIter.On("Next", ctx).Return(false)
 	mockedMongoIter.On("Err").Return(fmt.Errorf("iteration error"))
 	mockedMongoIter.On("Close", ctx).Return(nil)
 
-	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000)
-	err := mongoService.SaveCollection(ctx, "database1", "collection1", stringWriter)
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.SaveCollection(ctx, "database1", "collection1", collectionQuery{}, stringWriter)
 
 	assert.Error(t, err, "Error expected for iterator.")
 	assert.Equal(t, "datadatadata", stringWriter.String())
@@ -83,8 +131,8 @@ func TestRestoreCollection_Ok(t *testing.T) {
 	var end []byte
 	mockedBsonService.On("ReadNextBSON", mock.MatchedBy(func(reader io.Reader) bool { return true })).Return(end, nil)
 
-	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000)
-	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"))
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreReplace)
 
 	assert.NoError(t, err, "Error wasn't expected during restore.")
 }
@@ -95,8 +143,8 @@ func TestRestoreCollection_ErrOnClean(t *testing.T) {
 	mockedMongoSession := new(mockMongoSession)
 	mockedMongoSession.On("RemoveAll", ctx, "database1", "collection1").Return(fmt.Errorf("couldn't clean"))
 
-	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000)
-	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"))
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreReplace)
 
 	assert.Error(t, err, "Error was expected during restore.")
 	assert.EqualError(t, err, "error while clearing collection=database1/collection1: couldn't clean")
@@ -110,8 +158,8 @@ func TestRestoreCollection_ErrOnRead(t *testing.T) {
 	mockedBsonService.On("ReadNextBSON", mock.MatchedBy(func(reader io.Reader) bool { return true })).Times(3).Return([]byte("bson"), nil)
 	var end []byte
 	mockedBsonService.On("ReadNextBSON", mock.MatchedBy(func(reader io.Reader) bool { return true })).Return(end, fmt.Errorf("error on read from unit test"))
-	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000)
-	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"))
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreReplace)
 
 	assert.Error(t, err, "Error was expected during restore.")
 	assert.EqualError(t, err, "error while reading bson: error on read from unit test")
@@ -128,8 +176,8 @@ func TestRestoreCollection_ErrorOnWrite(t *testing.T) {
 	var end []byte
 	mockedBsonService.On("ReadNextBSON", mock.MatchedBy(func(reader io.Reader) bool { return true })).Return(end, nil)
 
-	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000)
-	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"))
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreReplace)
 
 	assert.Error(t, err)
 	assert.EqualError(t, err, "error while writing bulk: error writing to db from test")
@@ -151,9 +199,276 @@ func TestRestoreCollection_ErrorAfterOneBulkBatching(t *testing.T) {
 	var end []byte
 	mockedBsonService.On("ReadNextBSON", mock.MatchedBy(func(reader io.Reader) bool { return true })).Return(end, nil)
 
-	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000)
-	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"))
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreReplace)
 
 	assert.Error(t, err)
 	assert.EqualError(t, err, "error while writing bulk: error writing to db from test")
 }
+
+func TestRestoreCollection_Workers(t *testing.T) {
+	ctx := context.Background()
+	var data []byte
+	for i := 0; i < 10; i++ {
+		doc, _ := bson.Marshal(bson.D{{Key: "_id", Value: i}})
+		data = append(data, doc...)
+	}
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("RemoveAll", ctx, "database1", "collection1").Return(nil)
+	var lock sync.Mutex
+	var written, running, maxRunning int
+	mockedMongoSession.On("BulkWrite", mock.Anything, "database1", "collection1", mock.Anything).Return(nil).Run(func(args mock.Arguments) {
+		lock.Lock()
+		written += len(args.Get(3).([]mongo.WriteModel))
+		running++
+		if running > maxRunning {
+			maxRunning = running
+		}
+		lock.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		lock.Lock()
+		running--
+		lock.Unlock()
+	})
+
+	// Each document fills a batch on its own.
+	mongoService := newMongoService(mockedMongoSession, &defaultBsonService{}, 0, 1, 3, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", bytes.NewReader(data), restoreReplace)
+
+	assert.NoError(t, err)
+	assert.Equal(t, 10, written)
+	assert.Greater(t, maxRunning, 1, "Batches should be written at the same time.")
+	assert.LessOrEqual(t, maxRunning, 3)
+}
+
+func TestRestoreCollection_WorkersErrorOnWrite(t *testing.T) {
+	ctx := context.Background()
+	var data []byte
+	for i := 0; i < 10; i++ {
+		doc, _ := bson.Marshal(bson.D{{Key: "_id", Value: i}})
+		data = append(data, doc...)
+	}
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("RemoveAll", ctx, "database1", "collection1").Return(nil)
+	mockedMongoSession.On("BulkWrite", mock.Anything, "database1", "collection1", mock.Anything).Return(fmt.Errorf("error writing to db from test"))
+
+	mongoService := newMongoService(mockedMongoSession, &defaultBsonService{}, 0, 1, 3, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", bytes.NewReader(data), restoreReplace)
+
+	assert.EqualError(t, err, "error while writing bulk: error writing to db from test")
+}
+
+func TestRestoreCollection_EmptyWritesNothing(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("RemoveAll", ctx, "database1", "collection1").Return(nil)
+
+	mongoService := newMongoService(mockedMongoSession, &defaultBsonService{}, 0, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", bytes.NewReader(nil), restoreReplace)
+
+	assert.NoError(t, err)
+	mockedMongoSession.AssertNotCalled(t, "BulkWrite", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRestoreCollection_Upsert(t *testing.T) {
+	ctx := context.Background()
+	doc, _ := bson.Marshal(bson.D{{Key: "_id", Value: "id1"}, {Key: "hello", Value: "world"}})
+	mockedBsonService := new(mockBsonService)
+	mockedMongoSession := new(mockMongoSession)
+	id, _ := bson.Raw(doc).LookupErr("_id")
+	model := mongo.NewReplaceOneModel().
+		SetFilter(bson.D{{Key: "_id", Value: id}}).
+		SetReplacement(bson.Raw(doc)).
+		SetUpsert(true)
+	mockedMongoSession.On("BulkWrite", ctx, "database1", "collection1", []mongo.WriteModel{model}).Return(nil)
+	mockedBsonService.On("ReadNextBSON", mock.Anything).Once().Return(doc, nil)
+	var end []byte
+	mockedBsonService.On("ReadNextBSON", mock.Anything).Return(end, nil)
+
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreUpsert)
+
+	assert.NoError(t, err, "Error wasn't expected during restore.")
+	mockedMongoSession.AssertNotCalled(t, "RemoveAll", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRestoreCollection_InsertMissing(t *testing.T) {
+	ctx := context.Background()
+	doc, _ := bson.Marshal(bson.D{{Key: "_id", Value: "id1"}, {Key: "hello", Value: "world"}})
+	mockedBsonService := new(mockBsonService)
+	mockedMongoSession := new(mockMongoSession)
+	model := mongo.NewInsertOneModel().SetDocument(bson.Raw(doc))
+	// The document is already there, which isn't an error in this mode.
+	mockedMongoSession.On("BulkWrite", ctx, "database1", "collection1", []mongo.WriteModel{model}).
+		Return(mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{{WriteError: mongo.WriteError{Code: duplicateKeyCode}}}})
+	mockedBsonService.On("ReadNextBSON", mock.Anything).Once().Return(doc, nil)
+	var end []byte
+	mockedBsonService.On("ReadNextBSON", mock.Anything).Return(end, nil)
+
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreInsertMissing)
+
+	assert.NoError(t, err, "Error wasn't expected during restore.")
+	mockedMongoSession.AssertNotCalled(t, "RemoveAll", mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestRestoreCollection_InsertMissingOtherWriteErrors(t *testing.T) {
+	ctx := context.Background()
+	doc, _ := bson.Marshal(bson.D{{Key: "_id", Value: "id1"}, {Key: "hello", Value: "world"}})
+	mockedBsonService := new(mockBsonService)
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("BulkWrite", ctx, "database1", "collection1", mock.Anything).
+		Return(mongo.BulkWriteException{WriteErrors: []mongo.BulkWriteError{
+			{WriteError: mongo.WriteError{Code: duplicateKeyCode}},
+			{WriteError: mongo.WriteError{Code: 121, Message: "Document failed validation"}},
+		}})
+	mockedBsonService.On("ReadNextBSON", mock.Anything).Once().Return(doc, nil)
+	var end []byte
+	mockedBsonService.On("ReadNextBSON", mock.Anything).Return(end, nil)
+
+	mongoService := newMongoService(mockedMongoSession, mockedBsonService, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreInsertMissing)
+
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Document failed validation")
+	}
+}
+
+func TestRestoreCollection_FailIfNotEmpty(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("HasDocuments", ctx, "database1", "collection1").Return(true, nil)
+
+	mongoService := newMongoService(mockedMongoSession, new(mockBsonService), 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.RestoreCollection(ctx, "database1", "collection1", strings.NewReader("nothing"), restoreFailIfNotEmpty)
+
+	assert.EqualError(t, err, "collection=database1/collection1 is not empty")
+	mockedMongoSession.AssertNotCalled(t, "BulkWrite", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestApplyOplog_Ok(t *testing.T) {
+	ctx := context.Background()
+	ui := primitive.Binary{Subtype: 4, Data: make([]byte, 16)}
+	entry, _ := bson.Marshal(bson.D{
+		{Key: "ts", Value: primitive.Timestamp{T: 1000, I: 1}},
+		{Key: "op", Value: "u"},
+		{Key: "ns", Value: "database1.collection1"},
+		{Key: "ui", Value: ui},
+		{Key: "o", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: 1}}}}},
+		{Key: "o2", Value: bson.D{{Key: "_id", Value: 1}}},
+	})
+	op, _ := bson.Marshal(bson.D{
+		{Key: "op", Value: "u"},
+		{Key: "ns", Value: "database1.collection1"},
+		{Key: "o", Value: bson.D{{Key: "$set", Value: bson.D{{Key: "a", Value: 1}}}}},
+		{Key: "o2", Value: bson.D{{Key: "_id", Value: 1}}},
+	})
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ApplyOps", ctx, []bson.Raw{op, op}).Return(nil)
+
+	mongoService := newMongoService(mockedMongoSession, &defaultBsonService{}, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.ApplyOplog(ctx, bytes.NewReader(append(entry, entry...)))
+
+	assert.NoError(t, err, "Error wasn't expected during oplog replay.")
+	mockedMongoSession.AssertExpectations(t)
+}
+
+func TestApplyOplog_ErrorOnApply(t *testing.T) {
+	ctx := context.Background()
+	entry, _ := bson.Marshal(bson.D{
+		{Key: "op", Value: "d"},
+		{Key: "ns", Value: "database1.collection1"},
+		{Key: "o", Value: bson.D{{Key: "_id", Value: 1}}},
+	})
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ApplyOps", ctx, mock.Anything).Return(fmt.Errorf("error applying ops from test"))
+
+	mongoService := newMongoService(mockedMongoSession, &defaultBsonService{}, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.ApplyOplog(ctx, bytes.NewReader(entry))
+
+	assert.EqualError(t, err, "error while applying oplog entries: error applying ops from test")
+}
+
+func TestApplyOplog_Cancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	entry, _ := bson.Marshal(bson.D{
+		{Key: "op", Value: "d"},
+		{Key: "ns", Value: "database1.collection1"},
+		{Key: "o", Value: bson.D{{Key: "_id", Value: 1}}},
+	})
+	mockedMongoSession := new(mockMongoSession)
+
+	// The throttle gives up waiting once the replay is cancelled.
+	mongoService := newMongoService(mockedMongoSession, &defaultBsonService{}, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.ApplyOplog(ctx, bytes.NewReader(entry))
+
+	assert.Equal(t, context.Canceled, err)
+	mockedMongoSession.AssertNotCalled(t, "ApplyOps", mock.Anything, mock.Anything)
+}
+
+func TestCollectionMetadata_Ok(t *testing.T) {
+	ctx := context.Background()
+	spec, _ := bson.Marshal(bson.D{
+		{Key: "name", Value: "collection1"},
+		{Key: "type", Value: "collection"},
+		{Key: "options", Value: bson.D{{Key: "capped", Value: true}}},
+		{Key: "info", Value: bson.D{{Key: "uuid", Value: primitive.Binary{Subtype: 4, Data: []byte{0xab, 0xcd}}}}},
+	})
+	index, _ := bson.Marshal(bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}})
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("CollectionSpec", ctx, "database1", "collection1").Return(bson.Raw(spec), nil)
+	mockedMongoSession.On("ListIndexes", ctx, "database1", "collection1").Return([]bson.Raw{index}, nil)
+
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	metadata, err := mongoService.CollectionMetadata(ctx, "database1", "collection1")
+
+	assert.NoError(t, err, "Error wasn't expected reading metadata.")
+	assert.Equal(t, "collection1", metadata.CollectionName)
+	assert.Equal(t, "collection", metadata.Type)
+	assert.Equal(t, "abcd", metadata.UUID)
+	assert.True(t, metadata.Options.Lookup("capped").Boolean())
+	assert.Equal(t, []bson.Raw{index}, metadata.Indexes)
+}
+
+func TestCreateCollection_KeepsExisting(t *testing.T) {
+	ctx := context.Background()
+	spec, _ := bson.Marshal(bson.D{{Key: "name", Value: "collection1"}})
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("CollectionSpec", ctx, "database1", "collection1").Return(bson.Raw(spec), nil)
+
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.CreateCollection(ctx, "database1", "collection1", collectionMetadata{})
+
+	assert.NoError(t, err)
+	mockedMongoSession.AssertNotCalled(t, "CreateCollection", mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestCreateIndexes_SkipsIDIndex(t *testing.T) {
+	ctx := context.Background()
+	idIndex, _ := bson.Marshal(bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "_id", Value: 1}}}, {Key: "name", Value: "_id_"}})
+	index, _ := bson.Marshal(bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "uuid", Value: 1}}}, {Key: "name", Value: "uuid_1"}, {Key: "ns", Value: "database1.collection1"}})
+	expected, _ := bson.Marshal(bson.D{{Key: "v", Value: 2}, {Key: "key", Value: bson.D{{Key: "uuid", Value: 1}}}, {Key: "name", Value: "uuid_1"}})
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("CreateIndexes", ctx, "database1", "collection1", []bson.Raw{expected}).Return(nil)
+
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	err := mongoService.CreateIndexes(ctx, "database1", "collection1", []bson.Raw{idIndex, index})
+
+	assert.NoError(t, err)
+	mockedMongoSession.AssertExpectations(t)
+}
+
+func TestListCollections_SkipsSystemCollections(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ListDatabases", ctx).Return([]string{"database1", "database2"}, nil)
+	mockedMongoSession.On("ListCollections", ctx, "database1").Return([]string{"collection1", "system.profile"}, nil)
+	mockedMongoSession.On("ListCollections", ctx, "database2").Return([]string{"collection2"}, nil)
+
+	mongoService := newMongoService(mockedMongoSession, nil, 250*time.Millisecond, 15000000, 1, throttleOptions{})
+	colls, err := mongoService.ListCollections(ctx)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []dbColl{{"database1", "collection1"}, {"database2", "collection2"}}, colls)
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+// documentSelection picks the documents of a backup a restore loads, by _id,
+// by a filter, or by both.
+type documentSelection struct {
+	// ids holds the keys of the selected _ids, nil selects any _id.
+	ids map[string]bool
+	// idCount is the number of _ids listed.
+	idCount int
+	filter  []documentCondition
+}
+
+// documentCondition is a condition of a filter, which a document has to meet.
+type documentCondition interface {
+	matches(doc bson.Raw) bool
+}
+
+// newDocumentSelection reads the _ids listed in idsFile, and parses filter.
+// It returns nil if neither is given.
+func newDocumentSelection(idsFile, filter string) (*documentSelection, error) {
+	if idsFile == "" && filter == "" {
+		return nil, nil
+	}
+
+	selection := &documentSelection{}
+	if idsFile != "" {
+		file, err := os.Open(idsFile)
+		if err != nil {
+			return nil, fmt.Errorf("error opening ids file: %v", err)
+		}
+		defer file.Close()
+
+		if err := selection.readIDs(file); err != nil {
+			return nil, err
+		}
+	}
+	if filter != "" {
+		conditions, err := parseDocumentFilter(filter)
+		if err != nil {
+			return nil, err
+		}
+		selection.filter = conditions
+	}
+	return selection, nil
+}
+
+// readIDs reads one _id per line, as a relaxed extended JSON value or a plain
+// string. Hex strings of ObjectIds select the ObjectId too. Empty lines and
+// lines starting with # are skipped.
+func (s *documentSelection) readIDs(reader io.Reader) error {
+	s.ids = make(map[string]bool)
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		id, err := parseLooseValue(line)
+		if err != nil {
+			return fmt.Errorf("invalid id %s: %v", line, err)
+		}
+		s.ids[idKey(id)] = true
+		if id.Type == bsontype.String {
+			if oid, err := primitive.ObjectIDFromHex(id.StringValue()); err == nil {
+				s.ids[idKey(bson.RawValue{Type: bsontype.ObjectID, Value: oid[:]})] = true
+			}
+		}
+		s.idCount++
+	}
+	if err := scanner.Err(); err != nil {
+		return fmt.Errorf("error reading ids file: %v", err)
+	}
+	if s.idCount == 0 {
+		return fmt.Errorf("no ids in ids file")
+	}
+	return nil
+}
+
+// idKey returns the key of an _id in the selected ids. Numbers are keyed by
+// their value, so 42 selects both an int32 and an int64 _id.
+func idKey(id bson.RawValue) string {
+	if x, ok := numberValue(id); ok {
+		return "n" + strconv.FormatFloat(x, 'g', -1, 64)
+	}
+	return string([]byte{byte(id.Type)}) + string(id.Value)
+}
+
+// matches reports whether the document has one of the selected _ids, and
+// meets all conditions of the filter.
+func (s *documentSelection) matches(doc bson.Raw) bool {
+	if s.ids != nil {
+		id, err := doc.LookupErr("_id")
+		if err != nil || !s.ids[idKey(id)] {
+			return false
+		}
+	}
+	for _, condition := range s.filter {
+		if !condition.matches(doc) {
+			return false
+		}
+	}
+	return true
+}
+
+var filterOperators = map[string]string{
+	"$eq":  "=",
+	"$ne":  "!=",
+	"$lt":  "<",
+	"$lte": "<=",
+	"$gt":  ">",
+	"$gte": ">=",
+}
+
+// parseDocumentFilter parses a MongoDB query given in relaxed extended JSON,
+// e.g. {"type": "article", "publishedDate": {"$gte": {"$date": "2022-06-01T00:00:00Z"}}}.
+// Fields are compared like export predicates, with the operators $eq, $ne,
+// $lt, $lte, $gt, $gte, $in, $nin and $exists.
+func parseDocumentFilter(value string) ([]documentCondition, error) {
+	var filter bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(value), false, &filter); err != nil {
+		return nil, fmt.Errorf("invalid filter %s: %v", value, err)
+	}
+	elements, err := filter.Elements()
+	if err != nil {
+		return nil, fmt.Errorf("invalid filter %s: %v", value, err)
+	}
+
+	var conditions []documentCondition
+	for _, element := range elements {
+		if strings.HasPrefix(element.Key(), "$") {
+			return nil, fmt.Errorf("unsupported filter operator %s", element.Key())
+		}
+		path := strings.Split(element.Key(), ".")
+		operand := element.Value()
+		if !hasOperators(operand) {
+			conditions = append(conditions, &fieldPredicate{path: path, operator: "=", value: operand})
+			continue
+		}
+
+		operators, err := operand.Document().Elements()
+		if err != nil {
+			return nil, fmt.Errorf("invalid filter of %s: %v", element.Key(), err)
+		}
+		for _, op := range operators {
+			condition, err := parseFilterOperator(path, op.Key(), op.Value())
+			if err != nil {
+				return nil, fmt.Errorf("invalid filter of %s: %v", element.Key(), err)
+			}
+			conditions = append(conditions, condition)
+		}
+	}
+	return conditions, nil
+}
+
+// hasOperators reports whether a filter value is a document of operators,
+// rather than a document to compare with.
+func hasOperators(value bson.RawValue) bool {
+	if value.Type != bsontype.EmbeddedDocument {
+		return false
+	}
+	elements, err := value.Document().Elements()
+	return err == nil && len(elements) > 0 && strings.HasPrefix(elements[0].Key(), "$")
+}
+
+func parseFilterOperator(path []string, operator string, value bson.RawValue) (documentCondition, error) {
+	if op, ok := filterOperators[operator]; ok {
+		return &fieldPredicate{path: path, operator: op, value: value}, nil
+	}
+
+	switch operator {
+	case "$in", "$nin":
+		if value.Type != bsontype.Array {
+			return nil, fmt.Errorf("%s needs an array", operator)
+		}
+		values, err := value.Array().Values()
+		if err != nil {
+			return nil, err
+		}
+		return &inCondition{path: path, values: values, negate: operator == "$nin"}, nil
+	case "$exists":
+		if value.Type != bsontype.Boolean {
+			return nil, fmt.Errorf("$exists needs true or false")
+		}
+		return &existsCondition{path: path, exists: value.Boolean()}, nil
+	}
+	return nil, fmt.Errorf("unsupported operator %s", operator)
+}
+
+// inCondition matches documents whose field equals any of values, or with
+// negate, none of them.
+type inCondition struct {
+	path   []string
+	values []bson.RawValue
+	negate bool
+}
+
+func (c *inCondition) matches(doc bson.Raw) bool {
+	for _, value := range c.values {
+		if (&fieldPredicate{path: c.path, operator: "=", value: value}).matches(doc) {
+			return !c.negate
+		}
+	}
+	return c.negate
+}
+
+// existsCondition matches documents which have the field, or with exists
+// false, don't.
+type existsCondition struct {
+	path   []string
+	exists bool
+}
+
+func (c *existsCondition) matches(doc bson.Raw) bool {
+	_, err := doc.LookupErr(c.path...)
+	return (err == nil) == c.exists
+}
+
+// selectionRestoreMode returns the mode selected documents are restored in.
+// They are upserted, unless only missing documents are asked for, and the
+// other documents of the collection are always kept.
+func selectionRestoreMode(mode restoreMode) (restoreMode, error) {
+	switch mode {
+	case restoreReplace, restoreUpsert:
+		return restoreUpsert, nil
+	case restoreInsertMissing:
+		return mode, nil
+	default:
+		return "", fmt.Errorf("selected documents can't be restored in %s mode, use upsert or insert-missing", mode)
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func TestDocumentSelection_IDs(t *testing.T) {
+	oid := primitive.NewObjectID()
+	selection := &documentSelection{}
+	err := selection.readIDs(strings.NewReader("# deleted articles\n" + oid.Hex() + "\n\n42\n{\"$oid\": \"" + primitive.NewObjectID().Hex() + "\"}\nslug-1\n"))
+	assert.NoError(t, err)
+	assert.Equal(t, 4, selection.idCount)
+
+	for _, tc := range []struct {
+		id       interface{}
+		expected bool
+	}{
+		{oid, true},
+		{oid.Hex(), true},
+		{int32(42), true},
+		{int64(42), true},
+		{42.5, false},
+		{"slug-1", true},
+		{"slug-2", false},
+		{primitive.NewObjectID(), false},
+	} {
+		doc, err := bson.Marshal(bson.D{{Key: "_id", Value: tc.id}})
+		assert.NoError(t, err)
+		assert.Equal(t, tc.expected, selection.matches(doc), "%v", tc.id)
+	}
+
+	err = (&documentSelection{}).readIDs(strings.NewReader("# nothing\n"))
+	assert.EqualError(t, err, "no ids in ids file")
+}
+
+func TestParseDocumentFilter(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{
+		{Key: "type", Value: "article"},
+		{Key: "count", Value: int32(5)},
+		{Key: "tags", Value: bson.A{"news", "sport"}},
+		{Key: "brand", Value: bson.D{{Key: "name", Value: "FT"}}},
+	})
+	assert.NoError(t, err)
+
+	for _, tc := range []struct {
+		filter   string
+		expected bool
+	}{
+		{`{}`, true},
+		{`{"type": "article"}`, true},
+		{`{"type": "video"}`, false},
+		{`{"type": "article", "count": {"$gte": 5, "$lt": 10}}`, true},
+		{`{"count": {"$gt": 5}}`, false},
+		{`{"tags": "sport"}`, true},
+		{`{"tags": ["news", "sport"]}`, true},
+		{`{"tags": {"$in": ["opinion", "news"]}}`, true},
+		{`{"tags": {"$nin": ["opinion", "news"]}}`, false},
+		{`{"tags": {"$ne": "opinion"}}`, true},
+		{`{"brand.name": "FT"}`, true},
+		{`{"brand": {"name": "FT"}}`, true},
+		{`{"deleted": {"$exists": false}}`, true},
+		{`{"deleted": {"$exists": true}}`, false},
+	} {
+		conditions, err := parseDocumentFilter(tc.filter)
+		assert.NoError(t, err, tc.filter)
+		selection := &documentSelection{filter: conditions}
+		assert.Equal(t, tc.expected, selection.matches(doc), tc.filter)
+	}
+}
+
+func TestParseDocumentFilter_Errors(t *testing.T) {
+	_, err := parseDocumentFilter(`{"type": `)
+	assert.Error(t, err)
+	_, err = parseDocumentFilter(`{"$or": [{"type": "article"}]}`)
+	assert.EqualError(t, err, "unsupported filter operator $or")
+	_, err = parseDocumentFilter(`{"type": {"$regex": "^a"}}`)
+	assert.EqualError(t, err, "invalid filter of type: unsupported operator $regex")
+	_, err = parseDocumentFilter(`{"type": {"$in": "article"}}`)
+	assert.EqualError(t, err, "invalid filter of type: $in needs an array")
+}
+
+func TestNewDocumentSelection(t *testing.T) {
+	selection, err := newDocumentSelection("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, selection)
+
+	path := filepath.Join(t.TempDir(), "ids.txt")
+	assert.NoError(t, os.WriteFile(path, []byte("1\n2\n"), 0600))
+	selection, err = newDocumentSelection(path, `{"type": "article"}`)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, selection.idCount)
+	assert.Len(t, selection.filter, 1)
+
+	_, err = newDocumentSelection(filepath.Join(t.TempDir(), "missing.txt"), "")
+	assert.Error(t, err)
+}
+
+func TestSelectionRestoreMode(t *testing.T) {
+	mode, err := selectionRestoreMode(restoreReplace)
+	assert.NoError(t, err)
+	assert.Equal(t, restoreUpsert, mode)
+	mode, err = selectionRestoreMode(restoreInsertMissing)
+	assert.NoError(t, err)
+	assert.Equal(t, restoreInsertMissing, mode)
+	_, err = selectionRestoreMode(restoreSwap)
+	assert.EqualError(t, err, "selected documents can't be restored in swap mode, use upsert or insert-missing")
+}
+
+func TestRestore_FSSelectedDocuments(t *testing.T) {
+	doc := func(id int32, kind string) []byte {
+		data, err := bson.Marshal(bson.D{{Key: "_id", Value: id}, {Key: "type", Value: kind}})
+		assert.NoError(t, err)
+		return data
+	}
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, doc(1, "article"), doc(2, "video"), doc(3, "article"), doc(4, "article"))
+
+	conditions, err := parseDocumentFilter(`{"type": "article"}`)
+	assert.NoError(t, err)
+	selection := &documentSelection{filter: conditions}
+	assert.NoError(t, selection.readIDs(strings.NewReader("1\n2\n3\n5\n")))
+
+	// Only the selected documents are upserted, the collection isn't
+	// recreated, cleared or reindexed.
+	mockedMongoService := new(mockMongoService)
+	restored := new(bytes.Buffer)
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, restoreUpsert).
+		Run(func(args mock.Arguments) {
+			_, _ = io.Copy(restored, args.Get(3).(io.Reader))
+		}).
+		Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, nil, backupOptions{})
+	err = backupService.Restore(context.Background(), date, []dbColl{{"database1", "collection1"}}, restoreOptions{mode: restoreUpsert, documents: selection})
+	assert.NoError(t, err)
+
+	assert.Equal(t, append(doc(1, "article"), doc(3, "article")...), restored.Bytes())
+	mockedMongoService.AssertExpectations(t)
+}
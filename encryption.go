@@ -0,0 +1,427 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+const (
+	// encryptionMagic starts every encrypted object. It can't be mistaken for
+	// the start of a snappy stream or of a BSON document.
+	encryptionMagic  = "MHBENC01"
+	aesGCMEncryption = "aes-256-gcm"
+	// encryptionChunkSize is the amount of plain text sealed in one chunk.
+	encryptionChunkSize = 64 * 1024
+	// finalChunk is set in the length prefix of the last chunk of a stream.
+	finalChunk      = 1 << 31
+	noncePrefixSize = 7
+	dataKeySize     = 32
+)
+
+// keyProvider wraps the data keys which backups are encrypted with, so only
+// wrapped keys are ever stored next to the data.
+type keyProvider interface {
+	WrapKey(key []byte) (keyID string, wrapped []byte, err error)
+	UnwrapKey(keyID string, wrapped []byte) ([]byte, error)
+}
+
+func newKeyProvider(kind, keyfile string) (keyProvider, error) {
+	switch kind {
+	case "":
+		return nil, nil
+	case "keyfile":
+		return newKeyfileProvider(keyfile)
+	default:
+		return nil, fmt.Errorf("unknown encryption key provider: %s", kind)
+	}
+}
+
+// keyfileProvider wraps data keys with AES-256-GCM, using a key encryption
+// key read from a local file.
+type keyfileProvider struct {
+	aead cipher.AEAD
+	id   string
+}
+
+// newKeyfileProvider reads a 32 byte key, either raw or base64 encoded, from
+// the file at path.
+func newKeyfileProvider(path string) (*keyfileProvider, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read keyfile: %v", err)
+	}
+
+	key := data
+	if len(key) != dataKeySize {
+		key, err = base64.StdEncoding.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil || len(key) != dataKeySize {
+			return nil, fmt.Errorf("keyfile %s doesn't hold a %d byte key", path, dataKeySize)
+		}
+	}
+
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	fingerprint := sha256.Sum256(key)
+	return &keyfileProvider{
+		aead: aead,
+		id:   "keyfile:" + hex.EncodeToString(fingerprint[:8]),
+	}, nil
+}
+
+func (p *keyfileProvider) WrapKey(key []byte) (string, []byte, error) {
+	nonce := make([]byte, p.aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", nil, err
+	}
+	return p.id, p.aead.Seal(nonce, nonce, key, []byte(p.id)), nil
+}
+
+func (p *keyfileProvider) UnwrapKey(keyID string, wrapped []byte) ([]byte, error) {
+	if keyID != p.id {
+		return nil, fmt.Errorf("data key was wrapped with %s, but the keyfile is %s", keyID, p.id)
+	}
+	if len(wrapped) < p.aead.NonceSize() {
+		return nil, errors.New("wrapped data key is too short")
+	}
+	key, err := p.aead.Open(nil, wrapped[:p.aead.NonceSize()], wrapped[p.aead.NonceSize():], []byte(keyID))
+	if err != nil {
+		return nil, fmt.Errorf("couldn't unwrap data key: %v", err)
+	}
+	return key, nil
+}
+
+// dataKey is the key a backup run is encrypted with, along with its wrapped
+// form which is stored in the header of every object.
+type dataKey struct {
+	aead    cipher.AEAD
+	keyID   string
+	wrapped []byte
+}
+
+func newDataKey(provider keyProvider) (*dataKey, error) {
+	key := make([]byte, dataKeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	aead, err := newAESGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	keyID, wrapped, err := provider.WrapKey(key)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't wrap data key: %v", err)
+	}
+	return &dataKey{aead: aead, keyID: keyID, wrapped: wrapped}, nil
+}
+
+// encryption holds what a pipe needs to encrypt or decrypt its stream. A nil
+// *encryption writes plain streams, and can't read encrypted ones.
+type encryption struct {
+	provider keyProvider
+	// dataKey is only needed for encrypting.
+	dataKey *dataKey
+	// required makes decrypting fail on streams which aren't encrypted, for
+	// objects the manifest records as encrypted.
+	required bool
+}
+
+// newEncryption generates the data key for a backup run. It returns nil if
+// no key provider is configured.
+func newEncryption(provider keyProvider) (*encryption, error) {
+	if provider == nil {
+		return nil, nil
+	}
+	key, err := newDataKey(provider)
+	if err != nil {
+		return nil, err
+	}
+	return &encryption{provider: provider, dataKey: key}, nil
+}
+
+func (e *encryption) keyProvider() keyProvider {
+	if e == nil {
+		return nil
+	}
+	return e.provider
+}
+
+func (e *encryption) isRequired() bool {
+	return e != nil && e.required
+}
+
+// encryptWriteCloser seals the stream in chunks with AES-256-GCM. The nonce
+// of each chunk holds its position and whether it is the last one, so chunks
+// can neither be reordered nor dropped from the end without detection.
+type encryptWriteCloser struct {
+	writeCloser io.WriteCloser
+	key         *dataKey
+	header      []byte
+	noncePrefix []byte
+	counter     uint32
+	buf         []byte
+}
+
+func newEncryptWriteCloser(writeCloser io.WriteCloser, key *dataKey) *encryptWriteCloser {
+	return &encryptWriteCloser{
+		writeCloser: writeCloser,
+		key:         key,
+		buf:         make([]byte, 0, encryptionChunkSize),
+	}
+}
+
+func (e *encryptWriteCloser) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		// A full chunk is only sealed once more data arrives, so the last
+		// chunk is always sealed by Close.
+		if len(e.buf) == encryptionChunkSize {
+			if err := e.seal(false); err != nil {
+				return written, err
+			}
+		}
+		n := copy(e.buf[len(e.buf):encryptionChunkSize], p)
+		e.buf = e.buf[:len(e.buf)+n]
+		p = p[n:]
+		written += n
+	}
+	return written, nil
+}
+
+func (e *encryptWriteCloser) Close() error {
+	if err := e.seal(true); err != nil {
+		_ = e.writeCloser.Close()
+		return err
+	}
+	return e.writeCloser.Close()
+}
+
+func (e *encryptWriteCloser) seal(final bool) error {
+	if e.header == nil {
+		if err := e.writeHeader(); err != nil {
+			return err
+		}
+	}
+
+	sealed := e.key.aead.Seal(nil, chunkNonce(e.noncePrefix, e.counter, final), e.buf, e.header)
+	length := uint32(len(sealed))
+	if final {
+		length |= finalChunk
+	}
+
+	var prefix [4]byte
+	binary.BigEndian.PutUint32(prefix[:], length)
+	if _, err := e.writeCloser.Write(prefix[:]); err != nil {
+		return err
+	}
+	if _, err := e.writeCloser.Write(sealed); err != nil {
+		return err
+	}
+
+	e.counter++
+	e.buf = e.buf[:0]
+	return nil
+}
+
+// writeHeader starts the stream with the wrapped data key, and the random
+// nonce prefix of this stream.
+func (e *encryptWriteCloser) writeHeader() error {
+	e.noncePrefix = make([]byte, noncePrefixSize)
+	if _, err := rand.Read(e.noncePrefix); err != nil {
+		return err
+	}
+
+	header := new(bytes.Buffer)
+	header.WriteString(encryptionMagic)
+	writeBytes16(header, []byte(e.key.keyID))
+	writeBytes16(header, e.key.wrapped)
+	header.Write(e.noncePrefix)
+
+	if _, err := e.writeCloser.Write(header.Bytes()); err != nil {
+		return err
+	}
+	e.header = header.Bytes()
+	return nil
+}
+
+// decryptReadCloser decrypts streams written by encryptWriteCloser. Streams
+// which don't start with the encryption header are passed through as they
+// are, so unencrypted backups can still be read, unless encryption is
+// required.
+type decryptReadCloser struct {
+	readCloser  io.ReadCloser
+	reader      *bufio.Reader
+	provider    keyProvider
+	required    bool
+	initialized bool
+	err         error
+	plain       bool
+	aead        cipher.AEAD
+	header      []byte
+	noncePrefix []byte
+	counter     uint32
+	chunk       []byte
+	done        bool
+}
+
+func newDecryptReadCloser(readCloser io.ReadCloser, provider keyProvider, required bool) *decryptReadCloser {
+	return &decryptReadCloser{
+		readCloser: readCloser,
+		reader:     bufio.NewReader(readCloser),
+		provider:   provider,
+		required:   required,
+	}
+}
+
+func (d *decryptReadCloser) Read(p []byte) (int, error) {
+	if d.err != nil {
+		return 0, d.err
+	}
+	if !d.initialized {
+		if d.err = d.init(); d.err != nil {
+			return 0, d.err
+		}
+		d.initialized = true
+	}
+	if d.plain {
+		return d.reader.Read(p)
+	}
+
+	for len(d.chunk) == 0 {
+		if d.done {
+			return 0, io.EOF
+		}
+		if d.err = d.open(); d.err != nil {
+			return 0, d.err
+		}
+	}
+
+	n := copy(p, d.chunk)
+	d.chunk = d.chunk[n:]
+	return n, nil
+}
+
+func (d *decryptReadCloser) Close() error {
+	return d.readCloser.Close()
+}
+
+func (d *decryptReadCloser) init() error {
+	magic, err := d.reader.Peek(len(encryptionMagic))
+	if err != nil || string(magic) != encryptionMagic {
+		if d.required {
+			return errors.New("stream isn't encrypted, but the backup records it as encrypted")
+		}
+		// Too short or not encrypted, let the next stage deal with it.
+		d.plain = true
+		return nil
+	}
+	if d.provider == nil {
+		return errors.New("stream is encrypted, but no encryption key provider is configured")
+	}
+
+	header := new(bytes.Buffer)
+	tee := io.TeeReader(d.reader, header)
+	if _, err = io.ReadFull(tee, make([]byte, len(encryptionMagic))); err != nil {
+		return err
+	}
+	keyID, err := readBytes16(tee)
+	if err != nil {
+		return fmt.Errorf("invalid encryption header: %v", err)
+	}
+	wrapped, err := readBytes16(tee)
+	if err != nil {
+		return fmt.Errorf("invalid encryption header: %v", err)
+	}
+	d.noncePrefix = make([]byte, noncePrefixSize)
+	if _, err = io.ReadFull(tee, d.noncePrefix); err != nil {
+		return fmt.Errorf("invalid encryption header: %v", err)
+	}
+
+	key, err := d.provider.UnwrapKey(string(keyID), wrapped)
+	if err != nil {
+		return err
+	}
+	if d.aead, err = newAESGCM(key); err != nil {
+		return err
+	}
+	d.header = header.Bytes()
+	return nil
+}
+
+func (d *decryptReadCloser) open() error {
+	var prefix [4]byte
+	if _, err := io.ReadFull(d.reader, prefix[:]); err != nil {
+		if err == io.EOF {
+			return errors.New("encrypted stream is truncated")
+		}
+		return err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	final := length&finalChunk != 0
+	length &^= finalChunk
+	if length > encryptionChunkSize+uint32(d.aead.Overhead()) {
+		return fmt.Errorf("encrypted chunk %d is too large", d.counter)
+	}
+
+	sealed := make([]byte, length)
+	if _, err := io.ReadFull(d.reader, sealed); err != nil {
+		return fmt.Errorf("encrypted stream is truncated: %v", err)
+	}
+	chunk, err := d.aead.Open(sealed[:0], chunkNonce(d.noncePrefix, d.counter, final), sealed, d.header)
+	if err != nil {
+		return fmt.Errorf("couldn't decrypt chunk %d: %v", d.counter, err)
+	}
+
+	d.chunk = chunk
+	d.counter++
+	d.done = final
+	return nil
+}
+
+func chunkNonce(prefix []byte, counter uint32, final bool) []byte {
+	nonce := make([]byte, noncePrefixSize+5)
+	copy(nonce, prefix)
+	binary.BigEndian.PutUint32(nonce[noncePrefixSize:], counter)
+	if final {
+		nonce[noncePrefixSize+4] = 1
+	}
+	return nonce
+}
+
+func newAESGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func writeBytes16(buf *bytes.Buffer, p []byte) {
+	var length [2]byte
+	binary.BigEndian.PutUint16(length[:], uint16(len(p)))
+	buf.Write(length[:])
+	buf.Write(p)
+}
+
+func readBytes16(reader io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(reader, length[:]); err != nil {
+		return nil, err
+	}
+	p := make([]byte, binary.BigEndian.Uint16(length[:]))
+	_, err := io.ReadFull(reader, p)
+	return p, err
+}
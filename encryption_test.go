@@ -0,0 +1,127 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/base64"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func writeTestKeyfile(t *testing.T) string {
+	key := make([]byte, dataKeySize)
+	_, err := rand.Read(key)
+	assert.NoError(t, err)
+	path := filepath.Join(t.TempDir(), "master.key")
+	assert.NoError(t, os.WriteFile(path, []byte(base64.StdEncoding.EncodeToString(key)+"\n"), 0600))
+	return path
+}
+
+func newTestKeyProvider(t *testing.T) keyProvider {
+	provider, err := newKeyProvider("keyfile", writeTestKeyfile(t))
+	assert.NoError(t, err)
+	return provider
+}
+
+func encrypt(t *testing.T, provider keyProvider, data []byte) []byte {
+	enc, err := newEncryption(provider)
+	assert.NoError(t, err)
+	buf := new(bytes.Buffer)
+	writer := newEncryptWriteCloser(nopWriteCloser{buf}, enc.dataKey)
+	_, err = writer.Write(data)
+	assert.NoError(t, err)
+	assert.NoError(t, writer.Close())
+	return buf.Bytes()
+}
+
+func decrypt(provider keyProvider, data []byte) ([]byte, error) {
+	return io.ReadAll(newDecryptReadCloser(io.NopCloser(bytes.NewReader(data)), provider, false))
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+func TestEncryption_RoundTrip(t *testing.T) {
+	provider := newTestKeyProvider(t)
+
+	for _, size := range []int{0, 1, 16, 1000, encryptionChunkSize, 3*encryptionChunkSize + 17} {
+		data := make([]byte, size)
+		_, _ = rand.Read(data)
+
+		encrypted := encrypt(t, provider, data)
+		assert.True(t, bytes.HasPrefix(encrypted, []byte(encryptionMagic)))
+		// A random slice of 16 bytes won't turn up in the cipher text by
+		// chance, shorter ones might.
+		if size >= 16 {
+			assert.False(t, bytes.Contains(encrypted, data[:16]), "Plain text shouldn't be stored.")
+		}
+
+		decrypted, err := decrypt(provider, encrypted)
+		assert.NoError(t, err)
+		assert.Equal(t, data, decrypted, "size %d", size)
+	}
+}
+
+func TestEncryption_PlainStreamPassesThrough(t *testing.T) {
+	data := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+
+	decrypted, err := decrypt(nil, data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	decrypted, err = decrypt(newTestKeyProvider(t), data)
+	assert.NoError(t, err)
+	assert.Equal(t, data, decrypted)
+
+	_, err = io.ReadAll(newDecryptReadCloser(io.NopCloser(bytes.NewReader(data)), newTestKeyProvider(t), true))
+	assert.EqualError(t, err, "stream isn't encrypted, but the backup records it as encrypted")
+}
+
+func TestEncryption_DetectsTampering(t *testing.T) {
+	provider := newTestKeyProvider(t)
+	data := make([]byte, 2*encryptionChunkSize+5)
+	encrypted := encrypt(t, provider, data)
+
+	modified := append([]byte(nil), encrypted...)
+	modified[len(modified)-1] ^= 1
+	_, err := decrypt(provider, modified)
+	assert.Error(t, err, "Modified chunk should fail to decrypt.")
+
+	// Cut after the first chunk, which leaves a valid but non-final chunk.
+	headerSize := len(encrypted) - 3*(4+16) - len(data)
+	_, err = decrypt(provider, encrypted[:headerSize+4+encryptionChunkSize+16])
+	assert.EqualError(t, err, "encrypted stream is truncated")
+}
+
+func TestEncryption_WrongKey(t *testing.T) {
+	encrypted := encrypt(t, newTestKeyProvider(t), []byte("data"))
+
+	_, err := decrypt(newTestKeyProvider(t), encrypted)
+	assert.Error(t, err, "Data key shouldn't unwrap with another keyfile.")
+
+	_, err = decrypt(nil, encrypted)
+	assert.EqualError(t, err, "stream is encrypted, but no encryption key provider is configured")
+}
+
+func TestNewKeyProvider(t *testing.T) {
+	provider, err := newKeyProvider("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, provider)
+
+	_, err = newKeyProvider("kms", "")
+	assert.EqualError(t, err, "unknown encryption key provider: kms")
+
+	short := filepath.Join(t.TempDir(), "short.key")
+	assert.NoError(t, os.WriteFile(short, []byte("too short"), 0600))
+	_, err = newKeyProvider("keyfile", short)
+	assert.Error(t, err)
+}
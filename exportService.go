@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"golang.org/x/sync/errgroup"
+)
+
+// exportOptions decide how the documents of a collection are exported.
+type exportOptions struct {
+	// canonical writes canonical extended JSON, which keeps every BSON type,
+	// instead of relaxed extended JSON.
+	canonical bool
+	// where, if set, only exports the documents it matches.
+	where *fieldPredicate
+}
+
+// exportService writes the documents of a stored backup as newline delimited
+// extended JSON, or as a mongodump archive, without restoring it into MongoDB.
+type exportService struct {
+	storageService storageService
+	bsonService    bsonService
+	keyProvider    keyProvider
+}
+
+func newExportService(storageService storageService, bsonService bsonService, keyProvider keyProvider) *exportService {
+	return &exportService{
+		storageService: storageService,
+		bsonService:    bsonService,
+		keyProvider:    keyProvider,
+	}
+}
+
+// Export writes the documents of coll in the backup taken at date to w, one
+// per line, and returns how many it wrote. The parts of a partitioned
+// collection are exported one after the other.
+func (e *exportService) Export(ctx context.Context, date string, coll dbColl, options exportOptions, w io.Writer) (int64, error) {
+	paths, c, err := findCollectionFiles(ctx, e.storageService, date, coll.database, coll.collection)
+	if err != nil {
+		return 0, err
+	}
+	enc, err := collectionEncryption(ctx, e.storageService, e.keyProvider, date, coll)
+	if err != nil {
+		return 0, err
+	}
+
+	out := bufio.NewWriter(w)
+	var exported int64
+	for _, path := range paths {
+		err := e.readObject(ctx, path, c, enc, func(doc []byte) error {
+			if options.where != nil && !options.where.matches(doc) {
+				return nil
+			}
+
+			line, err := bson.MarshalExtJSON(bson.Raw(doc), options.canonical, false)
+			if err != nil {
+				return fmt.Errorf("couldn't convert document to extended JSON: %v", err)
+			}
+			if _, err = out.Write(append(line, '\n')); err != nil {
+				return err
+			}
+			exported++
+			return nil
+		})
+		if err != nil {
+			return exported, fmt.Errorf("exporting %s failed: %v", path, err)
+		}
+	}
+	return exported, out.Flush()
+}
+
+// Archive writes the given collections of the backup taken at date to w as a
+// mongodump --archive stream, which mongorestore --archive can restore.
+func (e *exportService) Archive(ctx context.Context, date string, colls []dbColl, w io.Writer) error {
+	out := bufio.NewWriter(w)
+
+	prelude := make([]archiveCollection, 0, len(colls))
+	for _, coll := range colls {
+		entry, err := e.archiveCollection(ctx, date, coll)
+		if err != nil {
+			return err
+		}
+		prelude = append(prelude, entry)
+	}
+
+	archive, err := newArchiveWriter(out, archiveHeader{ToolVersion: "mongo-hot-backup " + toolVersion()}, prelude)
+	if err != nil {
+		return err
+	}
+	for _, coll := range colls {
+		paths, c, err := findCollectionFiles(ctx, e.storageService, date, coll.database, coll.collection)
+		if err != nil {
+			return err
+		}
+		enc, err := collectionEncryption(ctx, e.storageService, e.keyProvider, date, coll)
+		if err != nil {
+			return err
+		}
+		if err = archive.beginCollection(coll.database, coll.collection); err != nil {
+			return err
+		}
+		for _, path := range paths {
+			if err = e.readObject(ctx, path, c, enc, archive.writeDocument); err != nil {
+				return fmt.Errorf("archiving %s failed: %v", path, err)
+			}
+		}
+		if err = archive.endCollection(); err != nil {
+			return err
+		}
+	}
+	return out.Flush()
+}
+
+// archiveCollection returns the prelude entry of a collection, with the
+// metadata mongorestore recreates it with. Collections backed up without
+// metadata are recreated without options or indexes.
+func (e *exportService) archiveCollection(ctx context.Context, date string, coll dbColl) (archiveCollection, error) {
+	metadata, err := downloadMetadata(ctx, e.storageService, date, coll)
+	if err != nil {
+		return archiveCollection{}, err
+	}
+	if metadata == nil {
+		metadata = &collectionMetadata{Indexes: []bson.Raw{}, Type: "collection"}
+	}
+	metadata.CollectionName = coll.collection
+	metadata.Filter, metadata.Projection, metadata.Masking = nil, nil, ""
+
+	data, err := marshalMetadata(*metadata)
+	if err != nil {
+		return archiveCollection{}, fmt.Errorf("couldn't marshal collection metadata: %v", err)
+	}
+	return archiveCollection{
+		Database:   coll.database,
+		Collection: coll.collection,
+		Metadata:   string(data),
+		Type:       metadata.Type,
+	}, nil
+}
+
+// readObject passes each document of a stored object to document.
+func (e *exportService) readObject(ctx context.Context, path string, c codec, enc *encryption, document func(doc []byte) error) error {
+	reader, writer := newPipe(downloadOperation, compression{codec: c}, enc)
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		defer func() {
+			_ = writer.Close()
+		}()
+
+		return e.storageService.Download(ctx, path, writer)
+	})
+	g.Go(func() error {
+		defer func() {
+			_ = reader.Close()
+		}()
+
+		for {
+			next, err := e.bsonService.ReadNextBSON(reader)
+			if err != nil {
+				return err
+			}
+			if next == nil {
+				return nil
+			}
+			if err = document(next); err != nil {
+				return err
+			}
+		}
+	})
+
+	return g.Wait()
+}
+
+// predicateOperators are the comparisons of a field predicate, longest first
+// so <= isn't taken for <.
+var predicateOperators = []string{"!=", "<=", ">=", "=", "<", ">"}
+
+// fieldPredicate compares the value of a field with a given value.
+type fieldPredicate struct {
+	path     []string
+	operator string
+	value    bson.RawValue
+}
+
+// parseFieldPredicate parses <field><operator><value>, where the field is a
+// dotted path, the operator one of =, !=, <, <=, > and >=, and the value a
+// relaxed extended JSON value (e.g. 42, true or {"$date": "2022-06-01T00:00:00Z"}).
+// Values which don't parse as JSON are taken as strings.
+func parseFieldPredicate(value string) (*fieldPredicate, error) {
+	index, operator := -1, ""
+	for _, op := range predicateOperators {
+		if i := strings.Index(value, op); i > 0 && (index == -1 || i < index) {
+			index, operator = i, op
+		}
+	}
+	if index == -1 {
+		return nil, fmt.Errorf("invalid predicate %s, expected <field><operator><value>", value)
+	}
+
+	path := strings.TrimSpace(value[:index])
+	operand, err := parseLooseValue(strings.TrimSpace(value[index+len(operator):]))
+	if err != nil {
+		return nil, err
+	}
+	return &fieldPredicate{path: strings.Split(path, "."), operator: operator, value: operand}, nil
+}
+
+// parseLooseValue parses a relaxed extended JSON value, taking values which
+// don't parse as JSON as strings.
+func parseLooseValue(value string) (bson.RawValue, error) {
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(`{"v": `+value+`}`), false, &doc); err != nil {
+		if doc, err = bson.Marshal(bson.D{{Key: "v", Value: value}}); err != nil {
+			return bson.RawValue{}, err
+		}
+	}
+	return doc.Lookup("v"), nil
+}
+
+// matches reports whether the document has the field and its value compares
+// as the predicate asks. Like a MongoDB query, an array field matches if any
+// of its values or the whole array does, and != matches if none of them is
+// equal.
+func (p *fieldPredicate) matches(doc bson.Raw) bool {
+	if p.operator == "!=" {
+		return !p.matchesAny(doc, "=")
+	}
+	return p.matchesAny(doc, p.operator)
+}
+
+func (p *fieldPredicate) matchesAny(doc bson.Raw, operator string) bool {
+	value, err := doc.LookupErr(p.path...)
+	if err != nil {
+		return false
+	}
+	if p.compare(value, operator) {
+		return true
+	}
+	if value.Type != bsontype.Array {
+		return false
+	}
+	values, err := value.Array().Values()
+	if err != nil {
+		return false
+	}
+	for _, v := range values {
+		if p.compare(v, operator) {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *fieldPredicate) compare(value bson.RawValue, operator string) bool {
+	cmp, ok := compareValues(value, p.value)
+	switch operator {
+	case "=":
+		return ok && cmp == 0
+	case "<":
+		return ok && cmp < 0
+	case "<=":
+		return ok && cmp <= 0
+	case ">":
+		return ok && cmp > 0
+	case ">=":
+		return ok && cmp >= 0
+	}
+	return false
+}
+
+// compareValues orders numbers, strings and dates, and compares ObjectIds
+// with their hex string. Values of other types are only equal to identical
+// values, and ok is false if the values can't be compared.
+func compareValues(a, b bson.RawValue) (cmp int, ok bool) {
+	if x, ok := numberValue(a); ok {
+		y, ok := numberValue(b)
+		if !ok {
+			return 0, false
+		}
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	}
+
+	switch {
+	case a.Type == bsontype.String && b.Type == bsontype.String:
+		return strings.Compare(a.StringValue(), b.StringValue()), true
+	case a.Type == bsontype.DateTime && b.Type == bsontype.DateTime:
+		x, y := a.DateTime(), b.DateTime()
+		switch {
+		case x < y:
+			return -1, true
+		case x > y:
+			return 1, true
+		}
+		return 0, true
+	case a.Type == bsontype.ObjectID && b.Type == bsontype.String:
+		return strings.Compare(a.ObjectID().Hex(), strings.ToLower(b.StringValue())), true
+	case a.Type == b.Type && bytes.Equal(a.Value, b.Value):
+		return 0, true
+	}
+	return 0, false
+}
+
+func numberValue(value bson.RawValue) (float64, bool) {
+	switch value.Type {
+	case bsontype.Int32:
+		return float64(value.Int32()), true
+	case bsontype.Int64:
+		return float64(value.Int64()), true
+	case bsontype.Double:
+		return value.Double(), true
+	}
+	return 0, false
+}
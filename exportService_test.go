@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func exportTestDocs(t *testing.T) (primitive.ObjectID, [][]byte) {
+	id := primitive.NewObjectID()
+	docs := []bson.D{
+		{{Key: "_id", Value: id}, {Key: "title", Value: "first"}, {Key: "version", Value: int32(3)}, {Key: "tags", Value: bson.A{"a", "b"}}},
+		{{Key: "_id", Value: primitive.NewObjectID()}, {Key: "title", Value: "second"}, {Key: "version", Value: int64(1)}},
+	}
+	var raw [][]byte
+	for _, doc := range docs {
+		data, err := bson.Marshal(doc)
+		assert.NoError(t, err)
+		raw = append(raw, data)
+	}
+	return id, raw
+}
+
+func TestExport_Relaxed(t *testing.T) {
+	_, docs := exportTestDocs(t)
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, docs...)
+
+	out := new(bytes.Buffer)
+	exported, err := newExportService(storageService, &defaultBsonService{}, nil).
+		Export(context.Background(), date, dbColl{"database1", "collection1"}, exportOptions{}, out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(2), exported)
+	lines := bytes.Split(bytes.TrimSuffix(out.Bytes(), []byte("\n")), []byte("\n"))
+	assert.Len(t, lines, 2)
+	for i, line := range lines {
+		var doc bson.Raw
+		assert.NoError(t, bson.UnmarshalExtJSON(line, false, &doc))
+		assert.Equal(t, bson.Raw(docs[i]).Lookup("title"), doc.Lookup("title"))
+	}
+	assert.Contains(t, string(lines[0]), `"version":3`)
+}
+
+func TestExport_CanonicalWhere(t *testing.T) {
+	id, docs := exportTestDocs(t)
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, docs...)
+	where, err := parseFieldPredicate("_id=" + id.Hex())
+	assert.NoError(t, err)
+
+	out := new(bytes.Buffer)
+	exported, err := newExportService(storageService, &defaultBsonService{}, nil).
+		Export(context.Background(), date, dbColl{"database1", "collection1"}, exportOptions{canonical: true, where: where}, out)
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1), exported)
+	assert.Contains(t, out.String(), `{"_id":{"$oid":"`+id.Hex()+`"},"title":"first","version":{"$numberInt":"3"}`)
+}
+
+func TestExport_NoBackup(t *testing.T) {
+	storageService := newFSStorageService(t.TempDir())
+
+	_, err := newExportService(storageService, &defaultBsonService{}, nil).
+		Export(context.Background(), "2022-06-01T00-00-00", dbColl{"database1", "collection1"}, exportOptions{}, new(bytes.Buffer))
+
+	assert.EqualError(t, err, "no backup of database1/collection1 found for date 2022-06-01T00-00-00")
+}
+
+func TestFieldPredicate(t *testing.T) {
+	_, docs := exportTestDocs(t)
+	first, second := bson.Raw(docs[0]), bson.Raw(docs[1])
+
+	tests := []struct {
+		predicate string
+		first     bool
+		second    bool
+	}{
+		{`title=first`, true, false},
+		{`title="second"`, false, true},
+		{`title != first`, false, true},
+		{`version>=3`, true, false},
+		{`version<3`, false, true},
+		{`version<=3.5`, true, true},
+		{`version>"3"`, false, false},
+		{`tags=b`, true, false},
+		{`tags!=a`, false, true},
+		{`missing=1`, false, false},
+		{`missing!=1`, true, true},
+		{`title=first=last`, false, false},
+	}
+	for _, test := range tests {
+		predicate, err := parseFieldPredicate(test.predicate)
+		assert.NoError(t, err, test.predicate)
+		assert.Equal(t, test.first, predicate.matches(first), test.predicate)
+		assert.Equal(t, test.second, predicate.matches(second), test.predicate)
+	}
+
+	_, err := parseFieldPredicate("title")
+	assert.EqualError(t, err, "invalid predicate title, expected <field><operator><value>")
+	_, err = parseFieldPredicate("=first")
+	assert.Error(t, err)
+}
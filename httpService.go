@@ -13,7 +13,7 @@ import (
 )
 
 type httpService interface {
-	ScheduleAndServe(colls []dbColl, cronExpr string, runAtStart bool)
+	ScheduleAndServe(selection collectionSelection, cronExpr string, runAtStart bool)
 }
 
 type scheduleHTTPService struct {
@@ -25,8 +25,8 @@ func newScheduleHTTPService(scheduler scheduler, healthService *healthService) *
 	return &scheduleHTTPService{scheduler, healthService}
 }
 
-func (h *scheduleHTTPService) ScheduleAndServe(colls []dbColl, cronExpr string, runAtStart bool) {
-	go h.scheduler.ScheduleBackups(colls, cronExpr, runAtStart)
+func (h *scheduleHTTPService) ScheduleAndServe(selection collectionSelection, cronExpr string, runAtStart bool) {
+	go h.scheduler.ScheduleBackups(selection, cronExpr, runAtStart)
 
 	hc := health.TimedHealthCheck{
 		HealthCheck: health.HealthCheck{
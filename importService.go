@@ -0,0 +1,351 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/klauspost/compress/gzip"
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/sync/errgroup"
+)
+
+// ImportArchive stores the collections of a mongodump --archive stream as a
+// backup taken now, so restore loads them like any other backup. It returns
+// the date of the new backup.
+func (m *mongoBackupService) ImportArchive(ctx context.Context, reader io.Reader) (string, error) {
+	archive, err := newArchiveReader(reader)
+	if err != nil {
+		return "", err
+	}
+
+	date := formattedNow()
+	manifest := newBackupManifest(date)
+	enc, err := newEncryption(m.options.keyProvider)
+	if err != nil {
+		return "", fmt.Errorf("couldn't set up encryption: %v", err)
+	}
+
+	var colls []dbColl
+	metadata := map[dbColl]string{}
+	for _, entry := range archive.collections {
+		coll := dbColl{entry.Database, entry.Collection}
+		if skipImport(coll, entry.Type) {
+			log.Infof("Skipping %s, views and system collections can't be restored as collections", coll)
+			continue
+		}
+		colls = append(colls, coll)
+		metadata[coll] = entry.Metadata
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	g, gctx := errgroup.WithContext(ctx)
+
+	// Namespaces are interleaved in the archive, so all of them are stored at
+	// once, each fed its documents as they come.
+	entries := map[dbColl]*collectionManifest{}
+	streams := map[dbColl]chan []byte{}
+	start := func(coll dbColl) chan []byte {
+		docs := make(chan []byte)
+		streams[coll] = docs
+		entry := &collectionManifest{}
+		entries[coll] = entry
+		g.Go(func() error {
+			var err error
+			*entry, err = m.importCollection(gctx, date, coll, metadata[coll], enc, func(ctx context.Context, writer io.Writer) error {
+				for {
+					select {
+					case doc, ok := <-docs:
+						if !ok {
+							return nil
+						}
+						if _, err := writer.Write(doc); err != nil {
+							return err
+						}
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+				}
+			})
+			return err
+		})
+		return docs
+	}
+
+	fail := func(err error) (string, error) {
+		if gctx.Err() != nil {
+			// A collection failed first, which stopped reading the archive.
+			err = g.Wait()
+		}
+		cancel()
+		_ = g.Wait()
+		return "", err
+	}
+
+	closed := map[dbColl]bool{}
+	for {
+		header, err := archive.nextBlock()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fail(err)
+		}
+
+		coll := dbColl{header.Database, header.Collection}
+		if _, ok := metadata[coll]; !ok {
+			// Skipped namespaces, and the oplog of mongodump --oplog.
+			if header.EOF {
+				continue
+			}
+			if err = archive.readBlock(func([]byte) error { return nil }); err != nil {
+				return fail(err)
+			}
+			continue
+		}
+		if closed[coll] {
+			return fail(fmt.Errorf("%s continues after its end", coll))
+		}
+		docs, ok := streams[coll]
+		if !ok {
+			docs = start(coll)
+		}
+		if header.EOF {
+			close(docs)
+			closed[coll] = true
+			continue
+		}
+		err = archive.readBlock(func(doc []byte) error {
+			select {
+			case docs <- doc:
+				return nil
+			case <-gctx.Done():
+				return gctx.Err()
+			}
+		})
+		if err != nil {
+			return fail(err)
+		}
+	}
+
+	for _, coll := range colls {
+		if _, ok := streams[coll]; !ok {
+			close(start(coll))
+		} else if !closed[coll] {
+			return fail(fmt.Errorf("archive ended before all documents of %s", coll))
+		}
+	}
+	if err = g.Wait(); err != nil {
+		return "", err
+	}
+
+	for _, coll := range colls {
+		manifest.Collections = append(manifest.Collections, *entries[coll])
+	}
+	manifest.Complete = true
+	return date, m.saveManifest(ctx, manifest)
+}
+
+// ImportDirectory stores the collections of a mongodump output directory,
+// <dir>/<database>/<collection>.bson with its .metadata.json next to it, as a
+// backup taken now. Files of mongodump --gzip are decompressed. It returns
+// the date of the new backup.
+func (m *mongoBackupService) ImportDirectory(ctx context.Context, dir string) (string, error) {
+	colls, err := dumpedCollections(dir)
+	if err != nil {
+		return "", err
+	}
+
+	date := formattedNow()
+	manifest := newBackupManifest(date)
+	enc, err := newEncryption(m.options.keyProvider)
+	if err != nil {
+		return "", fmt.Errorf("couldn't set up encryption: %v", err)
+	}
+
+	for _, coll := range colls {
+		base := filepath.Join(dir, coll.database, coll.collection)
+		metadata, err := readDumpFile(base + metadataFileExtension)
+		if err != nil && !os.IsNotExist(err) {
+			return "", err
+		}
+
+		entry, err := m.importCollection(ctx, date, coll, string(metadata), enc, func(ctx context.Context, writer io.Writer) error {
+			file, err := openDumpFile(base + ".bson")
+			if err != nil {
+				return err
+			}
+			defer func() {
+				_ = file.Close()
+			}()
+
+			bsonService := &defaultBsonService{}
+			for {
+				doc, err := bsonService.ReadNextBSON(file)
+				if err != nil {
+					return err
+				}
+				if doc == nil {
+					return nil
+				}
+				if _, err = writer.Write(doc); err != nil {
+					return err
+				}
+			}
+		})
+		if err != nil {
+			return "", err
+		}
+		manifest.Collections = append(manifest.Collections, entry)
+	}
+
+	manifest.Complete = true
+	return date, m.saveManifest(ctx, manifest)
+}
+
+// importCollection stores the metadata and documents of a collection of a
+// mongodump, masking the documents like a backup would.
+func (m *mongoBackupService) importCollection(ctx context.Context, date string, coll dbColl, metadataJSON string, enc *encryption, save func(ctx context.Context, writer io.Writer) error) (collectionManifest, error) {
+	start := time.Now().UTC()
+	logEntry := log.
+		WithField("database", coll.database).
+		WithField("collection", coll.collection)
+
+	logEntry.Info("Importing collection...")
+
+	mask := m.options.masking.lookup(coll)
+	if metadataJSON != "" {
+		metadata, err := unmarshalMetadata([]byte(metadataJSON))
+		if err != nil {
+			return collectionManifest{}, fmt.Errorf("importing %s failed: %v", coll, err)
+		}
+		if mask != nil {
+			metadata.Masking = mask.String()
+		}
+		if err = uploadMetadata(ctx, m.storageService, date, coll, metadata); err != nil {
+			return collectionManifest{}, fmt.Errorf("importing %s failed: %v", coll, err)
+		}
+	}
+
+	object, err := m.saveObject(ctx, collectionFilePath(date, coll.database, coll.collection, m.options.compression.codec), enc,
+		func(ctx context.Context, writer io.Writer) error {
+			return save(ctx, newMaskingWriter(writer, mask))
+		})
+	if err != nil {
+		logEntry.WithError(err).Error("Importing collection failed")
+		return collectionManifest{}, fmt.Errorf("importing %s failed: %v", coll, err)
+	}
+
+	logEntry.Infof("Collection successfully imported. Duration: %v", time.Since(start))
+
+	entry := collectionManifest{
+		Database:    coll.database,
+		Collection:  coll.collection,
+		Documents:   object.Documents,
+		BSONBytes:   object.BSONBytes,
+		StoredBytes: object.StoredBytes,
+		SHA256:      object.SHA256,
+		StartTime:   start,
+		EndTime:     time.Now().UTC(),
+		ToolVersion: toolVersion(),
+		Codec:       m.options.compression.codec,
+		Masked:      mask != nil,
+	}
+	if enc != nil {
+		entry.Encryption = aesGCMEncryption
+	}
+	return entry, nil
+}
+
+// skipImport reports whether a namespace of a mongodump is left out of an
+// import: views and system collections can't be restored like collections.
+func skipImport(coll dbColl, namespaceType string) bool {
+	return namespaceType == "view" || isSystemCollection(coll.collection)
+}
+
+// dumpedCollections returns the collections of a mongodump output directory,
+// sorted by name.
+func dumpedCollections(dir string) ([]dbColl, error) {
+	databases, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't read dump directory: %v", err)
+	}
+
+	var colls []dbColl
+	for _, database := range databases {
+		if !database.IsDir() {
+			continue
+		}
+		files, err := os.ReadDir(filepath.Join(dir, database.Name()))
+		if err != nil {
+			return nil, fmt.Errorf("couldn't read dump directory: %v", err)
+		}
+		for _, file := range files {
+			name := strings.TrimSuffix(file.Name(), ".gz")
+			if file.IsDir() || !strings.HasSuffix(name, ".bson") {
+				continue
+			}
+			coll := dbColl{database.Name(), strings.TrimSuffix(name, ".bson")}
+			if isSystemCollection(coll.collection) {
+				continue
+			}
+			colls = append(colls, coll)
+		}
+	}
+	if len(colls) == 0 {
+		return nil, fmt.Errorf("no collections found in dump directory %s", dir)
+	}
+	sort.Slice(colls, func(i, j int) bool {
+		return colls[i].String() < colls[j].String()
+	})
+	return colls, nil
+}
+
+// openDumpFile opens a file of a mongodump output directory, or its .gz
+// version.
+func openDumpFile(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err == nil {
+		return file, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+	if file, err = os.Open(path + ".gz"); err != nil {
+		return nil, err
+	}
+	gz, err := gzip.NewReader(file)
+	if err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("couldn't read %s.gz: %v", path, err)
+	}
+	return &gzipFile{Reader: gz, file: file}, nil
+}
+
+func readDumpFile(path string) ([]byte, error) {
+	file, err := openDumpFile(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+	return io.ReadAll(file)
+}
+
+// gzipFile closes the file under a gzip reader along with the reader.
+type gzipFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (f *gzipFile) Close() error {
+	_ = f.Reader.Close()
+	return f.file.Close()
+}
@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/klauspost/compress/gzip"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const dumpMetadata = `{"options":{"capped":true,"size":{"$numberLong":"4096"}},"indexes":[{"v":2,"key":{"_id":1},"name":"_id_"},{"v":2,"key":{"uuid":1},"name":"uuid_1","unique":true}],"uuid":"7e3b9a3a1c2d4f5e8a9b0c1d2e3f4a5b","collectionName":"collection1","type":"collection"}`
+
+func readStoredDocs(t *testing.T, storageService storageService, date string, coll dbColl) [][]byte {
+	var docs [][]byte
+	err := newExportService(storageService, &defaultBsonService{}, nil).readObject(context.Background(),
+		collectionFilePath(date, coll.database, coll.collection, snappyCodec), snappyCodec, nil, func(doc []byte) error {
+			docs = append(docs, doc)
+			return nil
+		})
+	assert.NoError(t, err)
+	return docs
+}
+
+func TestArchiveAndImport_RoundTrip(t *testing.T) {
+	doc1 := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	doc2 := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00there\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, doc1, doc2)
+
+	archive := new(bytes.Buffer)
+	err := newExportService(storageService, &defaultBsonService{}, nil).Archive(context.Background(), date, []dbColl{{"database1", "collection1"}}, archive)
+	assert.NoError(t, err)
+
+	reader, docs := readTestArchive(t, bytes.NewReader(archive.Bytes()))
+	assert.Equal(t, [][]byte{doc1, doc2}, docs)
+	metadata, err := unmarshalMetadata([]byte(reader.collections[0].Metadata))
+	assert.NoError(t, err)
+	assert.Equal(t, "collection1", metadata.CollectionName)
+
+	imported := newFSStorageService(t.TempDir())
+	importDate, err := newMongoBackupService(nil, imported, nil, backupOptions{}).ImportArchive(context.Background(), archive)
+	assert.NoError(t, err)
+
+	manifest, err := newCatalogService(imported).Manifest(context.Background(), importDate)
+	assert.NoError(t, err)
+	assert.True(t, manifest.Complete)
+	assert.Len(t, manifest.Collections, 1)
+	assert.Equal(t, int64(2), manifest.Collections[0].Documents)
+	assert.Equal(t, [][]byte{doc1, doc2}, readStoredDocs(t, imported, importDate, dbColl{"database1", "collection1"}))
+
+	results, err := newVerifyService(imported, &defaultBsonService{}, nil).Verify(context.Background(), importDate)
+	assert.NoError(t, err)
+	assert.True(t, results[0].OK(), "%v", results[0].Problems)
+}
+
+// TestImportArchive_Interleaved imports an archive the way mongodump writes
+// it, with the documents of several namespaces in alternating blocks.
+func TestImportArchive_Interleaved(t *testing.T) {
+	doc := func(n int32) []byte {
+		data, err := bson.Marshal(bson.D{{Key: "n", Value: n}})
+		assert.NoError(t, err)
+		return data
+	}
+	buf := new(bytes.Buffer)
+	write := func(value interface{}) {
+		data, err := bson.Marshal(value)
+		assert.NoError(t, err)
+		buf.Write(data)
+	}
+	terminate := func() {
+		_ = binary.Write(buf, binary.LittleEndian, archiveTerminator)
+	}
+
+	_ = binary.Write(buf, binary.LittleEndian, archiveMagic)
+	write(archiveHeader{ConcurrentCollections: 4, FormatVersion: "0.1", ServerVersion: "6.0.3", ToolVersion: "100.6.1"})
+	write(archiveCollection{Database: "database1", Collection: "collection1", Metadata: dumpMetadata, Type: "collection"})
+	write(archiveCollection{Database: "database1", Collection: "collection2", Metadata: "", Type: "collection"})
+	write(archiveCollection{Database: "database1", Collection: "view1", Metadata: `{"options":{"viewOn":"collection1"},"indexes":[],"type":"view"}`, Type: "view"})
+	terminate()
+	for _, block := range []struct {
+		coll string
+		docs []int32
+	}{{"collection1", []int32{1, 2}}, {"collection2", []int32{10}}, {"collection1", []int32{3}}} {
+		write(archiveNamespaceHeader{Database: "database1", Collection: block.coll})
+		for _, n := range block.docs {
+			buf.Write(doc(n))
+		}
+		terminate()
+	}
+	for _, coll := range []string{"collection2", "view1", "collection1"} {
+		write(archiveNamespaceHeader{Database: "database1", Collection: coll, EOF: true})
+		terminate()
+	}
+
+	storageService := newFSStorageService(t.TempDir())
+	date, err := newMongoBackupService(nil, storageService, nil, backupOptions{}).ImportArchive(context.Background(), buf)
+	assert.NoError(t, err)
+
+	manifest, err := newCatalogService(storageService).Manifest(context.Background(), date)
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Collections, 2)
+	assert.Equal(t, [][]byte{doc(1), doc(2), doc(3)}, readStoredDocs(t, storageService, date, dbColl{"database1", "collection1"}))
+	assert.Equal(t, [][]byte{doc(10)}, readStoredDocs(t, storageService, date, dbColl{"database1", "collection2"}))
+
+	metadata, err := downloadMetadata(context.Background(), storageService, date, dbColl{"database1", "collection1"})
+	assert.NoError(t, err)
+	assert.Len(t, metadata.Indexes, 2)
+	assert.True(t, metadata.Options.Lookup("capped").Boolean())
+	metadata, err = downloadMetadata(context.Background(), storageService, date, dbColl{"database1", "collection2"})
+	assert.NoError(t, err)
+	assert.Nil(t, metadata)
+}
+
+func TestImportArchive_Truncated(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	data := testArchive(t, doc)
+	storageService := newFSStorageService(t.TempDir())
+
+	// Cut off the header marking the end of the collection, and its terminator.
+	eof, err := bson.Marshal(archiveNamespaceHeader{Database: "database1", Collection: "collection1", EOF: true})
+	assert.NoError(t, err)
+	_, err = newMongoBackupService(nil, storageService, nil, backupOptions{}).ImportArchive(context.Background(), bytes.NewReader(data[:len(data)-len(eof)-4]))
+
+	assert.EqualError(t, err, "archive ended before all documents of database1/collection1")
+}
+
+func TestImportArchive_ContinuesAfterEnd(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	eof, err := bson.Marshal(archiveNamespaceHeader{Database: "database1", Collection: "collection1", EOF: true})
+	assert.NoError(t, err)
+	block, err := bson.Marshal(archiveNamespaceHeader{Database: "database1", Collection: "collection1"})
+	assert.NoError(t, err)
+	terminator := []byte{0xff, 0xff, 0xff, 0xff}
+
+	for name, trailer := range map[string][]byte{
+		"repeated end": append(append([]byte{}, eof...), terminator...),
+		"data block":   append(append(append([]byte{}, block...), doc...), terminator...),
+	} {
+		t.Run(name, func(t *testing.T) {
+			data := append(testArchive(t, doc), trailer...)
+			storageService := newFSStorageService(t.TempDir())
+
+			_, err := newMongoBackupService(nil, storageService, nil, backupOptions{}).ImportArchive(context.Background(), bytes.NewReader(data))
+
+			assert.EqualError(t, err, "database1/collection1 continues after its end")
+		})
+	}
+}
+
+func TestImportDirectory(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "database1"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "database1", "collection1.bson"), append(doc, doc...), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "database1", "collection1.metadata.json"), []byte(dumpMetadata), 0600))
+	gzipped := new(bytes.Buffer)
+	gz := gzip.NewWriter(gzipped)
+	_, _ = gz.Write(doc)
+	assert.NoError(t, gz.Close())
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "database1", "collection2.bson.gz"), gzipped.Bytes(), 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "database1", "system.views.bson"), doc, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "oplog.bson"), nil, 0600))
+
+	storageService := newFSStorageService(t.TempDir())
+	date, err := newMongoBackupService(nil, storageService, nil, backupOptions{}).ImportDirectory(context.Background(), dir)
+	assert.NoError(t, err)
+
+	manifest, err := newCatalogService(storageService).Manifest(context.Background(), date)
+	assert.NoError(t, err)
+	assert.Len(t, manifest.Collections, 2)
+	assert.Equal(t, [][]byte{doc, doc}, readStoredDocs(t, storageService, date, dbColl{"database1", "collection1"}))
+	assert.Equal(t, [][]byte{doc}, readStoredDocs(t, storageService, date, dbColl{"database1", "collection2"}))
+	metadata, err := downloadMetadata(context.Background(), storageService, date, dbColl{"database1", "collection1"})
+	assert.NoError(t, err)
+	assert.Equal(t, "7e3b9a3a1c2d4f5e8a9b0c1d2e3f4a5b", metadata.UUID)
+
+	_, err = newMongoBackupService(nil, storageService, nil, backupOptions{}).ImportDirectory(context.Background(), t.TempDir())
+	assert.Error(t, err)
+}
+
+func TestImportDirectory_RestoresWithMetadata(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	dir := t.TempDir()
+	assert.NoError(t, os.MkdirAll(filepath.Join(dir, "database1"), 0700))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "database1", "collection1.bson"), doc, 0600))
+	assert.NoError(t, os.WriteFile(filepath.Join(dir, "database1", "collection1.metadata.json"), []byte(dumpMetadata), 0600))
+	storageService := newFSStorageService(t.TempDir())
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", mock.MatchedBy(func(metadata collectionMetadata) bool {
+		return metadata.Options.Lookup("capped").Boolean()
+	})).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	restored := new(bytes.Buffer)
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, restoreReplace).
+		Run(func(args mock.Arguments) {
+			_, _ = io.Copy(restored, args.Get(3).(io.Reader))
+		}).
+		Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, nil, backupOptions{})
+	date, err := backupService.ImportDirectory(context.Background(), dir)
+	assert.NoError(t, err)
+	assert.NoError(t, backupService.Restore(context.Background(), date, []dbColl{{"database1", "collection1"}}, restoreOptions{mode: restoreReplace}))
+
+	assert.Equal(t, doc, restored.Bytes())
+	mockedMongoService.AssertExpectations(t)
+}
+
+// TestImportDirectory_MongodumpFormat reads a backup taken in the mongodump
+// format the way mongorestore --dir would.
+func TestImportDirectory_MongodumpFormat(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	options := backupOptions{compression: compression{codec: gzipCodec}, format: mongodumpFormat}
+	assert.NoError(t, checkBackupFormat(options))
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").
+		Return(collectionMetadata{CollectionName: "collection1", Type: "collection"}, nil)
+	mockedMongoService.On("SaveCollection", mock.Anything, "database1", "collection1", collectionQuery{}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = args.Get(4).(io.Writer).Write(doc)
+		}).
+		Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+	err := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, options).Backup(context.Background(), selectCollections(dbColl{"database1", "collection1"}))
+	assert.NoError(t, err)
+	dates, err := os.ReadDir(storageService.dir)
+	assert.NoError(t, err)
+
+	manifest, err := newCatalogService(storageService).Manifest(context.Background(), dates[0].Name())
+	assert.NoError(t, err)
+	assert.Equal(t, mongodumpFormat, manifest.Format)
+	results, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(context.Background(), dates[0].Name())
+	assert.NoError(t, err)
+	assert.True(t, results[0].OK(), "Unexpected problems: %v", results[0].Problems)
+
+	dump := filepath.Join(storageService.dir, dates[0].Name())
+	assert.FileExists(t, filepath.Join(dump, "database1", "collection1.bson.gz"))
+	assert.FileExists(t, filepath.Join(dump, "database1", "collection1.metadata.json"))
+	imported := newFSStorageService(t.TempDir())
+	date, err := newMongoBackupService(nil, imported, nil, backupOptions{}).ImportDirectory(context.Background(), dump)
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{doc}, readStoredDocs(t, imported, date, dbColl{"database1", "collection1"}))
+}
+
+func TestCheckBackupFormat(t *testing.T) {
+	assert.NoError(t, checkBackupFormat(backupOptions{compression: snappyCompression, format: nativeFormat}))
+	assert.NoError(t, checkBackupFormat(backupOptions{compression: compression{codec: noCodec}, format: mongodumpFormat}))
+	assert.EqualError(t, checkBackupFormat(backupOptions{compression: snappyCompression, format: mongodumpFormat}), "mongodump backups need the gzip or none codec, not snappy")
+	assert.EqualError(t, checkBackupFormat(backupOptions{compression: compression{codec: gzipCodec}, keyProvider: newTestKeyProvider(t), format: mongodumpFormat}), "mongodump backups can't be encrypted, mongorestore couldn't read them")
+	assert.EqualError(t, checkBackupFormat(backupOptions{compression: compression{codec: gzipCodec}, partitionSize: 1 << 30, format: mongodumpFormat}), "mongodump backups can't be partitioned, mongorestore needs each collection in one file")
+	assert.EqualError(t, checkBackupFormat(backupOptions{format: "tar"}), "unknown backup format: tar")
+}
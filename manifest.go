@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"io"
+	"path/filepath"
+	"time"
+
+	"github.com/Financial-Times/service-status-go/buildinfo"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+const manifestFileName = "manifest.json"
+
+// backupManifest describes a backup run. It is stored as <date>/manifest.json
+// next to the collection objects of the run.
+type backupManifest struct {
+	Date        string    `json:"date"`
+	ToolVersion string    `json:"toolVersion"`
+	StartTime   time.Time `json:"startTime"`
+	EndTime     time.Time `json:"endTime"`
+	Complete    bool      `json:"complete"`
+	// ClusterTime is the time all collections were read at, if the run used a
+	// snapshot session.
+	ClusterTime *primitive.Timestamp `json:"clusterTime,omitempty"`
+	// Format is the format the run was taken in, native if it is empty.
+	Format string `json:"format,omitempty"`
+	// Selection is the collections the run was asked for, possibly with
+	// patterns, and Resolved the collections they matched at the start of
+	// the run.
+	Selection   string               `json:"selection,omitempty"`
+	Resolved    []string             `json:"resolved,omitempty"`
+	Collections []collectionManifest `json:"collections"`
+}
+
+type collectionManifest struct {
+	Database    string `json:"database"`
+	Collection  string `json:"collection"`
+	Documents   int64  `json:"documents"`
+	BSONBytes   int64  `json:"bsonBytes"`
+	StoredBytes int64  `json:"storedBytes"`
+	// SHA256 is empty for partitioned collections, Parts describes each of
+	// their objects instead.
+	SHA256      string         `json:"sha256"`
+	Parts       []partManifest `json:"parts,omitempty"`
+	StartTime   time.Time      `json:"startTime"`
+	EndTime     time.Time      `json:"endTime"`
+	ToolVersion string         `json:"toolVersion"`
+	Codec       codec          `json:"codec"`
+	// Encryption is empty for unencrypted backups.
+	Encryption string `json:"encryption,omitempty"`
+	// Partial is set if a collection query left out documents or fields.
+	// The query is recorded in the collection metadata.
+	Partial bool `json:"partial,omitempty"`
+	// Masked is set if personal data fields were masked. The mask is
+	// recorded in the collection metadata.
+	Masked bool `json:"masked,omitempty"`
+}
+
+// partManifest describes one stored object of a partitioned collection.
+type partManifest struct {
+	Part        int    `json:"part"`
+	Documents   int64  `json:"documents"`
+	BSONBytes   int64  `json:"bsonBytes"`
+	StoredBytes int64  `json:"storedBytes"`
+	SHA256      string `json:"sha256"`
+}
+
+func newBackupManifest(date string) *backupManifest {
+	return &backupManifest{
+		Date:        date,
+		ToolVersion: toolVersion(),
+		StartTime:   time.Now().UTC(),
+		Collections: []collectionManifest{},
+	}
+}
+
+func (bm *backupManifest) format() string {
+	if bm.Format == "" {
+		return nativeFormat
+	}
+	return bm.Format
+}
+
+func (bm *backupManifest) hasCollection(database, collection string) bool {
+	return bm.collection(database, collection) != nil
+}
+
+func (bm *backupManifest) collection(database, collection string) *collectionManifest {
+	for i, coll := range bm.Collections {
+		if coll.Database == database && coll.Collection == collection {
+			return &bm.Collections[i]
+		}
+	}
+	return nil
+}
+
+func manifestFilePath(date string) string {
+	return filepath.Join(date, manifestFileName)
+}
+
+func toolVersion() string {
+	return buildinfo.GetBuildInfo().Version
+}
+
+// countingWriter counts the documents and bytes handed to SaveCollection,
+// which writes exactly one document per call.
+type countingWriter struct {
+	writer    io.Writer
+	documents int64
+	bytes     int64
+}
+
+func newCountingWriter(writer io.Writer) *countingWriter {
+	return &countingWriter{writer: writer}
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.writer.Write(p)
+	cw.documents++
+	cw.bytes += int64(n)
+	return n, err
+}
+
+// digestReader counts and hashes the bytes of a stored object as they go by.
+type digestReader struct {
+	reader io.Reader
+	hash   hash.Hash
+	bytes  int64
+}
+
+func newDigestReader(reader io.Reader) *digestReader {
+	return &digestReader{
+		reader: reader,
+		hash:   sha256.New(),
+	}
+}
+
+func (dr *digestReader) Read(p []byte) (int, error) {
+	n, err := dr.reader.Read(p)
+	dr.hash.Write(p[:n])
+	dr.bytes += int64(n)
+	return n, err
+}
+
+func (dr *digestReader) Sum() string {
+	return hex.EncodeToString(dr.hash.Sum(nil))
+}
+
+// digestWriter counts and hashes the bytes of a stored object as they are
+// written out of the storage backend.
+type digestWriter struct {
+	writer io.Writer
+	hash   hash.Hash
+	bytes  int64
+}
+
+func newDigestWriter(writer io.Writer) *digestWriter {
+	return &digestWriter{
+		writer: writer,
+		hash:   sha256.New(),
+	}
+}
+
+func (dw *digestWriter) Write(p []byte) (int, error) {
+	n, err := dw.writer.Write(p)
+	dw.hash.Write(p[:n])
+	dw.bytes += int64(n)
+	return n, err
+}
+
+func (dw *digestWriter) Sum() string {
+	return hex.EncodeToString(dw.hash.Sum(nil))
+}
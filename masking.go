@@ -0,0 +1,352 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+// maskAction is what is done to a masked field.
+type maskAction string
+
+const (
+	// maskHash replaces the value with the hex HMAC-SHA256 of it, so equal
+	// values stay equal.
+	maskHash maskAction = "hash"
+	// maskFake replaces the value with a made up one of the same type, derived
+	// from the hash of the value.
+	maskFake maskAction = "fake"
+	// maskNull sets the field to null.
+	maskNull maskAction = "null"
+	// maskDrop removes the field.
+	maskDrop maskAction = "drop"
+)
+
+// fieldMask is the action taken on the field at a dotted path. Paths reach
+// into embedded documents and into every document of an array.
+type fieldMask struct {
+	path   []string
+	action maskAction
+}
+
+// collectionMask masks the fields of the documents of a collection.
+type collectionMask struct {
+	fields []fieldMask
+	// salt keys the hashes, so masked values can't be matched against the
+	// hashes of guessed values.
+	salt []byte
+}
+
+// maskRule applies a mask to the collections an entry, possibly a pattern,
+// matches.
+type maskRule struct {
+	coll dbColl
+	mask *collectionMask
+}
+
+// maskingRules are the masks of the collections holding personal data.
+type maskingRules []maskRule
+
+// lookup returns the mask of the first rule matching the collection, or nil.
+func (r maskingRules) lookup(coll dbColl) *collectionMask {
+	for _, rule := range r {
+		if rule.coll.matches(coll) {
+			return rule.mask
+		}
+	}
+	return nil
+}
+
+// parseMaskingRules parses a JSON document mapping <database>/<collection>
+// entries, which may be patterns, to the action taken on each field, e.g.
+// {"users/accounts": {"email": "hash", "address.street": "fake", "phone":
+// "null", "notes": "drop"}}. The first matching entry applies.
+func parseMaskingRules(value, salt string) (maskingRules, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(value), false, &doc); err != nil {
+		return nil, fmt.Errorf("couldn't parse masking rules: %v", err)
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse masking rules: %v", err)
+	}
+
+	var rules maskingRules
+	for _, element := range elements {
+		coll, err := parseDBColl(element.Key())
+		if err != nil {
+			return nil, err
+		}
+		fields, err := parseFieldMasks(element.Value())
+		if err != nil {
+			return nil, fmt.Errorf("invalid masking rule for %s: %v", element.Key(), err)
+		}
+		// Unkeyed hashes of guessed values would match the masked ones.
+		if salt == "" && keyedMask(fields) {
+			return nil, fmt.Errorf("masking rule for %s hashes or fakes fields, which needs a masking salt", element.Key())
+		}
+		rules = append(rules, maskRule{coll: coll, mask: &collectionMask{fields: fields, salt: []byte(salt)}})
+	}
+	return rules, nil
+}
+
+// keyedMask reports whether any of the fields is masked with a value derived
+// from the salt.
+func keyedMask(fields []fieldMask) bool {
+	for _, field := range fields {
+		if field.action == maskHash || field.action == maskFake {
+			return true
+		}
+	}
+	return false
+}
+
+func parseFieldMasks(value bson.RawValue) ([]fieldMask, error) {
+	doc, ok := value.DocumentOK()
+	if !ok {
+		return nil, fmt.Errorf("not a document")
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	var fields []fieldMask
+	for _, element := range elements {
+		path := element.Key()
+		// Restores rely on the _id of every document.
+		if path == "_id" || strings.HasPrefix(path, "_id.") {
+			return nil, fmt.Errorf("_id can't be masked")
+		}
+		if strings.HasPrefix(path, ".") || strings.HasSuffix(path, ".") || strings.Contains(path, "..") {
+			return nil, fmt.Errorf("invalid field path %s", path)
+		}
+		action, ok := element.Value().StringValueOK()
+		if !ok {
+			return nil, fmt.Errorf("action of %s is not a string", path)
+		}
+		switch maskAction(action) {
+		case maskHash, maskFake, maskNull, maskDrop:
+		default:
+			return nil, fmt.Errorf("unknown action %s for %s, expected hash, fake, null or drop", action, path)
+		}
+		fields = append(fields, fieldMask{path: strings.Split(path, "."), action: maskAction(action)})
+	}
+	if len(fields) == 0 {
+		return nil, fmt.Errorf("no fields to mask")
+	}
+	return fields, nil
+}
+
+// String returns the actions of the mask as a JSON document.
+func (m *collectionMask) String() string {
+	fields := make([]string, 0, len(m.fields))
+	for _, field := range m.fields {
+		fields = append(fields, fmt.Sprintf("%q: %q", strings.Join(field.path, "."), field.action))
+	}
+	return "{" + strings.Join(fields, ", ") + "}"
+}
+
+// apply returns the document with its fields masked. It has the signature
+// of a bsonTransformReader transform.
+func (m *collectionMask) apply(doc bson.Raw) (bson.Raw, error) {
+	masked, err := m.maskDocument(doc, m.fields)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't mask document: %v", err)
+	}
+	return masked, nil
+}
+
+// maskDocument masks the fields of an embedded document or array whose paths
+// are relative to it.
+func (m *collectionMask) maskDocument(doc bson.Raw, fields []fieldMask) (bson.Raw, error) {
+	elements, err := doc.Elements()
+	if err != nil {
+		return nil, err
+	}
+
+	index, dst := bsoncore.AppendDocumentStart(nil)
+	for _, element := range elements {
+		key := element.Key()
+		var action maskAction
+		var nested []fieldMask
+		for _, field := range fields {
+			if field.path[0] != key {
+				continue
+			}
+			if len(field.path) == 1 {
+				action = field.action
+				break
+			}
+			nested = append(nested, fieldMask{path: field.path[1:], action: field.action})
+		}
+
+		value := element.Value()
+		switch {
+		case action == maskDrop:
+			continue
+		case action != "":
+			value = m.maskValue(action, value)
+		case len(nested) > 0:
+			if value, err = m.maskNested(value, nested); err != nil {
+				return nil, err
+			}
+		default:
+			dst = append(dst, element...)
+			continue
+		}
+		dst = bsoncore.AppendHeader(dst, value.Type, key)
+		dst = append(dst, value.Value...)
+	}
+	return bsoncore.AppendDocumentEnd(dst, index)
+}
+
+// maskNested masks the fields of an embedded document, or of every document
+// of an array. Other values don't have the fields, so they are kept.
+func (m *collectionMask) maskNested(value bson.RawValue, fields []fieldMask) (bson.RawValue, error) {
+	switch value.Type {
+	case bsontype.EmbeddedDocument:
+		doc, err := m.maskDocument(value.Document(), fields)
+		return bson.RawValue{Type: value.Type, Value: doc}, err
+	case bsontype.Array:
+		values, err := value.Array().Values()
+		if err != nil {
+			return bson.RawValue{}, err
+		}
+		index, dst := bsoncore.AppendArrayStart(nil)
+		for i, item := range values {
+			if item.Type == bsontype.EmbeddedDocument {
+				if item, err = m.maskNested(item, fields); err != nil {
+					return bson.RawValue{}, err
+				}
+			}
+			dst = bsoncore.AppendHeader(dst, item.Type, fmt.Sprint(i))
+			dst = append(dst, item.Value...)
+		}
+		dst, err = bsoncore.AppendArrayEnd(dst, index)
+		return bson.RawValue{Type: value.Type, Value: dst}, err
+	}
+	return value, nil
+}
+
+// maskValue hashes, fakes or nulls a value. Hashing or faking an array masks
+// each of its values, and faking an embedded document each of its fields.
+func (m *collectionMask) maskValue(action maskAction, value bson.RawValue) bson.RawValue {
+	if action == maskNull || value.Type == bsontype.Null {
+		return bson.RawValue{Type: bsontype.Null}
+	}
+
+	if value.Type == bsontype.Array || (action == maskFake && value.Type == bsontype.EmbeddedDocument) {
+		elements, err := bson.Raw(value.Value).Elements()
+		if err != nil {
+			return bson.RawValue{Type: bsontype.Null}
+		}
+		index, dst := bsoncore.AppendDocumentStart(nil)
+		for _, element := range elements {
+			item := m.maskValue(action, element.Value())
+			dst = bsoncore.AppendHeader(dst, item.Type, element.Key())
+			dst = append(dst, item.Value...)
+		}
+		dst, _ = bsoncore.AppendDocumentEnd(dst, index)
+		return bson.RawValue{Type: value.Type, Value: dst}
+	}
+
+	digest := m.digest(value)
+	if action == maskHash {
+		return bson.RawValue{Type: bsontype.String, Value: bsoncore.AppendString(nil, hex.EncodeToString(digest))}
+	}
+	return fakeValue(value, digest)
+}
+
+// digest is the keyed hash of the type and bytes of a value.
+func (m *collectionMask) digest(value bson.RawValue) []byte {
+	mac := hmac.New(sha256.New, m.salt)
+	_, _ = mac.Write([]byte{byte(value.Type)})
+	_, _ = mac.Write(value.Value)
+	return mac.Sum(nil)
+}
+
+// fakeValue makes up a value of the type of value out of its digest. Types
+// without a sensible fake are nulled.
+func fakeValue(value bson.RawValue, digest []byte) bson.RawValue {
+	n := binary.BigEndian.Uint64(digest)
+	fake := bson.RawValue{Type: value.Type}
+	switch value.Type {
+	case bsontype.String:
+		s := "masked-" + hex.EncodeToString(digest[:6])
+		if strings.Contains(value.StringValue(), "@") {
+			s = "user-" + hex.EncodeToString(digest[:6]) + "@example.com"
+		}
+		fake.Value = bsoncore.AppendString(nil, s)
+	case bsontype.Int32:
+		fake.Value = bsoncore.AppendInt32(nil, int32(n%1000000))
+	case bsontype.Int64:
+		fake.Value = bsoncore.AppendInt64(nil, int64(n%1000000))
+	case bsontype.Double:
+		fake.Value = bsoncore.AppendDouble(nil, float64(n%100000000)/100)
+	case bsontype.Boolean:
+		fake.Value = bsoncore.AppendBoolean(nil, n%2 == 1)
+	case bsontype.DateTime:
+		// Somewhere between 1970 and 2020.
+		fake.Value = bsoncore.AppendDateTime(nil, int64(n%1577836800000))
+	case bsontype.ObjectID:
+		var id primitive.ObjectID
+		copy(id[:], digest)
+		fake.Value = bsoncore.AppendObjectID(nil, id)
+	case bsontype.Binary:
+		subtype, data := value.Binary()
+		fake.Value = bsoncore.AppendBinary(nil, subtype, fakeBytes(digest, len(data)))
+	default:
+		fake = bson.RawValue{Type: bsontype.Null}
+	}
+	return fake
+}
+
+// fakeBytes stretches the digest to n bytes.
+func fakeBytes(digest []byte, n int) []byte {
+	data := make([]byte, 0, n)
+	for block := digest; len(data) < n; {
+		data = append(data, block...)
+		sum := sha256.Sum256(block)
+		block = sum[:]
+	}
+	return data[:n]
+}
+
+// maskingWriter masks the documents written to it. Like the writers given to
+// SaveCollection, it expects exactly one document per Write.
+type maskingWriter struct {
+	writer io.Writer
+	mask   *collectionMask
+}
+
+func newMaskingWriter(writer io.Writer, mask *collectionMask) io.Writer {
+	if mask == nil {
+		return writer
+	}
+	return &maskingWriter{writer: writer, mask: mask}
+}
+
+func (w *maskingWriter) Write(p []byte) (int, error) {
+	doc, err := w.mask.apply(p)
+	if err != nil {
+		return 0, err
+	}
+	if _, err = w.writer.Write(doc); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func testMask(t *testing.T, rules string) *collectionMask {
+	masking, err := parseMaskingRules(rules, "salt")
+	assert.NoError(t, err)
+	mask := masking.lookup(dbColl{"users", "accounts"})
+	assert.NotNil(t, mask)
+	return mask
+}
+
+func TestParseMaskingRules(t *testing.T) {
+	masking, err := parseMaskingRules(`{
+		"users/accounts": {"email": "hash", "address.street": "fake"},
+		"users/*": {"notes": "drop"}
+	}`, "salt")
+	assert.NoError(t, err)
+	assert.Len(t, masking, 2)
+
+	accounts := masking.lookup(dbColl{"users", "accounts"})
+	assert.Equal(t, `{"email": "hash", "address.street": "fake"}`, accounts.String())
+	assert.Equal(t, []byte("salt"), accounts.salt)
+	assert.Equal(t, `{"notes": "drop"}`, masking.lookup(dbColl{"users", "sessions"}).String())
+	assert.Nil(t, masking.lookup(dbColl{"content", "pages"}))
+}
+
+func TestParseMaskingRules_Errors(t *testing.T) {
+	masking, err := parseMaskingRules("", "")
+	assert.NoError(t, err)
+	assert.Nil(t, masking)
+
+	_, err = parseMaskingRules(`{"users/accounts": {"email": "encrypt"}}`, "")
+	assert.EqualError(t, err, "invalid masking rule for users/accounts: unknown action encrypt for email, expected hash, fake, null or drop")
+
+	_, err = parseMaskingRules(`{"users/accounts": {"_id": "fake"}}`, "")
+	assert.EqualError(t, err, "invalid masking rule for users/accounts: _id can't be masked")
+
+	_, err = parseMaskingRules(`{"users/accounts": {"address..street": "null"}}`, "")
+	assert.EqualError(t, err, "invalid masking rule for users/accounts: invalid field path address..street")
+
+	_, err = parseMaskingRules(`{"users/accounts": {"email": 1}}`, "")
+	assert.EqualError(t, err, "invalid masking rule for users/accounts: action of email is not a string")
+
+	_, err = parseMaskingRules(`{"users/accounts": {}}`, "")
+	assert.EqualError(t, err, "invalid masking rule for users/accounts: no fields to mask")
+
+	_, err = parseMaskingRules(`{"accounts": {"email": "hash"}}`, "salt")
+	assert.Error(t, err)
+
+	_, err = parseMaskingRules(`{"users/accounts": {"email": "hash"}}`, "")
+	assert.EqualError(t, err, "masking rule for users/accounts hashes or fakes fields, which needs a masking salt")
+
+	_, err = parseMaskingRules(`{"users/accounts": {"name": "fake"}}`, "")
+	assert.EqualError(t, err, "masking rule for users/accounts hashes or fakes fields, which needs a masking salt")
+
+	masking, err = parseMaskingRules(`{"users/accounts": {"phone": "null", "notes": "drop"}}`, "")
+	assert.NoError(t, err)
+	assert.Len(t, masking, 1)
+}
+
+func TestCollectionMask_Apply(t *testing.T) {
+	mask := testMask(t, `{"users/accounts": {
+		"email": "hash",
+		"name": "fake",
+		"phone": "null",
+		"notes": "drop",
+		"address.street": "fake",
+		"contacts.email": "fake",
+		"tags": "hash"
+	}}`)
+	id := primitive.NewObjectID()
+	doc, err := bson.Marshal(bson.D{
+		{Key: "_id", Value: id},
+		{Key: "email", Value: "jane@example.org"},
+		{Key: "name", Value: "Jane"},
+		{Key: "phone", Value: "+44 20 7873 3000"},
+		{Key: "notes", Value: "likes cats"},
+		{Key: "address", Value: bson.D{{Key: "street", Value: "1 Friday St"}, {Key: "city", Value: "London"}}},
+		{Key: "contacts", Value: bson.A{bson.D{{Key: "email", Value: "john@example.org"}}, "none"}},
+		{Key: "tags", Value: bson.A{"a", "b"}},
+		{Key: "age", Value: int32(42)},
+	})
+	assert.NoError(t, err)
+
+	masked, err := mask.apply(doc)
+	assert.NoError(t, err)
+	assert.NoError(t, masked.Validate())
+
+	var result bson.M
+	assert.NoError(t, bson.Unmarshal(masked, &result))
+	assert.Equal(t, id, result["_id"])
+	assert.Len(t, result["email"], 64)
+	assert.True(t, strings.HasPrefix(result["name"].(string), "masked-"))
+	assert.Nil(t, result["phone"])
+	assert.Contains(t, result, "phone")
+	assert.NotContains(t, result, "notes")
+	address := result["address"].(bson.M)
+	assert.True(t, strings.HasPrefix(address["street"].(string), "masked-"))
+	assert.Equal(t, "London", address["city"])
+	contacts := result["contacts"].(bson.A)
+	assert.True(t, strings.HasSuffix(contacts[0].(bson.M)["email"].(string), "@example.com"))
+	assert.Equal(t, "none", contacts[1])
+	tags := result["tags"].(bson.A)
+	assert.Len(t, tags, 2)
+	assert.NotEqual(t, tags[0], tags[1])
+	assert.Equal(t, int32(42), result["age"])
+
+	again, err := mask.apply(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, masked, again)
+}
+
+func TestCollectionMask_FakeKeepsTypes(t *testing.T) {
+	mask := testMask(t, `{"users/accounts": {"profile": "fake"}}`)
+	doc, err := bson.Marshal(bson.D{{Key: "profile", Value: bson.D{
+		{Key: "visits", Value: int64(12)},
+		{Key: "score", Value: 4.5},
+		{Key: "verified", Value: true},
+		{Key: "born", Value: primitive.NewDateTimeFromTime(time.Date(1985, 3, 1, 0, 0, 0, 0, time.UTC))},
+		{Key: "photo", Value: primitive.Binary{Subtype: 0, Data: []byte("jpeg data")}},
+		{Key: "location", Value: primitive.Regex{Pattern: "^x"}},
+	}}})
+	assert.NoError(t, err)
+
+	masked, err := mask.apply(doc)
+	assert.NoError(t, err)
+
+	profile := masked.Lookup("profile").Document()
+	assert.Equal(t, bson.TypeInt64, profile.Lookup("visits").Type)
+	assert.Equal(t, bson.TypeDouble, profile.Lookup("score").Type)
+	assert.Equal(t, bson.TypeBoolean, profile.Lookup("verified").Type)
+	assert.Equal(t, bson.TypeDateTime, profile.Lookup("born").Type)
+	_, photo := profile.Lookup("photo").Binary()
+	assert.Len(t, photo, len("jpeg data"))
+	assert.NotEqual(t, []byte("jpeg data"), photo)
+	assert.Equal(t, bson.TypeNull, profile.Lookup("location").Type)
+}
+
+func TestCollectionMask_SaltChangesHashes(t *testing.T) {
+	doc, err := bson.Marshal(bson.D{{Key: "email", Value: "jane@example.org"}})
+	assert.NoError(t, err)
+
+	first, err := parseMaskingRules(`{"users/accounts": {"email": "hash"}}`, "one")
+	assert.NoError(t, err)
+	second, err := parseMaskingRules(`{"users/accounts": {"email": "hash"}}`, "two")
+	assert.NoError(t, err)
+
+	a, err := first[0].mask.apply(doc)
+	assert.NoError(t, err)
+	b, err := second[0].mask.apply(doc)
+	assert.NoError(t, err)
+	assert.NotEqual(t, a.Lookup("email"), b.Lookup("email"))
+}
+
+func TestMaskingWriter(t *testing.T) {
+	mask := testMask(t, `{"users/accounts": {"notes": "drop"}}`)
+	doc, err := bson.Marshal(bson.D{{Key: "name", Value: "Jane"}, {Key: "notes", Value: "likes cats"}})
+	assert.NoError(t, err)
+
+	buf := new(bytes.Buffer)
+	n, err := newMaskingWriter(buf, mask).Write(doc)
+	assert.NoError(t, err)
+	assert.Equal(t, len(doc), n)
+	assert.NoError(t, bson.Raw(buf.Bytes()).Validate())
+	assert.Equal(t, "Jane", bson.Raw(buf.Bytes()).Lookup("name").StringValue())
+	_, err = bson.Raw(buf.Bytes()).LookupErr("notes")
+	assert.Error(t, err)
+
+	assert.Equal(t, buf, newMaskingWriter(buf, nil))
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+const metadataFileExtension = ".metadata.json"
+
+// collectionMetadata describes how a collection was set up, so a restore can
+// recreate it. It is stored next to the collection data, in the same layout
+// as the metadata files of mongodump.
+type collectionMetadata struct {
+	Options        bson.Raw   `bson:"options"`
+	Indexes        []bson.Raw `bson:"indexes"`
+	UUID           string     `bson:"uuid,omitempty"`
+	CollectionName string     `bson:"collectionName"`
+	Type           string     `bson:"type"`
+	// Filter and Projection are set if the backup only holds the documents
+	// and fields they select.
+	Filter     bson.Raw `bson:"filter,omitempty"`
+	Projection bson.Raw `bson:"projection,omitempty"`
+	// Masking is the actions personal data fields were masked with, if any.
+	Masking string `bson:"masking,omitempty"`
+}
+
+// partial reports whether the backup leaves out documents or fields of the
+// collection.
+func (m collectionMetadata) partial() bool {
+	return len(m.Filter) > 0 || len(m.Projection) > 0
+}
+
+func metadataFilePath(date, database, collection string) string {
+	return filepath.Join(date, database, collection+metadataFileExtension)
+}
+
+// marshalMetadata encodes the metadata as canonical extended JSON, so index
+// options like expireAfterSeconds keep their exact BSON types.
+func marshalMetadata(metadata collectionMetadata) ([]byte, error) {
+	if metadata.Options == nil {
+		metadata.Options = emptyDocument()
+	}
+	return bson.MarshalExtJSON(metadata, true, false)
+}
+
+func unmarshalMetadata(data []byte) (collectionMetadata, error) {
+	var metadata collectionMetadata
+	if err := bson.UnmarshalExtJSON(data, true, &metadata); err != nil {
+		return collectionMetadata{}, fmt.Errorf("couldn't parse collection metadata: %v", err)
+	}
+	return metadata, nil
+}
+
+// restorableIndexes returns the index specs which have to be created on
+// restore. The _id index always exists already, and the ns field which older
+// servers report is rejected by createIndexes.
+func restorableIndexes(indexes []bson.Raw) ([]bson.Raw, error) {
+	var restorable []bson.Raw
+	for _, index := range indexes {
+		name, ok := index.Lookup("name").StringValueOK()
+		if !ok {
+			return nil, fmt.Errorf("index has no name: %v", index)
+		}
+		if name == "_id_" {
+			continue
+		}
+
+		elements, err := index.Elements()
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %s: %v", name, err)
+		}
+		var spec bson.D
+		for _, element := range elements {
+			if element.Key() == "ns" {
+				continue
+			}
+			spec = append(spec, bson.E{Key: element.Key(), Value: element.Value()})
+		}
+		raw, err := bson.Marshal(spec)
+		if err != nil {
+			return nil, fmt.Errorf("invalid index %s: %v", name, err)
+		}
+		restorable = append(restorable, raw)
+	}
+	return restorable, nil
+}
+
+type indexBuildOrder string
+
+const (
+	indexesAfterData  indexBuildOrder = "after"
+	indexesBeforeData indexBuildOrder = "before"
+)
+
+func parseIndexBuildOrder(value string) (indexBuildOrder, error) {
+	switch order := indexBuildOrder(strings.ToLower(value)); order {
+	case indexesAfterData, indexesBeforeData:
+		return order, nil
+	default:
+		return "", fmt.Errorf("unknown index build order: %s", value)
+	}
+}
+
+func emptyDocument() bson.Raw {
+	raw, _ := bson.Marshal(bson.D{})
+	return raw
+}
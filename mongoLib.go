@@ -2,12 +2,13 @@ package main
 
 import (
 	"context"
-	"fmt"
 	"time"
 
 	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 	"go.mongodb.org/mongo-driver/mongo/options"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
 )
 
 type closer interface {
@@ -15,9 +16,35 @@ type closer interface {
 }
 
 type mongoSession interface {
-	FindAll(ctx context.Context, database, collection string) (mongoCursor, error)
+	FindAll(ctx context.Context, database, collection string, query collectionQuery) (mongoCursor, error)
+	FindRange(ctx context.Context, database, collection string, partition idRange, query collectionQuery) (mongoCursor, error)
+	CollectionSize(ctx context.Context, database, collection string) (int64, error)
+	SampleIDs(ctx context.Context, database, collection string, size int) ([]bson.RawValue, error)
 	RemoveAll(ctx context.Context, database, collection string) error
+	HasDocuments(ctx context.Context, database, collection string) (bool, error)
 	BulkWrite(ctx context.Context, database, collection string, models []mongo.WriteModel) error
+	TailOplog(ctx context.Context, namespaces []string, after primitive.Timestamp) (mongoCursor, error)
+	LastOplogTimestamp(ctx context.Context) (primitive.Timestamp, error)
+	FirstOplogTimestamp(ctx context.Context) (primitive.Timestamp, error)
+	ApplyOps(ctx context.Context, ops []bson.Raw) error
+	StartSnapshot(ctx context.Context) (context.Context, snapshot, error)
+	CollectionSpec(ctx context.Context, database, collection string) (bson.Raw, error)
+	ListIndexes(ctx context.Context, database, collection string) ([]bson.Raw, error)
+	CreateCollection(ctx context.Context, database, collection string, options bson.Raw) error
+	CreateIndexes(ctx context.Context, database, collection string, indexes []bson.Raw) error
+	DropCollection(ctx context.Context, database, collection string) error
+	RenameCollection(ctx context.Context, database, from, to string) error
+	ClusterHealth(ctx context.Context) (clusterHealth, error)
+	ListDatabases(ctx context.Context) ([]string, error)
+	ListCollections(ctx context.Context, database string) ([]string, error)
+
+	closer
+}
+
+// snapshot is a session reading with snapshot read concern. Every read made
+// with its context sees the data at the same cluster time.
+type snapshot interface {
+	ClusterTime() (primitive.Timestamp, bool)
 
 	closer
 }
@@ -40,13 +67,19 @@ func (c *cursor) Current() []byte {
 
 type mongoClient struct {
 	client *mongo.Client
+	// readPref is the read preference of the reads of backups, if set.
+	// Everything else, including all writes, follows the connection string.
+	readPref *readpref.ReadPref
 }
 
-func newMongoClient(ctx context.Context, uri string, timeout time.Duration) (*mongoClient, error) {
-	uri = fmt.Sprintf("mongodb://%s", uri)
-	opts := options.Client().
-		ApplyURI(uri).
-		SetSocketTimeout(timeout)
+// newMongoClient connects to MongoDB. A nil readPref reads backups with the
+// read preference of the connection string, the primary unless it says
+// otherwise.
+func newMongoClient(ctx context.Context, uri string, timeout time.Duration, conn connectionOptions, readPref *readpref.ReadPref) (*mongoClient, error) {
+	opts, err := clientOptions(uri, timeout, conn)
+	if err != nil {
+		return nil, err
+	}
 
 	client, err := mongo.Connect(ctx, opts)
 	if err != nil {
@@ -54,15 +87,60 @@ func newMongoClient(ctx context.Context, uri string, timeout time.Duration) (*mo
 	}
 
 	return &mongoClient{
-		client: client,
+		client:   client,
+		readPref: readPref,
 	}, nil
 }
 
-func (m mongoClient) FindAll(ctx context.Context, database, collection string) (mongoCursor, error) {
-	cur, err := m.client.
-		Database(database).
+// readDatabase returns a database whose reads use the read preference of
+// backups.
+func (m mongoClient) readDatabase(database string) *mongo.Database {
+	opts := options.Database()
+	if m.readPref != nil {
+		opts.SetReadPreference(m.readPref)
+	}
+	return m.client.Database(database, opts)
+}
+
+// FindAll returns a cursor over the documents, and their fields, which the
+// query selects.
+func (m mongoClient) FindAll(ctx context.Context, database, collection string, query collectionQuery) (mongoCursor, error) {
+	opts := options.Find()
+	if query.projection != nil {
+		opts.SetProjection(query.projection)
+	}
+
+	cur, err := m.
+		readDatabase(database).
+		Collection(collection).
+		Find(ctx, query.findFilter(), opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor{cur}, nil
+}
+
+// FindRange returns a cursor over the documents whose _id is in the given
+// range. It walks the _id index with min and max bounds rather than a $gte/$lt
+// filter, as those only match _ids of the same BSON type as the bounds. The
+// query applies within the range.
+func (m mongoClient) FindRange(ctx context.Context, database, collection string, partition idRange, query collectionQuery) (mongoCursor, error) {
+	opts := options.Find().SetHint(bson.D{{Key: "_id", Value: 1}})
+	if query.projection != nil {
+		opts.SetProjection(query.projection)
+	}
+	if partition.min != nil {
+		opts.SetMin(bson.D{{Key: "_id", Value: *partition.min}})
+	}
+	if partition.max != nil {
+		opts.SetMax(bson.D{{Key: "_id", Value: *partition.max}})
+	}
+
+	cur, err := m.
+		readDatabase(database).
 		Collection(collection).
-		Find(ctx, bson.D{})
+		Find(ctx, query.findFilter(), opts)
 	if err != nil {
 		return nil, err
 	}
@@ -70,6 +148,50 @@ func (m mongoClient) FindAll(ctx context.Context, database, collection string) (
 	return &cursor{cur}, nil
 }
 
+// CollectionSize returns the uncompressed size of the documents of a
+// collection, in bytes.
+func (m mongoClient) CollectionSize(ctx context.Context, database, collection string) (int64, error) {
+	var stats struct {
+		Size int64 `bson:"size"`
+	}
+	// Commands go to the primary unless told otherwise, even if the database
+	// has another read preference.
+	db := m.readDatabase(database)
+	err := db.
+		RunCommand(ctx, bson.D{{Key: "collStats", Value: collection}}, options.RunCmd().SetReadPreference(db.ReadPreference())).
+		Decode(&stats)
+	return stats.Size, err
+}
+
+// SampleIDs returns the _ids of a random sample of documents, in _id order.
+func (m mongoClient) SampleIDs(ctx context.Context, database, collection string, size int) ([]bson.RawValue, error) {
+	cur, err := m.
+		readDatabase(database).
+		Collection(collection).
+		Aggregate(ctx, bson.A{
+			bson.D{{Key: "$sample", Value: bson.D{{Key: "size", Value: size}}}},
+			bson.D{{Key: "$project", Value: bson.D{{Key: "_id", Value: 1}}}},
+			bson.D{{Key: "$sort", Value: bson.D{{Key: "_id", Value: 1}}}},
+		}, options.Aggregate().SetAllowDiskUse(true))
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = cur.Close(context.Background())
+	}()
+
+	var ids []bson.RawValue
+	for cur.Next(ctx) {
+		id, err := cur.Current.LookupErr("_id")
+		if err != nil {
+			return nil, err
+		}
+		ids = append(ids, bson.RawValue{Type: id.Type, Value: append([]byte(nil), id.Value...)})
+	}
+	return ids, cur.Err()
+}
+
 func (m mongoClient) RemoveAll(ctx context.Context, database, collection string) error {
 	_, err := m.client.
 		Database(database).
@@ -78,6 +200,14 @@ func (m mongoClient) RemoveAll(ctx context.Context, database, collection string)
 	return err
 }
 
+func (m mongoClient) HasDocuments(ctx context.Context, database, collection string) (bool, error) {
+	count, err := m.client.
+		Database(database).
+		Collection(collection).
+		CountDocuments(ctx, bson.D{}, options.Count().SetLimit(1))
+	return count > 0, err
+}
+
 func (m mongoClient) BulkWrite(ctx context.Context, database, collection string, models []mongo.WriteModel) error {
 	opts := options.BulkWrite().SetOrdered(false)
 
@@ -89,6 +219,252 @@ func (m mongoClient) BulkWrite(ctx context.Context, database, collection string,
 	return err
 }
 
+// TailOplog returns a tailable cursor over the insert, update and delete oplog
+// entries of the given namespaces, starting after the given timestamp. It
+// also returns the applyOps entries of transactions which wrote to them, and
+// the no-op entries replica sets write every few seconds, which show how far
+// the oplog was read even while the namespaces see no writes.
+func (m mongoClient) TailOplog(ctx context.Context, namespaces []string, after primitive.Timestamp) (mongoCursor, error) {
+	filter := bson.D{
+		{Key: "ts", Value: bson.D{{Key: "$gt", Value: after}}},
+		{Key: "$or", Value: bson.A{
+			bson.D{
+				{Key: "ns", Value: bson.D{{Key: "$in", Value: namespaces}}},
+				{Key: "op", Value: bson.D{{Key: "$in", Value: bson.A{"i", "u", "d"}}}},
+			},
+			bson.D{
+				{Key: "ns", Value: "admin.$cmd"},
+				{Key: "op", Value: "c"},
+				{Key: "o.applyOps.ns", Value: bson.D{{Key: "$in", Value: namespaces}}},
+			},
+			bson.D{
+				{Key: "ns", Value: ""},
+				{Key: "op", Value: "n"},
+			},
+		}},
+	}
+	opts := options.Find().
+		SetCursorType(options.TailableAwait).
+		SetMaxAwaitTime(time.Second)
+
+	cur, err := m.client.
+		Database("local").
+		Collection("oplog.rs").
+		Find(ctx, filter, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &cursor{cur}, nil
+}
+
+func (m mongoClient) LastOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	return m.oplogEnd(ctx, -1)
+}
+
+func (m mongoClient) FirstOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	return m.oplogEnd(ctx, 1)
+}
+
+// oplogEnd returns the timestamp of the newest oplog entry for order -1, and
+// of the oldest one still in the oplog for order 1.
+func (m mongoClient) oplogEnd(ctx context.Context, order int) (primitive.Timestamp, error) {
+	opts := options.FindOne().
+		SetSort(bson.D{{Key: "$natural", Value: order}}).
+		SetProjection(bson.D{{Key: "ts", Value: 1}})
+
+	var entry struct {
+		TS primitive.Timestamp `bson:"ts"`
+	}
+	err := m.client.
+		Database("local").
+		Collection("oplog.rs").
+		FindOne(ctx, bson.D{}, opts).
+		Decode(&entry)
+
+	return entry.TS, err
+}
+
+func (m mongoClient) ApplyOps(ctx context.Context, ops []bson.Raw) error {
+	return m.client.
+		Database("admin").
+		RunCommand(ctx, bson.D{{Key: "applyOps", Value: ops}}).
+		Err()
+}
+
+// StartSnapshot starts a snapshot session. The returned context makes reads
+// use it. The cluster time of the snapshot is chosen by the first read.
+func (m mongoClient) StartSnapshot(ctx context.Context) (context.Context, snapshot, error) {
+	sess, err := m.client.StartSession(options.Session().SetSnapshot(true))
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return mongo.NewSessionContext(ctx, sess), &snapshotSession{sess}, nil
+}
+
+type snapshotSession struct {
+	session mongo.Session
+}
+
+func (s *snapshotSession) ClusterTime() (primitive.Timestamp, bool) {
+	xs, ok := s.session.(mongo.XSession)
+	if !ok || xs.ClientSession().SnapshotTime == nil {
+		return primitive.Timestamp{}, false
+	}
+	return *xs.ClientSession().SnapshotTime, true
+}
+
+func (s *snapshotSession) Close(ctx context.Context) error {
+	s.session.EndSession(ctx)
+	return nil
+}
+
+func (m mongoClient) ListDatabases(ctx context.Context) ([]string, error) {
+	return m.client.ListDatabaseNames(ctx, bson.D{})
+}
+
+// ListCollections returns the names of the collections of a database,
+// leaving out views.
+func (m mongoClient) ListCollections(ctx context.Context, database string) ([]string, error) {
+	return m.client.
+		Database(database).
+		ListCollectionNames(ctx, bson.D{{Key: "type", Value: "collection"}})
+}
+
+// CollectionSpec returns the listCollections entry of a collection, or nil if
+// the collection doesn't exist.
+func (m mongoClient) CollectionSpec(ctx context.Context, database, collection string) (bson.Raw, error) {
+	cur, err := m.client.
+		Database(database).
+		ListCollections(ctx, bson.D{{Key: "name", Value: collection}})
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = cur.Close(context.Background())
+	}()
+
+	if cur.Next(ctx) {
+		return append(bson.Raw(nil), cur.Current...), nil
+	}
+	return nil, cur.Err()
+}
+
+func (m mongoClient) ListIndexes(ctx context.Context, database, collection string) ([]bson.Raw, error) {
+	cur, err := m.client.
+		Database(database).
+		Collection(collection).
+		Indexes().
+		List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		_ = cur.Close(context.Background())
+	}()
+
+	var indexes []bson.Raw
+	for cur.Next(ctx) {
+		indexes = append(indexes, append(bson.Raw(nil), cur.Current...))
+	}
+	return indexes, cur.Err()
+}
+
+func (m mongoClient) CreateCollection(ctx context.Context, database, collection string, options bson.Raw) error {
+	cmd := bson.D{{Key: "create", Value: collection}}
+	elements, err := options.Elements()
+	if err != nil {
+		return err
+	}
+	for _, element := range elements {
+		cmd = append(cmd, bson.E{Key: element.Key(), Value: element.Value()})
+	}
+
+	return m.client.
+		Database(database).
+		RunCommand(ctx, cmd).
+		Err()
+}
+
+func (m mongoClient) CreateIndexes(ctx context.Context, database, collection string, indexes []bson.Raw) error {
+	return m.client.
+		Database(database).
+		RunCommand(ctx, bson.D{
+			{Key: "createIndexes", Value: collection},
+			{Key: "indexes", Value: indexes},
+		}).
+		Err()
+}
+
+func (m mongoClient) DropCollection(ctx context.Context, database, collection string) error {
+	return m.client.
+		Database(database).
+		Collection(collection).
+		Drop(ctx)
+}
+
+func (m mongoClient) RenameCollection(ctx context.Context, database, from, to string) error {
+	return m.client.
+		Database("admin").
+		RunCommand(ctx, bson.D{
+			{Key: "renameCollection", Value: database + "." + from},
+			{Key: "to", Value: database + "." + to},
+			{Key: "dropTarget", Value: true},
+		}).
+		Err()
+}
+
+// ClusterHealth reads the lag of the furthest secondary from replSetGetStatus,
+// and the write queue of the primary from serverStatus.
+func (m mongoClient) ClusterHealth(ctx context.Context) (clusterHealth, error) {
+	var status struct {
+		Members []struct {
+			State      int       `bson:"state"`
+			OptimeDate time.Time `bson:"optimeDate"`
+		} `bson:"members"`
+	}
+	err := m.client.
+		Database("admin").
+		RunCommand(ctx, bson.D{{Key: "replSetGetStatus", Value: 1}}).
+		Decode(&status)
+	if err != nil {
+		return clusterHealth{}, err
+	}
+
+	var health clusterHealth
+	var primary time.Time
+	for _, member := range status.Members {
+		if member.State == 1 {
+			primary = member.OptimeDate
+		}
+	}
+	for _, member := range status.Members {
+		if member.State != 2 || primary.IsZero() {
+			continue
+		}
+		if lag := primary.Sub(member.OptimeDate); lag > health.ReplicationLag {
+			health.ReplicationLag = lag
+		}
+	}
+
+	var server struct {
+		GlobalLock struct {
+			CurrentQueue struct {
+				Writers int64 `bson:"writers"`
+			} `bson:"currentQueue"`
+		} `bson:"globalLock"`
+	}
+	err = m.client.
+		Database("admin").
+		RunCommand(ctx, bson.D{{Key: "serverStatus", Value: 1}}).
+		Decode(&server)
+	health.WriteQueue = server.GlobalLock.CurrentQueue.Writers
+	return health, err
+}
+
 func (m mongoClient) Close(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, time.Second*10)
 	defer cancel()
@@ -0,0 +1,753 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+	"golang.org/x/sync/errgroup"
+)
+
+const (
+	oplogDir = "oplog"
+	// oplogReplayMargin is how far before the start of a backup the oplog
+	// replay starts, to make up for clock differences between this service
+	// and MongoDB. Replaying oplog entries which are already contained in the
+	// backup is harmless, as long as they are all replayed in order.
+	oplogReplayMargin = time.Minute
+	oplogRetryDelay   = 30 * time.Second
+)
+
+// oplogService captures the oplog of a set of collections into the storage
+// backend, and replays it on top of a restored backup.
+type oplogService struct {
+	dbService      dbService
+	storageService storageService
+	bsonService    bsonService
+	catalogService *catalogService
+	keyProvider    keyProvider
+	segmentLength  time.Duration
+	flushInterval  time.Duration
+}
+
+func newOplogService(dbService dbService, storageService storageService, bsonService bsonService, keyProvider keyProvider, segmentLength time.Duration) *oplogService {
+	return &oplogService{
+		dbService:      dbService,
+		storageService: storageService,
+		bsonService:    bsonService,
+		catalogService: newCatalogService(storageService),
+		keyProvider:    keyProvider,
+		segmentLength:  segmentLength,
+		flushInterval:  time.Second,
+	}
+}
+
+// oplogSegmentPath names a segment after the timestamp of its first entry.
+// Segments are always stored with snappy.
+func oplogSegmentPath(first primitive.Timestamp) string {
+	name := fmt.Sprintf("%s_%d%s", time.Unix(int64(first.T), 0).UTC().Format(dateFormat), first.I, snappyCodec.extension())
+	return filepath.Join(oplogDir, name)
+}
+
+func parseOplogSegmentPath(path string) (primitive.Timestamp, bool) {
+	dir, name := filepath.Split(filepath.ToSlash(path))
+	if dir != oplogDir+"/" || !strings.HasSuffix(name, snappyCodec.extension()) {
+		return primitive.Timestamp{}, false
+	}
+
+	parts := strings.Split(strings.TrimSuffix(name, snappyCodec.extension()), "_")
+	if len(parts) != 2 {
+		return primitive.Timestamp{}, false
+	}
+	t, err := time.Parse(dateFormat, parts[0])
+	if err != nil {
+		return primitive.Timestamp{}, false
+	}
+	i, err := strconv.ParseUint(parts[1], 10, 32)
+	if err != nil {
+		return primitive.Timestamp{}, false
+	}
+	return primitive.Timestamp{T: uint32(t.Unix()), I: uint32(i)}, true
+}
+
+// oplogSegmentMetadata describes what a segment covers. It is stored next to
+// the segment, e.g. as oplog/2022-08-31T15-40-00_1.metadata.json.
+type oplogSegmentMetadata struct {
+	// After is the timestamp the capture continued from when the segment was
+	// started. Nothing was written to the namespaces between it and the first
+	// entry of the segment.
+	After primitive.Timestamp `json:"after"`
+	// Namespaces is the namespaces the segment holds the entries of.
+	Namespaces []string `json:"namespaces"`
+}
+
+func oplogSegmentMetadataPath(segmentPath string) string {
+	return strings.TrimSuffix(segmentPath, snappyCodec.extension()) + metadataFileExtension
+}
+
+func (m oplogSegmentMetadata) covers(ns string) bool {
+	for _, n := range m.Namespaces {
+		if n == ns {
+			return true
+		}
+	}
+	return false
+}
+
+type oplogSegmentInfo struct {
+	path  string
+	first primitive.Timestamp
+}
+
+// segments lists the stored oplog segments, oldest first.
+func (o *oplogService) segments(ctx context.Context) ([]oplogSegmentInfo, error) {
+	return listOplogSegments(ctx, o.storageService)
+}
+
+func listOplogSegments(ctx context.Context, storageService storageService) ([]oplogSegmentInfo, error) {
+	objects, err := storageService.List(ctx, oplogDir)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list oplog segments: %v", err)
+	}
+
+	var segments []oplogSegmentInfo
+	for _, obj := range objects {
+		if first, ok := parseOplogSegmentPath(obj.Path); ok {
+			segments = append(segments, oplogSegmentInfo{path: obj.Path, first: first})
+		}
+	}
+
+	sort.Slice(segments, func(i, j int) bool {
+		return timestampBefore(segments[i].first, segments[j].first)
+	})
+	return segments, nil
+}
+
+// Run captures the oplog until the context is done, starting over after
+// failures.
+func (o *oplogService) Run(ctx context.Context, colls []dbColl) {
+	for {
+		err := o.Capture(ctx, colls)
+		if ctx.Err() != nil {
+			return
+		}
+
+		log.WithError(err).Errorf("Capturing oplog failed, retrying in %v", oplogRetryDelay)
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(oplogRetryDelay):
+		}
+	}
+}
+
+// Capture tails the oplog of the collections from where the last stored
+// segment ends, and stores it in segments of segmentLength.
+func (o *oplogService) Capture(ctx context.Context, colls []dbColl) error {
+	after, err := o.resumePoint(ctx)
+	if err != nil {
+		return err
+	}
+
+	enc, err := newEncryption(o.keyProvider)
+	if err != nil {
+		return fmt.Errorf("couldn't set up encryption: %v", err)
+	}
+
+	log.Infof("Capturing oplog after %v", after)
+
+	namespaces := oplogNamespaces(colls)
+	tailCtx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	entries := make(chan []byte, 1024)
+	tailErr := make(chan error, 1)
+	go func() {
+		tailErr <- o.dbService.TailOplog(tailCtx, namespaces, after, entries)
+	}()
+
+	ticker := time.NewTicker(o.flushInterval)
+	defer ticker.Stop()
+
+	var seg *oplogSegment
+	defer func() {
+		if seg != nil {
+			if err := seg.close(); err != nil {
+				log.WithError(err).Errorf("Storing oplog segment %s failed", seg.path)
+			}
+		}
+	}()
+
+	// A new segment continues the capture from the last entry written.
+	last := after
+	write := func(entry []byte) error {
+		ops, err := oplogOps(entry, namespaces)
+		if err != nil {
+			return err
+		}
+		for _, op := range ops {
+			ts, err := oplogTimestamp(op)
+			if err != nil {
+				return err
+			}
+			if seg != nil && !seg.covers(ts) {
+				err = seg.close()
+				seg = nil
+				if err != nil {
+					return err
+				}
+			}
+			if seg == nil {
+				if seg, err = o.openSegment(ctx, ts, last, namespaces, enc); err != nil {
+					return err
+				}
+			}
+			if err = seg.write(op, ts); err != nil {
+				return err
+			}
+			last = ts
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case entry := <-entries:
+			if err = write(entry); err != nil {
+				return err
+			}
+		case <-ticker.C:
+			if seg != nil && time.Now().After(seg.end) {
+				err = seg.close()
+				seg = nil
+				if err != nil {
+					return err
+				}
+			}
+		case err = <-tailErr:
+			// Keep what was captured before the tailing stopped.
+			for len(entries) > 0 {
+				if wErr := write(<-entries); wErr != nil {
+					return wErr
+				}
+			}
+			return err
+		}
+	}
+}
+
+// resumePoint returns the timestamp of the last stored oplog entry, or the
+// current end of the oplog if nothing was captured yet. It fails if the oplog
+// rolled over past the last stored entry, as the entries after it are lost.
+func (o *oplogService) resumePoint(ctx context.Context) (primitive.Timestamp, error) {
+	segments, err := o.segments(ctx)
+	if err != nil {
+		return primitive.Timestamp{}, err
+	}
+
+	if len(segments) == 0 {
+		ts, err := o.dbService.LastOplogTimestamp(ctx)
+		if err != nil {
+			return primitive.Timestamp{}, fmt.Errorf("couldn't find the end of the oplog: %v", err)
+		}
+		return ts, nil
+	}
+
+	last := segments[len(segments)-1]
+	after, err := o.lastTimestamp(ctx, last)
+	if err != nil {
+		log.WithError(err).Warnf("Reading last oplog segment %s failed, resuming after %v", last.path, after)
+	}
+
+	oldest, err := o.dbService.FirstOplogTimestamp(ctx)
+	if err != nil {
+		return primitive.Timestamp{}, fmt.Errorf("couldn't find the start of the oplog: %v", err)
+	}
+	if timestampBefore(after, oldest) {
+		return primitive.Timestamp{}, fmt.Errorf("the oplog was captured up to %v, but it now starts at %v, the entries in between are lost; move the captured segments out of %s/ to start capturing afresh", after, oldest, oplogDir)
+	}
+	return after, nil
+}
+
+// lastTimestamp returns the timestamp of the last entry of a segment. If the
+// segment can't be read to the end, it returns the last one read, or the
+// timestamp just before the first entry, along with the error.
+func (o *oplogService) lastTimestamp(ctx context.Context, seg oplogSegmentInfo) (primitive.Timestamp, error) {
+	last := previousTimestamp(seg.first)
+	err := o.readSegment(ctx, seg.path, func(reader io.Reader) error {
+		for {
+			next, err := o.bsonService.ReadNextBSON(reader)
+			if err != nil || next == nil {
+				return err
+			}
+			if last, err = oplogTimestamp(next); err != nil {
+				return err
+			}
+		}
+	})
+	return last, err
+}
+
+// segmentMetadata downloads the metadata of a segment.
+func (o *oplogService) segmentMetadata(ctx context.Context, seg oplogSegmentInfo) (*oplogSegmentMetadata, error) {
+	buf := new(bytes.Buffer)
+	if err := o.storageService.Download(ctx, oplogSegmentMetadataPath(seg.path), buf); err != nil {
+		return nil, fmt.Errorf("couldn't download metadata of oplog segment %s, segments captured by older versions have none: %v", seg.path, err)
+	}
+	var metadata oplogSegmentMetadata
+	if err := json.Unmarshal(buf.Bytes(), &metadata); err != nil {
+		return nil, fmt.Errorf("couldn't parse metadata of oplog segment %s: %v", seg.path, err)
+	}
+	return &metadata, nil
+}
+
+func (o *oplogService) readSegment(ctx context.Context, path string, read func(reader io.Reader) error) error {
+	reader, writer := newPipe(downloadOperation, snappyCompression, &encryption{provider: o.keyProvider})
+
+	g, ctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		defer func() {
+			_ = writer.Close()
+		}()
+
+		return o.storageService.Download(ctx, path, writer)
+	})
+	g.Go(func() error {
+		// Unblocks the download if reading stops early.
+		defer func() {
+			_ = reader.Close()
+		}()
+
+		return read(reader)
+	})
+
+	return g.Wait()
+}
+
+// RestoreTo restores the collections from the latest backup taken before the
+// given time, then replays the captured oplog up to that time.
+func (o *oplogService) RestoreTo(ctx context.Context, backupService backupService, to time.Time, colls []dbColl, options restoreOptions) error {
+	date, from, err := o.nearestBackup(ctx, to, colls)
+	if err != nil {
+		return err
+	}
+
+	if err = o.checkUnmasked(ctx, date, colls); err != nil {
+		return err
+	}
+
+	// The oplog is checked before anything is restored.
+	segments, err := o.replaySegments(ctx, colls, from, to)
+	if err != nil {
+		return err
+	}
+
+	log.Infof("Restoring backup %s, then replaying the oplog from %v up to %v", date, from, to)
+
+	if err = backupService.Restore(ctx, date, colls, options); err != nil {
+		return err
+	}
+	return o.replay(ctx, segments, colls, from, to, options)
+}
+
+// checkUnmasked refuses backups taken with fields masked. The oplog is
+// captured unmasked, so replaying it on top would put back what was masked.
+func (o *oplogService) checkUnmasked(ctx context.Context, date string, colls []dbColl) error {
+	manifest, err := o.catalogService.Manifest(ctx, date)
+	if err != nil && err != errManifestNotFound {
+		return err
+	}
+
+	for _, coll := range colls {
+		masked := false
+		if manifest != nil {
+			for _, entry := range manifest.Collections {
+				if entry.Database == coll.database && entry.Collection == coll.collection && entry.Masked {
+					masked = true
+				}
+			}
+		}
+		if !masked {
+			metadata, err := downloadMetadata(ctx, o.storageService, date, coll)
+			if err != nil {
+				return err
+			}
+			masked = metadata != nil && metadata.Masking != ""
+		}
+		if masked {
+			return fmt.Errorf("backup %s of %s was taken with fields masked, the oplog can't be replayed on top of it", date, coll)
+		}
+	}
+	return nil
+}
+
+// nearestBackup finds the latest backup taken before the given time which
+// successfully saved all the collections, and the oplog timestamp to replay
+// from on top of it.
+func (o *oplogService) nearestBackup(ctx context.Context, to time.Time, colls []dbColl) (string, primitive.Timestamp, error) {
+	listings, err := o.catalogService.List(ctx)
+	if err != nil {
+		return "", primitive.Timestamp{}, err
+	}
+
+	for i := len(listings) - 1; i >= 0; i-- {
+		listing := listings[i]
+		start, _ := time.Parse(dateFormat, listing.Date)
+		if start.After(to) || !listing.contains(colls) {
+			continue
+		}
+
+		fromTS, err := replayStart(ctx, o.catalogService, listing)
+		if err != nil {
+			return "", primitive.Timestamp{}, err
+		}
+		return listing.Date, fromTS, nil
+	}
+
+	return "", primitive.Timestamp{}, fmt.Errorf("no backup of all collections found before %v", to)
+}
+
+// replayStart returns the timestamp after which the oplog is replayed on top
+// of the backup run.
+func replayStart(ctx context.Context, catalogService *catalogService, listing backupListing) (primitive.Timestamp, error) {
+	start, _ := time.Parse(dateFormat, listing.Date)
+	if listing.Status != backupUnknown {
+		manifest, err := catalogService.Manifest(ctx, listing.Date)
+		if err != nil {
+			return primitive.Timestamp{}, err
+		}
+		// A snapshot backup is consistent at its cluster time, so the
+		// replay can start right after it.
+		if manifest.ClusterTime != nil {
+			return *manifest.ClusterTime, nil
+		}
+		start = manifest.StartTime
+	}
+	return primitive.Timestamp{T: uint32(start.Add(-oplogReplayMargin).Unix())}, nil
+}
+
+// Replay applies the captured oplog entries of the collections with a
+// timestamp after from and up to the given time.
+func (o *oplogService) Replay(ctx context.Context, colls []dbColl, fromTS primitive.Timestamp, to time.Time, options restoreOptions) error {
+	segments, err := o.replaySegments(ctx, colls, fromTS, to)
+	if err != nil {
+		return err
+	}
+	return o.replay(ctx, segments, colls, fromTS, to, options)
+}
+
+// replaySegments returns the segments holding the entries of the collections
+// after fromTS up to the given time, once it made sure they hold all of them.
+func (o *oplogService) replaySegments(ctx context.Context, colls []dbColl, fromTS primitive.Timestamp, to time.Time) ([]oplogSegmentInfo, error) {
+	segments, err := o.segments(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// A segment holds the entries up to the first entry of the next one, so
+	// the replay starts with the last segment starting before fromTS.
+	toTS := primitive.Timestamp{T: uint32(to.Unix()), I: ^uint32(0)}
+	begin := 0
+	for begin+1 < len(segments) && !timestampBefore(fromTS, segments[begin+1].first) {
+		begin++
+	}
+	end := begin
+	for end < len(segments) && !timestampBefore(toTS, segments[end].first) {
+		end++
+	}
+
+	if err = o.checkCoverage(ctx, segments, begin, end, colls, fromTS, to); err != nil {
+		return nil, err
+	}
+	return segments[begin:end], nil
+}
+
+func (o *oplogService) replay(ctx context.Context, segments []oplogSegmentInfo, colls []dbColl, fromTS primitive.Timestamp, to time.Time, options restoreOptions) error {
+	// Entries of restored collections are applied to the namespace they are
+	// restored into.
+	namespaces := map[string]string{}
+	for _, coll := range colls {
+		namespaces[oplogNamespace(coll)] = oplogNamespace(options.target(coll))
+	}
+	toTS := primitive.Timestamp{T: uint32(to.Unix()), I: ^uint32(0)}
+
+	filter := func(entry bson.Raw) (bson.Raw, error) {
+		ts, err := oplogTimestamp(entry)
+		if err != nil {
+			return nil, err
+		}
+		ns, _ := entry.Lookup("ns").StringValueOK()
+		target, ok := namespaces[ns]
+		if !timestampBefore(fromTS, ts) || timestampBefore(toTS, ts) || !ok {
+			return nil, nil
+		}
+		if target != ns {
+			return withNamespace(entry, target)
+		}
+		return entry, nil
+	}
+
+	for _, seg := range segments {
+		log.Infof("Replaying oplog segment %s", seg.path)
+
+		err := o.readSegment(ctx, seg.path, func(reader io.Reader) error {
+			return o.dbService.ApplyOplog(ctx, newBSONTransformReader(reader, o.bsonService, filter))
+		})
+		if err != nil {
+			return fmt.Errorf("replaying oplog segment %s failed: %v", seg.path, err)
+		}
+	}
+
+	return nil
+}
+
+// checkCoverage makes sure the captured oplog holds every change to the
+// collections from fromTS up to the given time, before anything is replayed.
+// segments[begin:end] are the segments the replay reads.
+func (o *oplogService) checkCoverage(ctx context.Context, segments []oplogSegmentInfo, begin, end int, colls []dbColl, fromTS primitive.Timestamp, to time.Time) error {
+	if len(segments) == 0 {
+		return fmt.Errorf("no oplog was captured, it can't be replayed from %v", fromTS)
+	}
+
+	// The first segment shows where the captured oplog starts even if
+	// nothing has to be replayed.
+	if end == begin {
+		end = begin + 1
+	}
+	for i, seg := range segments[begin:end] {
+		metadata, err := o.segmentMetadata(ctx, seg)
+		if err != nil {
+			return err
+		}
+		if i == 0 && timestampBefore(fromTS, metadata.After) {
+			return fmt.Errorf("the captured oplog starts at %v, after %v where the replay has to start, changes made in between would be missing", metadata.After, fromTS)
+		}
+		for _, coll := range colls {
+			if !metadata.covers(oplogNamespace(coll)) {
+				return fmt.Errorf("oplog segment %s wasn't captured for %s, changes to it would be missing", seg.path, coll)
+			}
+		}
+	}
+
+	// A segment starting after the given time shows the capture got there.
+	if end < len(segments) {
+		return nil
+	}
+	last, err := o.lastTimestamp(ctx, segments[len(segments)-1])
+	if err != nil {
+		return fmt.Errorf("couldn't read the last oplog segment: %v", err)
+	}
+	if last.T < uint32(to.Unix()) {
+		return fmt.Errorf("the captured oplog ends at %v, before %v, changes made in between would be missing", time.Unix(int64(last.T), 0).UTC(), to)
+	}
+	return nil
+}
+
+type oplogSegment struct {
+	path   string
+	end    time.Time
+	writer io.WriteCloser
+	done   chan error
+}
+
+// openSegment starts a segment with the first entry after the given one. Its
+// metadata is stored first, so a stored segment always has it.
+func (o *oplogService) openSegment(ctx context.Context, first, after primitive.Timestamp, namespaces []string, enc *encryption) (*oplogSegment, error) {
+	path := oplogSegmentPath(first)
+	data, err := json.Marshal(oplogSegmentMetadata{After: after, Namespaces: namespaces})
+	if err != nil {
+		return nil, fmt.Errorf("couldn't marshal oplog segment metadata: %v", err)
+	}
+	if err = o.storageService.Upload(ctx, oplogSegmentMetadataPath(path), bytes.NewReader(data)); err != nil {
+		return nil, fmt.Errorf("couldn't upload metadata of oplog segment %s: %v", path, err)
+	}
+
+	start := time.Unix(int64(first.T), 0).UTC().Truncate(o.segmentLength)
+	reader, writer := newPipe(uploadOperation, snappyCompression, enc)
+
+	seg := &oplogSegment{
+		path:   path,
+		end:    start.Add(o.segmentLength),
+		writer: writer,
+		done:   make(chan error, 1),
+	}
+
+	go func() {
+		err := o.storageService.Upload(ctx, seg.path, reader)
+		_ = reader.Close()
+		seg.done <- err
+	}()
+
+	return seg, nil
+}
+
+func (s *oplogSegment) covers(ts primitive.Timestamp) bool {
+	return time.Unix(int64(ts.T), 0).Before(s.end)
+}
+
+func (s *oplogSegment) write(entry []byte, ts primitive.Timestamp) error {
+	if _, err := s.writer.Write(entry); err != nil {
+		return fmt.Errorf("writing oplog entry %v to segment %s failed: %v", ts, s.path, err)
+	}
+	return nil
+}
+
+func (s *oplogSegment) close() error {
+	if err := s.writer.Close(); err != nil {
+		return err
+	}
+	if err := <-s.done; err != nil {
+		return fmt.Errorf("storing oplog segment %s failed: %v", s.path, err)
+	}
+
+	log.Infof("Stored oplog segment %s", s.path)
+	return nil
+}
+
+func (l backupListing) contains(colls []dbColl) bool {
+	for _, coll := range colls {
+		found := false
+		for _, c := range l.Collections {
+			if c.Database == coll.database && c.Collection == coll.collection && (c.InManifest || l.Status == backupUnknown) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+func oplogNamespaces(colls []dbColl) []string {
+	var namespaces []string
+	for _, coll := range colls {
+		namespaces = append(namespaces, oplogNamespace(coll))
+	}
+	return namespaces
+}
+
+func oplogNamespace(coll dbColl) string {
+	return coll.database + "." + coll.collection
+}
+
+// oplogOps returns the entries to store for an oplog entry. The writes of a
+// transaction, which the oplog holds as an applyOps command, are stored as
+// entries of their own with the timestamp of the transaction, keeping those
+// to the given namespaces. Transactions too big for a single entry are
+// written as several applyOps entries when they commit, each of which is
+// unwrapped the same way.
+func oplogOps(entry []byte, namespaces []string) ([][]byte, error) {
+	raw := bson.Raw(entry)
+	if op, _ := raw.Lookup("op").StringValueOK(); op != "c" {
+		return [][]byte{entry}, nil
+	}
+
+	ts, err := oplogTimestamp(entry)
+	if err != nil {
+		return nil, err
+	}
+	// Prepared transactions are committed or aborted by a later entry.
+	if prepare, _ := raw.Lookup("o", "prepare").BooleanOK(); prepare {
+		return nil, fmt.Errorf("oplog entry %v is a prepared transaction, which can't be captured", ts)
+	}
+	applyOps, ok := raw.Lookup("o", "applyOps").ArrayOK()
+	if !ok {
+		return nil, fmt.Errorf("oplog entry %v is a command other than applyOps, which can't be captured", ts)
+	}
+	inner, err := applyOps.Values()
+	if err != nil {
+		return nil, fmt.Errorf("invalid oplog entry %v: %v", ts, err)
+	}
+
+	captured := map[string]bool{}
+	for _, ns := range namespaces {
+		captured[ns] = true
+	}
+	var ops [][]byte
+	for _, value := range inner {
+		doc, ok := value.DocumentOK()
+		if !ok {
+			return nil, fmt.Errorf("invalid oplog entry %v: applyOps holds a %v", ts, value.Type)
+		}
+		if ns, _ := doc.Lookup("ns").StringValueOK(); !captured[ns] {
+			continue
+		}
+		elements, err := doc.Elements()
+		if err != nil {
+			return nil, fmt.Errorf("invalid oplog entry %v: %v", ts, err)
+		}
+		op := bson.D{{Key: "ts", Value: ts}}
+		for _, element := range elements {
+			op = append(op, bson.E{Key: element.Key(), Value: element.Value()})
+		}
+		data, err := bson.Marshal(op)
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, data)
+	}
+	return ops, nil
+}
+
+// withNamespace returns a copy of the oplog entry which applies to the given
+// namespace instead.
+func withNamespace(entry bson.Raw, ns string) (bson.Raw, error) {
+	elements, err := entry.Elements()
+	if err != nil {
+		return nil, fmt.Errorf("invalid oplog entry: %v", err)
+	}
+	var rewritten bson.D
+	for _, element := range elements {
+		if element.Key() == "ns" {
+			rewritten = append(rewritten, bson.E{Key: "ns", Value: ns})
+			continue
+		}
+		rewritten = append(rewritten, bson.E{Key: element.Key(), Value: element.Value()})
+	}
+	return bson.Marshal(rewritten)
+}
+
+func oplogTimestamp(entry []byte) (primitive.Timestamp, error) {
+	t, i, ok := bson.Raw(entry).Lookup("ts").TimestampOK()
+	if !ok {
+		return primitive.Timestamp{}, fmt.Errorf("oplog entry without timestamp")
+	}
+	return primitive.Timestamp{T: t, I: i}, nil
+}
+
+func timestampBefore(a, b primitive.Timestamp) bool {
+	return a.T < b.T || (a.T == b.T && a.I < b.I)
+}
+
+func previousTimestamp(ts primitive.Timestamp) primitive.Timestamp {
+	if ts.I > 0 {
+		return primitive.Timestamp{T: ts.T, I: ts.I - 1}
+	}
+	return primitive.Timestamp{T: ts.T - 1, I: ^uint32(0)}
+}
+
+// parseRestoreTime accepts RFC 3339 times as well as times in dateFormat.
+func parseRestoreTime(value string) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	t, err := time.Parse(dateFormat, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("couldn't parse time %q, expected RFC 3339 or %s", value, dateFormat)
+	}
+	return t, nil
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func newTestOplogEntry(t *testing.T, ts primitive.Timestamp, ns string) []byte {
+	entry, err := bson.Marshal(bson.D{
+		{Key: "ts", Value: ts},
+		{Key: "op", Value: "i"},
+		{Key: "ns", Value: ns},
+		{Key: "ui", Value: primitive.Binary{Subtype: 4, Data: make([]byte, 16)}},
+		{Key: "o", Value: bson.D{{Key: "_id", Value: ts.T}}},
+	})
+	assert.NoError(t, err)
+	return entry
+}
+
+func mockTailOplog(mockedMongoService *mockMongoService, after primitive.Timestamp, entries ...[]byte) {
+	mockedMongoService.On("TailOplog", mock.Anything, []string{"database1.collection1"}, after, mock.Anything).
+		Run(func(args mock.Arguments) {
+			out := args.Get(3).(chan<- []byte)
+			for _, entry := range entries {
+				out <- entry
+			}
+		}).
+		Return(errors.New("oplog cursor was closed by the server")).
+		Once()
+}
+
+func TestOplogCapture_StoresSegments(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("LastOplogTimestamp", mock.Anything).Return(primitive.Timestamp{T: 100}, nil)
+	mockTailOplog(mockedMongoService, primitive.Timestamp{T: 100},
+		newTestOplogEntry(t, primitive.Timestamp{T: 1000, I: 1}, "database1.collection1"),
+		newTestOplogEntry(t, primitive.Timestamp{T: 1100, I: 1}, "database1.collection1"),
+		newTestOplogEntry(t, primitive.Timestamp{T: 1300, I: 1}, "database1.collection1"),
+	)
+	mockTailOplog(mockedMongoService, primitive.Timestamp{T: 1300, I: 1})
+	mockedMongoService.On("FirstOplogTimestamp", mock.Anything).Return(primitive.Timestamp{T: 1200}, nil)
+
+	oplogService := newOplogService(mockedMongoService, storageService, &defaultBsonService{}, nil, 10*time.Minute)
+
+	err := oplogService.Capture(ctx, []dbColl{{"database1", "collection1"}})
+	assert.EqualError(t, err, "oplog cursor was closed by the server")
+
+	segments, err := oplogService.segments(ctx)
+	assert.NoError(t, err)
+	assert.Equal(t, []oplogSegmentInfo{
+		{path: "oplog/1970-01-01T00-16-40_1.bson.snappy", first: primitive.Timestamp{T: 1000, I: 1}},
+		{path: "oplog/1970-01-01T00-21-40_1.bson.snappy", first: primitive.Timestamp{T: 1300, I: 1}},
+	}, segments)
+
+	metadata, err := oplogService.segmentMetadata(ctx, segments[1])
+	assert.NoError(t, err)
+	assert.Equal(t, &oplogSegmentMetadata{After: primitive.Timestamp{T: 1100, I: 1}, Namespaces: []string{"database1.collection1"}}, metadata)
+
+	// Capturing again resumes after the last stored entry.
+	err = oplogService.Capture(ctx, []dbColl{{"database1", "collection1"}})
+	assert.EqualError(t, err, "oplog cursor was closed by the server")
+	mockedMongoService.AssertExpectations(t)
+}
+
+func TestOplogCapture_RefusesToResumeAfterRollover(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("LastOplogTimestamp", mock.Anything).Return(primitive.Timestamp{T: 100}, nil)
+	mockTailOplog(mockedMongoService, primitive.Timestamp{T: 100},
+		newTestOplogEntry(t, primitive.Timestamp{T: 1000, I: 1}, "database1.collection1"),
+	)
+	mockedMongoService.On("FirstOplogTimestamp", mock.Anything).Return(primitive.Timestamp{T: 1200}, nil)
+	oplogService := newOplogService(mockedMongoService, storageService, &defaultBsonService{}, nil, 10*time.Minute)
+	_ = oplogService.Capture(ctx, []dbColl{{"database1", "collection1"}})
+
+	err := oplogService.Capture(ctx, []dbColl{{"database1", "collection1"}})
+
+	assert.EqualError(t, err, "the oplog was captured up to {1000 1}, but it now starts at {1200 0}, the entries in between are lost; move the captured segments out of oplog/ to start capturing afresh")
+	mockedMongoService.AssertNotCalled(t, "TailOplog", mock.Anything, mock.Anything, primitive.Timestamp{T: 1000, I: 1}, mock.Anything)
+}
+
+func TestOplogOps_UnwrapsTransactions(t *testing.T) {
+	ts := primitive.Timestamp{T: 1000, I: 1}
+	insert := bson.D{{Key: "op", Value: "i"}, {Key: "ns", Value: "database1.collection1"}, {Key: "o", Value: bson.D{{Key: "_id", Value: 1}}}}
+	entry, err := bson.Marshal(bson.D{
+		{Key: "ts", Value: ts},
+		{Key: "op", Value: "c"},
+		{Key: "ns", Value: "admin.$cmd"},
+		{Key: "o", Value: bson.D{{Key: "applyOps", Value: bson.A{
+			insert,
+			bson.D{{Key: "op", Value: "d"}, {Key: "ns", Value: "database1.collection2"}, {Key: "o", Value: bson.D{{Key: "_id", Value: 2}}}},
+		}}}},
+	})
+	assert.NoError(t, err)
+
+	ops, err := oplogOps(entry, []string{"database1.collection1"})
+
+	assert.NoError(t, err)
+	expected, err := bson.Marshal(append(bson.D{{Key: "ts", Value: ts}}, insert...))
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{expected}, ops)
+
+	plain := newTestOplogEntry(t, ts, "database1.collection1")
+	ops, err = oplogOps(plain, []string{"database1.collection1"})
+	assert.NoError(t, err)
+	assert.Equal(t, [][]byte{plain}, ops)
+
+	prepared, err := bson.Marshal(bson.D{
+		{Key: "ts", Value: ts},
+		{Key: "op", Value: "c"},
+		{Key: "ns", Value: "admin.$cmd"},
+		{Key: "o", Value: bson.D{{Key: "applyOps", Value: bson.A{insert}}, {Key: "prepare", Value: true}}},
+	})
+	assert.NoError(t, err)
+	_, err = oplogOps(prepared, []string{"database1.collection1"})
+	assert.EqualError(t, err, "oplog entry {1000 1} is a prepared transaction, which can't be captured")
+}
+
+func TestOplogReplay_RefusesIncompleteOplog(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("LastOplogTimestamp", mock.Anything).Return(primitive.Timestamp{T: 1000}, nil)
+	mockTailOplog(mockedMongoService, primitive.Timestamp{T: 1000},
+		newTestOplogEntry(t, primitive.Timestamp{T: 2000, I: 1}, "database1.collection1"),
+		newTestOplogEntry(t, primitive.Timestamp{T: 3000, I: 1}, "database1.collection1"),
+	)
+	oplogService := newOplogService(mockedMongoService, storageService, &defaultBsonService{}, nil, 10*time.Minute)
+	_ = oplogService.Capture(ctx, []dbColl{{"database1", "collection1"}})
+
+	colls := []dbColl{{"database1", "collection1"}}
+	err := oplogService.Replay(ctx, colls, primitive.Timestamp{T: 500}, time.Unix(2500, 0), restoreOptions{})
+	assert.EqualError(t, err, "the captured oplog starts at {1000 0}, after {500 0} where the replay has to start, changes made in between would be missing")
+
+	err = oplogService.Replay(ctx, colls, primitive.Timestamp{T: 1500}, time.Unix(3500, 0), restoreOptions{})
+	assert.EqualError(t, err, "the captured oplog ends at 1970-01-01 00:50:00 +0000 UTC, before "+time.Unix(3500, 0).String()+", changes made in between would be missing")
+
+	err = oplogService.Replay(ctx, []dbColl{{"database1", "collection2"}}, primitive.Timestamp{T: 1500}, time.Unix(2500, 0), restoreOptions{})
+	assert.EqualError(t, err, "oplog segment oplog/1970-01-01T00-33-20_1.bson.snappy wasn't captured for database1/collection2, changes to it would be missing")
+
+	mockedMongoService.AssertNotCalled(t, "ApplyOplog", mock.Anything, mock.Anything)
+}
+
+func TestOplogRestoreTo_ReplaysUpToTime(t *testing.T) {
+	ctx := context.Background()
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, doc)
+	backupTime, err := time.Parse(dateFormat, date)
+	assert.NoError(t, err)
+
+	ts := func(d time.Duration) primitive.Timestamp {
+		return primitive.Timestamp{T: uint32(backupTime.Add(d).Unix()), I: 1}
+	}
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("LastOplogTimestamp", mock.Anything).Return(ts(-3*time.Hour), nil)
+	mockTailOplog(mockedMongoService, ts(-3*time.Hour),
+		newTestOplogEntry(t, ts(-2*time.Hour), "database1.collection1"),
+		newTestOplogEntry(t, ts(time.Hour), "database1.collection1"),
+		newTestOplogEntry(t, ts(time.Hour), "database1.collection2"),
+		newTestOplogEntry(t, ts(2*time.Hour), "database1.collection1"),
+	)
+	oplogService := newOplogService(mockedMongoService, storageService, &defaultBsonService{}, nil, 10*time.Minute)
+	_ = oplogService.Capture(ctx, []dbColl{{"database1", "collection1"}})
+
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = io.Copy(io.Discard, args.Get(3).(io.Reader))
+		}).
+		Return(nil)
+	var applied []primitive.Timestamp
+	mockedMongoService.On("ApplyOplog", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			reader := args.Get(1).(io.Reader)
+			for {
+				next, err := (&defaultBsonService{}).ReadNextBSON(reader)
+				if err != nil || next == nil {
+					return
+				}
+				ts, _ := oplogTimestamp(next)
+				applied = append(applied, ts)
+			}
+		}).
+		Return(nil)
+	backupService := newMongoBackupService(mockedMongoService, storageService, nil, backupOptions{})
+
+	err = oplogService.RestoreTo(ctx, backupService, backupTime.Add(90*time.Minute), []dbColl{{"database1", "collection1"}}, restoreOptions{})
+
+	assert.NoError(t, err, "Error wasn't expected during restore.")
+	mockedMongoService.AssertCalled(t, "RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, mock.Anything)
+	assert.Equal(t, []primitive.Timestamp{ts(time.Hour)}, applied)
+}
+
+func TestOplogRestoreTo_NoBackupBefore(t *testing.T) {
+	storageService := newFSStorageService(t.TempDir())
+	oplogService := newOplogService(new(mockMongoService), storageService, &defaultBsonService{}, nil, 10*time.Minute)
+
+	err := oplogService.RestoreTo(context.Background(), nil, time.Unix(0, 0).UTC(), []dbColl{{"database1", "collection1"}}, restoreOptions{})
+
+	assert.EqualError(t, err, "no backup of all collections found before 1970-01-01 00:00:00 +0000 UTC")
+}
+
+func TestOplogRestoreTo_RefusesMaskedBackup(t *testing.T) {
+	ctx := context.Background()
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, doc)
+	backupTime, err := time.Parse(dateFormat, date)
+	assert.NoError(t, err)
+	err = uploadMetadata(ctx, storageService, date, dbColl{"database1", "collection1"}, collectionMetadata{CollectionName: "collection1", Masking: `{"hello": "hash"}`})
+	assert.NoError(t, err)
+	oplogService := newOplogService(new(mockMongoService), storageService, &defaultBsonService{}, nil, 10*time.Minute)
+
+	err = oplogService.RestoreTo(ctx, nil, backupTime.Add(time.Hour), []dbColl{{"database1", "collection1"}}, restoreOptions{})
+
+	assert.EqualError(t, err, "backup "+date+" of database1/collection1 was taken with fields masked, the oplog can't be replayed on top of it")
+}
+
+func TestWithNamespace(t *testing.T) {
+	entry := newTestOplogEntry(t, primitive.Timestamp{T: 1000, I: 1}, "database1.collection1")
+
+	rewritten, err := withNamespace(entry, "database1-restore.collection1")
+
+	assert.NoError(t, err)
+	assert.Equal(t, "database1-restore.collection1", rewritten.Lookup("ns").StringValue())
+	assert.Equal(t, bson.Raw(entry).Lookup("o"), rewritten.Lookup("o"))
+	ts, err := oplogTimestamp(rewritten)
+	assert.NoError(t, err)
+	assert.Equal(t, primitive.Timestamp{T: 1000, I: 1}, ts)
+}
+
+func TestParseRestoreTime(t *testing.T) {
+	expected := time.Date(2022, 8, 31, 15, 0, 0, 0, time.UTC)
+
+	for _, value := range []string{"2022-08-31T15:00:00Z", "2022-08-31T15-00-00"} {
+		parsed, err := parseRestoreTime(value)
+		assert.NoError(t, err)
+		assert.True(t, expected.Equal(parsed), "parsed %s as %v", value, parsed)
+	}
+
+	_, err := parseRestoreTime("yesterday")
+	assert.Error(t, err)
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"bytes"
+
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+// samplesPerPartition is the number of sampled _ids the bounds of each
+// partition are picked from. More samples give more even partitions.
+const samplesPerPartition = 20
+
+// idRange is a range of _ids in index order, from min inclusive to max
+// exclusive. A nil bound leaves the range open on that side.
+type idRange struct {
+	min *bson.RawValue
+	max *bson.RawValue
+}
+
+// partitionRanges splits the _id space into at most parts ranges, using a
+// sorted sample of _ids as bounds. The ranges cover every possible _id, so
+// documents inserted after sampling still end up in one of them.
+func partitionRanges(ids []bson.RawValue, parts int) []idRange {
+	if parts < 2 || len(ids) < parts {
+		return []idRange{{}}
+	}
+
+	var bounds []bson.RawValue
+	for i := 1; i < parts; i++ {
+		bound := ids[i*len(ids)/parts]
+		if len(bounds) > 0 && sameRawValue(bounds[len(bounds)-1], bound) {
+			continue
+		}
+		bounds = append(bounds, bound)
+	}
+
+	ranges := make([]idRange, 0, len(bounds)+1)
+	var min *bson.RawValue
+	for i := range bounds {
+		ranges = append(ranges, idRange{min: min, max: &bounds[i]})
+		min = &bounds[i]
+	}
+	return append(ranges, idRange{min: min})
+}
+
+func sameRawValue(a, b bson.RawValue) bool {
+	return a.Type == b.Type && bytes.Equal(a.Value, b.Value)
+}
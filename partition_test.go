@@ -0,0 +1,47 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+	"go.mongodb.org/mongo-driver/x/bsonx/bsoncore"
+)
+
+func int32IDs(values ...int32) []bson.RawValue {
+	var ids []bson.RawValue
+	for _, value := range values {
+		ids = append(ids, bson.RawValue{Type: bsontype.Int32, Value: bsoncore.AppendInt32(nil, value)})
+	}
+	return ids
+}
+
+func rangeBounds(ranges []idRange) [][2]interface{} {
+	bound := func(value *bson.RawValue) interface{} {
+		if value == nil {
+			return nil
+		}
+		return value.Int32()
+	}
+	var bounds [][2]interface{}
+	for _, r := range ranges {
+		bounds = append(bounds, [2]interface{}{bound(r.min), bound(r.max)})
+	}
+	return bounds
+}
+
+func TestPartitionRanges(t *testing.T) {
+	ranges := partitionRanges(int32IDs(1, 2, 3, 4, 5, 6, 7, 8, 9), 3)
+	assert.Equal(t, [][2]interface{}{{nil, int32(4)}, {int32(4), int32(7)}, {int32(7), nil}}, rangeBounds(ranges))
+}
+
+func TestPartitionRanges_SkipsRepeatedBounds(t *testing.T) {
+	ranges := partitionRanges(int32IDs(1, 5, 5, 5, 5, 5, 5, 9), 4)
+	assert.Equal(t, [][2]interface{}{{nil, int32(5)}, {int32(5), nil}}, rangeBounds(ranges))
+}
+
+func TestPartitionRanges_TooFewSamples(t *testing.T) {
+	assert.Equal(t, []idRange{{}}, partitionRanges(int32IDs(1, 2), 3))
+	assert.Equal(t, []idRange{{}}, partitionRanges(int32IDs(1, 2, 3), 1))
+}
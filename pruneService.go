@@ -0,0 +1,240 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// retentionPolicy is a grandfather-father-son policy. It keeps the newest
+// complete backup of each of the last daily days, weekly weeks and monthly
+// months which have one.
+type retentionPolicy struct {
+	daily   int
+	weekly  int
+	monthly int
+	// unfinishedAfter is how long a run without a manifest is kept as
+	// possibly still in progress. Older ones are pruned like incomplete runs.
+	unfinishedAfter time.Duration
+}
+
+func parseRetentionPolicy(daily, weekly, monthly int, unfinishedAfter string) (retentionPolicy, error) {
+	policy := retentionPolicy{daily: daily, weekly: weekly, monthly: monthly}
+	grace, err := time.ParseDuration(unfinishedAfter)
+	if err != nil {
+		return policy, fmt.Errorf("invalid grace period of unfinished backups: %v", err)
+	}
+	policy.unfinishedAfter = grace
+	return policy, nil
+}
+
+// oplogSegmentStatus is the status pruning reports for oplog segments.
+const oplogSegmentStatus = "oplog segment"
+
+type pruneDecision struct {
+	Date    string   `json:"date"`
+	Status  string   `json:"status"`
+	Keep    bool     `json:"keep"`
+	Reasons []string `json:"reasons"`
+}
+
+func (d *pruneDecision) keep(reason string) {
+	d.Keep = true
+	d.Reasons = append(d.Reasons, reason)
+}
+
+// pruneService deletes the backup runs which a retention policy doesn't keep.
+type pruneService struct {
+	catalogService *catalogService
+	storageService storageService
+	policy         retentionPolicy
+}
+
+func newPruneService(storageService storageService, policy retentionPolicy) *pruneService {
+	return &pruneService{
+		catalogService: newCatalogService(storageService),
+		storageService: storageService,
+		policy:         policy,
+	}
+}
+
+// Prune deletes every backup run the policy doesn't keep, and the oplog
+// segments no kept run needs to be replayed from. It returns the decision
+// taken for each run, oldest first, followed by the segments it deletes.
+// With dryRun nothing is deleted.
+func (p *pruneService) Prune(ctx context.Context, dryRun bool) ([]pruneDecision, error) {
+	listings, err := p.catalogService.List(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	decisions := p.plan(listings, time.Now().UTC())
+	segments, err := p.planOplog(ctx, listings, decisions)
+	if err != nil {
+		return decisions, err
+	}
+	decisions = append(decisions, segments...)
+	if dryRun {
+		return decisions, nil
+	}
+
+	for _, decision := range decisions {
+		if decision.Keep {
+			continue
+		}
+		if decision.Status == oplogSegmentStatus {
+			err = p.storageService.Delete(ctx, []string{decision.Date, oplogSegmentMetadataPath(decision.Date)})
+		} else {
+			err = p.delete(ctx, decision.Date)
+		}
+		if err != nil {
+			return decisions, fmt.Errorf("couldn't delete %s: %v", decision.Date, err)
+		}
+	}
+	return decisions, nil
+}
+
+// plan decides which of the listed runs to keep. Runs without a manifest are
+// kept for the grace period of the policy, as they may still be in progress,
+// and the newest run which successfully saved each collection is always kept.
+func (p *pruneService) plan(listings []backupListing, now time.Time) []pruneDecision {
+	decisions := make([]pruneDecision, len(listings))
+	for i, listing := range listings {
+		decisions[i] = pruneDecision{Date: listing.Date, Status: listing.Status, Reasons: []string{}}
+	}
+
+	periods := []struct {
+		name   string
+		keep   int
+		period func(time.Time) string
+	}{
+		{"daily", p.policy.daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.policy.weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.policy.monthly, func(t time.Time) string { return t.Format("2006-01") }},
+	}
+	for _, period := range periods {
+		last := ""
+		kept := 0
+		for i := len(listings) - 1; i >= 0 && kept < period.keep; i-- {
+			if listings[i].Status != backupComplete {
+				continue
+			}
+			t, err := time.Parse(dateFormat, listings[i].Date)
+			if err != nil {
+				continue
+			}
+			if current := period.period(t); current != last {
+				decisions[i].keep(period.name)
+				last = current
+				kept++
+			}
+		}
+	}
+
+	newest := map[dbColl]int{}
+	for i, listing := range listings {
+		if listing.Status == backupUnknown {
+			if started, err := time.Parse(dateFormat, listing.Date); err != nil || now.Sub(started) < p.policy.unfinishedAfter {
+				decisions[i].keep("no manifest, may still be in progress")
+			}
+		}
+		for _, coll := range listing.Collections {
+			if coll.InManifest {
+				newest[dbColl{coll.Database, coll.Collection}] = i
+			}
+		}
+	}
+	for i, listing := range listings {
+		for _, coll := range listing.Collections {
+			if coll.InManifest && newest[dbColl{coll.Database, coll.Collection}] == i {
+				decisions[i].keep(fmt.Sprintf("newest backup of %s/%s", coll.Database, coll.Collection))
+			}
+		}
+	}
+
+	return decisions
+}
+
+// planOplog returns the oplog segments which only hold entries from before
+// the replay start of the oldest kept run, and so can be deleted. A segment
+// holds the entries up to the first entry of the next one.
+func (p *pruneService) planOplog(ctx context.Context, listings []backupListing, decisions []pruneDecision) ([]pruneDecision, error) {
+	oldest := -1
+	for i, decision := range decisions {
+		if decision.Keep {
+			oldest = i
+			break
+		}
+	}
+	if oldest < 0 {
+		return nil, nil
+	}
+
+	start, err := replayStart(ctx, p.catalogService, listings[oldest])
+	if err != nil {
+		return nil, err
+	}
+	segments, err := listOplogSegments(ctx, p.storageService)
+	if err != nil {
+		return nil, err
+	}
+
+	var pruned []pruneDecision
+	for i := 0; i+1 < len(segments) && !timestampBefore(start, segments[i+1].first); i++ {
+		pruned = append(pruned, pruneDecision{
+			Date:    segments[i].path,
+			Status:  oplogSegmentStatus,
+			Reasons: []string{fmt.Sprintf("before %s, the oldest kept backup", listings[oldest].Date)},
+		})
+	}
+	return pruned, nil
+}
+
+// delete removes all objects of a run. The manifest goes last, so a run which
+// was only partly deleted is still recognised and pruned again next time.
+func (p *pruneService) delete(ctx context.Context, date string) error {
+	objects, err := p.storageService.List(ctx, date)
+	if err != nil {
+		return err
+	}
+
+	var paths []string
+	for _, obj := range objects {
+		if obj.Path != manifestFilePath(date) {
+			paths = append(paths, obj.Path)
+		}
+	}
+
+	log.Infof("Deleting backup %s", date)
+
+	if err = p.storageService.Delete(ctx, paths); err != nil {
+		return err
+	}
+	return p.storageService.Delete(ctx, []string{manifestFilePath(date)})
+}
+
+func printPruneDecisions(w io.Writer, decisions []pruneDecision, dryRun bool) error {
+	deleted := "deleted"
+	if dryRun {
+		deleted = "would delete"
+	}
+
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "DATE\tSTATUS\tACTION\tREASON")
+	for _, d := range decisions {
+		action := deleted
+		if d.Keep {
+			action = "keep"
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\n", d.Date, d.Status, action, strings.Join(d.Reasons, ", "))
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson/primitive"
+)
+
+func completeListing(date string, colls ...string) backupListing {
+	listing := backupListing{Date: date, Status: backupComplete}
+	for _, coll := range colls {
+		listing.Collections = append(listing.Collections, collectionListing{Database: "database1", Collection: coll, InManifest: true})
+	}
+	return listing
+}
+
+func keptDates(decisions []pruneDecision) []string {
+	var dates []string
+	for _, decision := range decisions {
+		if decision.Keep {
+			dates = append(dates, decision.Date)
+		}
+	}
+	return dates
+}
+
+func TestPrunePlan_GrandfatherFatherSon(t *testing.T) {
+	listings := []backupListing{
+		completeListing("2022-06-30T10-30-00"),
+		completeListing("2022-07-31T10-30-00"),
+		completeListing("2022-08-20T10-30-00"),
+		completeListing("2022-08-28T10-30-00"),
+		completeListing("2022-08-29T10-30-00"),
+		completeListing("2022-08-30T10-30-00"),
+		completeListing("2022-08-31T09-30-00"),
+		completeListing("2022-08-31T10-30-00", "collection1"),
+	}
+
+	decisions := newPruneService(nil, retentionPolicy{daily: 2, weekly: 2, monthly: 3}).plan(listings, time.Date(2022, 8, 31, 12, 0, 0, 0, time.UTC))
+
+	assert.Equal(t, []string{
+		"2022-06-30T10-30-00", // monthly
+		"2022-07-31T10-30-00", // monthly
+		"2022-08-28T10-30-00", // weekly, last of the previous week
+		"2022-08-30T10-30-00", // daily
+		"2022-08-31T10-30-00", // daily, weekly, monthly, newest of collection1
+	}, keptDates(decisions))
+	assert.Equal(t, []string{"daily", "weekly", "monthly", "newest backup of database1/collection1"}, decisions[7].Reasons)
+}
+
+func TestPrunePlan_KeepsNewestBackupOfEveryCollection(t *testing.T) {
+	listings := []backupListing{
+		completeListing("2022-08-29T10-30-00", "collection1", "collection2"),
+		{
+			Date:   "2022-08-30T10-30-00",
+			Status: backupIncomplete,
+			Collections: []collectionListing{
+				{Database: "database1", Collection: "collection1", InManifest: true},
+				{Database: "database1", Collection: "collection2"},
+			},
+		},
+		{Date: "2022-08-31T10-30-00", Status: backupUnknown},
+	}
+
+	decisions := newPruneService(nil, retentionPolicy{unfinishedAfter: 24 * time.Hour}).plan(listings, time.Date(2022, 8, 31, 12, 0, 0, 0, time.UTC))
+
+	assert.Equal(t, []string{"2022-08-29T10-30-00", "2022-08-30T10-30-00", "2022-08-31T10-30-00"}, keptDates(decisions))
+	assert.Equal(t, []string{"newest backup of database1/collection2"}, decisions[0].Reasons)
+	assert.Equal(t, []string{"newest backup of database1/collection1"}, decisions[1].Reasons)
+	assert.Equal(t, []string{"no manifest, may still be in progress"}, decisions[2].Reasons)
+}
+
+func TestPrunePlan_PrunesAbandonedRunsWithoutManifest(t *testing.T) {
+	listings := []backupListing{
+		{
+			Date:   "2022-08-29T10-30-00",
+			Status: backupUnknown,
+			Collections: []collectionListing{
+				{Database: "database1", Collection: "collection1"},
+			},
+		},
+		completeListing("2022-08-30T10-30-00", "collection1"),
+		{Date: "2022-08-31T10-30-00", Status: backupUnknown},
+	}
+
+	// A run which didn't write its manifest within the grace period is
+	// treated as incomplete.
+	decisions := newPruneService(nil, retentionPolicy{unfinishedAfter: 24 * time.Hour}).plan(listings, time.Date(2022, 8, 31, 12, 0, 0, 0, time.UTC))
+
+	assert.Equal(t, []string{"2022-08-30T10-30-00", "2022-08-31T10-30-00"}, keptDates(decisions))
+}
+
+func TestPrune_DeletesOplogSegmentsBeforeOldestKeptBackup(t *testing.T) {
+	ctx := context.Background()
+	timestamp := func(date string) primitive.Timestamp {
+		t, _ := time.Parse(dateFormat, date)
+		return primitive.Timestamp{T: uint32(t.Unix()), I: 1}
+	}
+	storageService := newFSStorageService(t.TempDir())
+	for _, date := range []string{"2022-08-30T10-30-00", "2022-08-31T10-30-00"} {
+		clusterTime := timestamp(date)
+		uploadTestManifest(t, storageService, backupManifest{
+			Date:        date,
+			Complete:    true,
+			ClusterTime: &clusterTime,
+			Collections: []collectionManifest{{Database: "database1", Collection: "collection1"}},
+		})
+	}
+	var segments []string
+	for _, first := range []string{"2022-08-29T10-00-00", "2022-08-30T10-00-00", "2022-08-30T11-00-00", "2022-08-31T11-00-00"} {
+		path := oplogSegmentPath(timestamp(first))
+		assert.NoError(t, storageService.Upload(ctx, path, strings.NewReader("data")))
+		assert.NoError(t, storageService.Upload(ctx, oplogSegmentMetadataPath(path), strings.NewReader("{}")))
+		segments = append(segments, path)
+	}
+	pruneService := newPruneService(storageService, retentionPolicy{daily: 1})
+
+	// The replay on top of the 2022-08-31 backup starts in the third
+	// segment, the first two are no longer needed.
+	decisions, err := pruneService.Prune(ctx, false)
+	assert.NoError(t, err)
+	assert.Len(t, decisions, 4)
+	assert.Equal(t, pruneDecision{Date: segments[0], Status: oplogSegmentStatus, Reasons: []string{"before 2022-08-31T10-30-00, the oldest kept backup"}}, decisions[2])
+	assert.Equal(t, segments[1], decisions[3].Date)
+
+	remaining, err := listOplogSegments(ctx, storageService)
+	assert.NoError(t, err)
+	assert.Equal(t, []oplogSegmentInfo{
+		{path: segments[2], first: timestamp("2022-08-30T11-00-00")},
+		{path: segments[3], first: timestamp("2022-08-31T11-00-00")},
+	}, remaining)
+	_, err = os.Stat(filepath.Join(storageService.dir, oplogSegmentMetadataPath(segments[0])))
+	assert.True(t, os.IsNotExist(err), "The metadata of pruned segments should be gone.")
+}
+
+func TestPrune_DeletesFromStorage(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	for _, date := range []string{"2022-08-30T10-30-00", "2022-08-31T10-30-00"} {
+		assert.NoError(t, storageService.Upload(ctx, collectionFilePath(date, "database1", "collection1", snappyCodec), strings.NewReader("data")))
+		assert.NoError(t, storageService.Upload(ctx, metadataFilePath(date, "database1", "collection1"), strings.NewReader("{}")))
+		uploadTestManifest(t, storageService, backupManifest{
+			Date:        date,
+			Complete:    true,
+			Collections: []collectionManifest{{Database: "database1", Collection: "collection1"}},
+		})
+	}
+	pruneService := newPruneService(storageService, retentionPolicy{daily: 1})
+
+	decisions, err := pruneService.Prune(ctx, true)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2022-08-31T10-30-00"}, keptDates(decisions))
+	_, err = os.Stat(filepath.Join(storageService.dir, "2022-08-30T10-30-00"))
+	assert.NoError(t, err, "A dry run shouldn't delete anything.")
+
+	decisions, err = pruneService.Prune(ctx, false)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"2022-08-31T10-30-00"}, keptDates(decisions))
+	_, err = os.Stat(filepath.Join(storageService.dir, "2022-08-30T10-30-00"))
+	assert.True(t, os.IsNotExist(err), "The pruned backup directory should be gone.")
+
+	listings, err := newCatalogService(storageService).List(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, listings, 1)
+	assert.Equal(t, "2022-08-31T10-30-00", listings[0].Date)
+}
+
+func TestParseRetentionPolicy(t *testing.T) {
+	policy, err := parseRetentionPolicy(7, 4, 12, "36h")
+	assert.NoError(t, err)
+	assert.Equal(t, retentionPolicy{daily: 7, weekly: 4, monthly: 12, unfinishedAfter: 36 * time.Hour}, policy)
+
+	_, err = parseRetentionPolicy(7, 4, 12, "a day")
+	assert.Error(t, err)
+}
+
+func TestPrintPruneDecisions(t *testing.T) {
+	buf := new(bytes.Buffer)
+
+	err := printPruneDecisions(buf, []pruneDecision{
+		{Date: "2022-08-30T10-30-00", Status: backupComplete},
+		{Date: "2022-08-31T10-30-00", Status: backupComplete, Keep: true, Reasons: []string{"daily"}},
+	}, true)
+
+	assert.NoError(t, err)
+	assert.Equal(t, "DATE                 STATUS    ACTION        REASON\n"+
+		"2022-08-30T10-30-00  complete  would delete  \n"+
+		"2022-08-31T10-30-00  complete  keep          daily\n", buf.String())
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"fmt"
+
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/bsontype"
+)
+
+// collectionQuery narrows down what a backup saves of a collection. A nil
+// filter saves every document, and a nil projection every field.
+type collectionQuery struct {
+	filter     bson.Raw
+	projection bson.Raw
+}
+
+// partial reports whether the query leaves out any documents or fields.
+func (q collectionQuery) partial() bool {
+	return len(q.filter) > 0 || len(q.projection) > 0
+}
+
+// findFilter returns the filter to pass to Find.
+func (q collectionQuery) findFilter() interface{} {
+	if len(q.filter) == 0 {
+		return bson.D{}
+	}
+	return q.filter
+}
+
+// queryRule applies a query to the collections an entry, possibly a pattern,
+// matches.
+type queryRule struct {
+	coll  dbColl
+	query collectionQuery
+}
+
+// collectionQueries are the queries of the collections which are not backed
+// up in full.
+type collectionQueries []queryRule
+
+// lookup returns the query of the first rule matching the collection, or an
+// empty query.
+func (q collectionQueries) lookup(coll dbColl) collectionQuery {
+	for _, rule := range q {
+		if rule.coll.matches(coll) {
+			return rule.query
+		}
+	}
+	return collectionQuery{}
+}
+
+// parseCollectionQueries parses a relaxed extended JSON document mapping
+// <database>/<collection> entries, which may be patterns, to a filter and a
+// projection, e.g. {"upp-store/pages": {"filter": {"type": "article"},
+// "projection": {"body": 0}}}. The first matching entry applies.
+func parseCollectionQueries(value string) (collectionQueries, error) {
+	if value == "" {
+		return nil, nil
+	}
+
+	var doc bson.Raw
+	if err := bson.UnmarshalExtJSON([]byte(value), false, &doc); err != nil {
+		return nil, fmt.Errorf("couldn't parse collection queries: %v", err)
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return nil, fmt.Errorf("couldn't parse collection queries: %v", err)
+	}
+
+	var queries collectionQueries
+	for _, element := range elements {
+		coll, err := parseDBColl(element.Key())
+		if err != nil {
+			return nil, err
+		}
+		query, err := parseCollectionQuery(element.Value())
+		if err != nil {
+			return nil, fmt.Errorf("invalid query for %s: %v", element.Key(), err)
+		}
+		queries = append(queries, queryRule{coll: coll, query: query})
+	}
+	return queries, nil
+}
+
+func parseCollectionQuery(value bson.RawValue) (collectionQuery, error) {
+	doc, ok := value.DocumentOK()
+	if !ok {
+		return collectionQuery{}, fmt.Errorf("not a document")
+	}
+	elements, err := doc.Elements()
+	if err != nil {
+		return collectionQuery{}, err
+	}
+
+	var query collectionQuery
+	for _, element := range elements {
+		value, ok := element.Value().DocumentOK()
+		if !ok {
+			return collectionQuery{}, fmt.Errorf("%s is not a document", element.Key())
+		}
+		switch element.Key() {
+		case "filter":
+			query.filter = value
+		case "projection":
+			// Restores and partitioned backups rely on the _id of every document.
+			if id, err := value.LookupErr("_id"); err == nil && isFalsy(id) {
+				return collectionQuery{}, fmt.Errorf("projection can't exclude _id")
+			}
+			query.projection = value
+		default:
+			return collectionQuery{}, fmt.Errorf("unknown field %s, expected filter or projection", element.Key())
+		}
+	}
+	return query, nil
+}
+
+func isFalsy(value bson.RawValue) bool {
+	switch value.Type {
+	case bsontype.Boolean:
+		return !value.Boolean()
+	case bsontype.Int32:
+		return value.Int32() == 0
+	case bsontype.Int64:
+		return value.Int64() == 0
+	case bsontype.Double:
+		return value.Double() == 0
+	}
+	return false
+}
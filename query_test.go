@@ -0,0 +1,51 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestParseCollectionQueries(t *testing.T) {
+	queries, err := parseCollectionQueries(`{
+		"upp-store/pages": {"filter": {"type": "article"}, "projection": {"body": 0}},
+		"upp-store/*": {"filter": {"publishedDate": {"$gte": {"$date": "2022-06-01T00:00:00Z"}}}}
+	}`)
+	assert.NoError(t, err)
+	assert.Len(t, queries, 2)
+
+	pages := queries.lookup(dbColl{"upp-store", "pages"})
+	assert.True(t, pages.partial())
+	assert.Equal(t, "article", pages.filter.Lookup("type").StringValue())
+	assert.Equal(t, int32(0), pages.projection.Lookup("body").Int32())
+
+	lists := queries.lookup(dbColl{"upp-store", "lists"})
+	assert.Equal(t, bson.TypeDateTime, lists.filter.Lookup("publishedDate", "$gte").Type)
+	assert.Nil(t, lists.projection)
+
+	other := queries.lookup(dbColl{"other", "pages"})
+	assert.False(t, other.partial())
+	assert.Equal(t, bson.D{}, other.findFilter())
+}
+
+func TestParseCollectionQueries_Errors(t *testing.T) {
+	queries, err := parseCollectionQueries("")
+	assert.NoError(t, err)
+	assert.Nil(t, queries)
+
+	_, err = parseCollectionQueries(`{"upp-store/pages": {"projection": {"_id": 0, "body": 1}}}`)
+	assert.EqualError(t, err, "invalid query for upp-store/pages: projection can't exclude _id")
+
+	_, err = parseCollectionQueries(`{"upp-store/pages": {"sort": {"_id": 1}}}`)
+	assert.EqualError(t, err, "invalid query for upp-store/pages: unknown field sort, expected filter or projection")
+
+	_, err = parseCollectionQueries(`{"upp-store/pages": {"filter": "type"}}`)
+	assert.EqualError(t, err, "invalid query for upp-store/pages: filter is not a document")
+
+	_, err = parseCollectionQueries(`{"pages": {}}`)
+	assert.EqualError(t, err, "failed to parse collection: pages")
+
+	_, err = parseCollectionQueries(`{"upp-store/pages":`)
+	assert.Error(t, err)
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+// minMaxStaleness is the smallest max staleness MongoDB accepts.
+const minMaxStaleness = 90 * time.Second
+
+// parseReadPreference builds the read preference of backups from a mode,
+// tag sets separated by semicolons, each made of comma separated name:value
+// pairs (e.g. "dc:east,use:backup;dc:east"), and a max staleness duration.
+// The tag sets are tried in order, an empty one matches any member. It
+// returns nil if no mode is given, leaving the read preference to the
+// connection string.
+func parseReadPreference(mode, tagSets, maxStaleness string) (*readpref.ReadPref, error) {
+	if mode == "" {
+		if tagSets != "" || maxStaleness != "" {
+			return nil, fmt.Errorf("tag sets and max staleness need a read preference mode")
+		}
+		return nil, nil
+	}
+	parsedMode, err := readpref.ModeFromString(mode)
+	if err != nil {
+		return nil, err
+	}
+
+	var opts []readpref.Option
+	if tagSets != "" {
+		var sets []tag.Set
+		for _, set := range strings.Split(tagSets, ";") {
+			parsedSet, err := parseTagSet(set)
+			if err != nil {
+				return nil, err
+			}
+			sets = append(sets, parsedSet)
+		}
+		opts = append(opts, readpref.WithTagSets(sets...))
+	}
+	if maxStaleness != "" {
+		staleness, err := time.ParseDuration(maxStaleness)
+		if err != nil {
+			return nil, fmt.Errorf("invalid max staleness: %v", err)
+		}
+		if staleness < minMaxStaleness {
+			return nil, fmt.Errorf("max staleness must be at least %v, got %v", minMaxStaleness, staleness)
+		}
+		opts = append(opts, readpref.WithMaxStaleness(staleness))
+	}
+
+	if parsedMode == readpref.PrimaryMode && len(opts) > 0 {
+		return nil, fmt.Errorf("tag sets and max staleness can't be used with read preference primary")
+	}
+	return readpref.New(parsedMode, opts...)
+}
+
+func parseTagSet(value string) (tag.Set, error) {
+	set := tag.Set{}
+	for _, pair := range strings.Split(value, ",") {
+		if strings.TrimSpace(pair) == "" {
+			continue
+		}
+		name, tagValue, ok := strings.Cut(pair, ":")
+		if !ok || strings.TrimSpace(name) == "" {
+			return nil, fmt.Errorf("invalid read preference tag: %s", pair)
+		}
+		set = append(set, tag.Tag{Name: strings.TrimSpace(name), Value: strings.TrimSpace(tagValue)})
+	}
+	return set, nil
+}
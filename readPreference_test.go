@@ -0,0 +1,59 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"go.mongodb.org/mongo-driver/mongo/readpref"
+	"go.mongodb.org/mongo-driver/tag"
+)
+
+func TestParseReadPreference_Ok(t *testing.T) {
+	readPref, err := parseReadPreference("secondaryPreferred", "dc:east, use:backup;dc:east;", "120s")
+
+	assert.NoError(t, err)
+	assert.Equal(t, readpref.SecondaryPreferredMode, readPref.Mode())
+	assert.Equal(t, []tag.Set{
+		{{Name: "dc", Value: "east"}, {Name: "use", Value: "backup"}},
+		{{Name: "dc", Value: "east"}},
+		{},
+	}, readPref.TagSets())
+	staleness, ok := readPref.MaxStaleness()
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Minute, staleness)
+}
+
+func TestParseReadPreference_Primary(t *testing.T) {
+	readPref, err := parseReadPreference("primary", "", "")
+
+	assert.NoError(t, err)
+	assert.Equal(t, readpref.PrimaryMode, readPref.Mode())
+}
+
+func TestParseReadPreference_Unset(t *testing.T) {
+	readPref, err := parseReadPreference("", "", "")
+
+	assert.NoError(t, err)
+	assert.Nil(t, readPref)
+
+	_, err = parseReadPreference("", "dc:east", "")
+	assert.EqualError(t, err, "tag sets and max staleness need a read preference mode")
+}
+
+func TestParseReadPreference_Errors(t *testing.T) {
+	_, err := parseReadPreference("secondaries", "", "")
+	assert.Error(t, err)
+
+	_, err = parseReadPreference("primary", "dc:east", "")
+	assert.EqualError(t, err, "tag sets and max staleness can't be used with read preference primary")
+
+	_, err = parseReadPreference("nearest", "dc", "")
+	assert.EqualError(t, err, "invalid read preference tag: dc")
+
+	_, err = parseReadPreference("secondary", "", "30s")
+	assert.EqualError(t, err, "max staleness must be at least 1m30s, got 30s")
+
+	_, err = parseReadPreference("secondary", "", "soon")
+	assert.Error(t, err)
+}
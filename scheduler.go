@@ -8,45 +8,48 @@ import (
 )
 
 type scheduler interface {
-	ScheduleBackups(colls []dbColl, cronExpr string, runAtStart bool)
+	ScheduleBackups(selection collectionSelection, cronExpr string, runAtStart bool)
 }
 
 type cronScheduler struct {
 	backupService backupService
 	statusKeeper  statusKeeper
+	// pruneService, if set, prunes old backups after every scheduled backup.
+	pruneService *pruneService
 }
 
-func newCronScheduler(backupService backupService, statusKeeper statusKeeper) *cronScheduler {
-	return &cronScheduler{backupService, statusKeeper}
+func newCronScheduler(backupService backupService, statusKeeper statusKeeper, pruneService *pruneService) *cronScheduler {
+	return &cronScheduler{backupService, statusKeeper, pruneService}
 }
 
 type scheduledJob struct {
-	eID   cron.EntryID
-	colls []dbColl
+	eID       cron.EntryID
+	selection collectionSelection
 }
 
-func (s *cronScheduler) ScheduleBackups(colls []dbColl, cronExpr string, runAtStart bool) {
+func (s *cronScheduler) ScheduleBackups(selection collectionSelection, cronExpr string, runAtStart bool) {
 	ctx := context.Background()
 
 	if runAtStart {
-		err := s.backupService.Backup(ctx, colls)
+		err := s.backupService.Backup(ctx, selection)
 		if err != nil {
 			log.Errorf("Error making scheduled backup: %v", err)
 		}
-
+		s.prune(ctx)
 	}
 
 	c := cron.New()
 	var jobs []scheduledJob
 	eID, _ := c.AddFunc(cronExpr, func() {
-		if err := s.backupService.Backup(ctx, colls); err != nil {
+		if err := s.backupService.Backup(ctx, selection); err != nil {
 			log.Errorf("Error making scheduled backup: %v", err)
 		}
+		s.prune(ctx)
 		for _, job := range jobs {
 			log.Printf("Next scheduled run: %v", c.Entry(job.eID).Next)
 		}
 	})
-	jobs = append(jobs, scheduledJob{eID, colls})
+	jobs = append(jobs, scheduledJob{eID, selection})
 
 	c.Start()
 
@@ -54,3 +57,20 @@ func (s *cronScheduler) ScheduleBackups(colls []dbColl, cronExpr string, runAtSt
 		log.Printf("Next scheduled run: %v", c.Entry(job.eID).Next)
 	}
 }
+
+func (s *cronScheduler) prune(ctx context.Context) {
+	if s.pruneService == nil {
+		return
+	}
+
+	decisions, err := s.pruneService.Prune(ctx, false)
+	if err != nil {
+		log.Errorf("Error pruning backups: %v", err)
+		return
+	}
+	for _, decision := range decisions {
+		if !decision.Keep {
+			log.Infof("Pruned %s", decision.Date)
+		}
+	}
+}
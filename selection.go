@@ -0,0 +1,164 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// systemDatabases are never matched by a database pattern, only by name.
+var systemDatabases = map[string]bool{"admin": true, "config": true, "local": true}
+
+// collectionSelection is the collections a run works on. Each side of an
+// entry is a collection name or a glob pattern (e.g. upp-store/*, */pages or
+// */tmp_*), which is matched against the collections that exist when the run
+// starts. Excluded entries are taken out of what the others select.
+type collectionSelection struct {
+	include []dbColl
+	exclude []dbColl
+}
+
+// selectCollections selects exactly the given collections.
+func selectCollections(colls ...dbColl) collectionSelection {
+	return collectionSelection{include: colls}
+}
+
+// parseCollectionSelection parses comma separated <database>/<collection>
+// entries. Entries starting with ! are excluded.
+func parseCollectionSelection(value string) (collectionSelection, error) {
+	var selection collectionSelection
+	for _, entry := range strings.Split(value, ",") {
+		entry = strings.TrimSpace(entry)
+		exclude := strings.HasPrefix(entry, "!")
+		coll, err := parseDBColl(strings.TrimPrefix(entry, "!"))
+		if err != nil {
+			return collectionSelection{}, err
+		}
+		for _, pattern := range []string{coll.database, coll.collection} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return collectionSelection{}, fmt.Errorf("invalid collection pattern %s: %v", entry, err)
+			}
+		}
+		if exclude {
+			selection.exclude = append(selection.exclude, coll)
+		} else {
+			selection.include = append(selection.include, coll)
+		}
+	}
+	if len(selection.include) == 0 {
+		return collectionSelection{}, fmt.Errorf("no collections selected: %s", value)
+	}
+	return selection, nil
+}
+
+// hasPatterns reports whether the selection has to be matched against the
+// existing collections to know which collections it selects.
+func (s collectionSelection) hasPatterns() bool {
+	if len(s.exclude) > 0 {
+		return true
+	}
+	for _, coll := range s.include {
+		if isPattern(coll.database) || isPattern(coll.collection) {
+			return true
+		}
+	}
+	return false
+}
+
+// resolve returns the selected collections, calling list for the existing
+// collections if the selection has patterns.
+func (s collectionSelection) resolve(ctx context.Context, list func(ctx context.Context) ([]dbColl, error)) ([]dbColl, error) {
+	if !s.hasPatterns() {
+		return s.include, nil
+	}
+	existing, err := list(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list collections: %v", err)
+	}
+	return s.match(existing), nil
+}
+
+// match returns the selected collections out of the given ones, in the order
+// of the entries selecting them. Collections named without a pattern are
+// selected even if they are not among the given ones.
+func (s collectionSelection) match(existing []dbColl) []dbColl {
+	existing = append([]dbColl(nil), existing...)
+	sort.Slice(existing, func(i, j int) bool {
+		if existing[i].database != existing[j].database {
+			return existing[i].database < existing[j].database
+		}
+		return existing[i].collection < existing[j].collection
+	})
+
+	var selected []dbColl
+	seen := map[dbColl]bool{}
+	add := func(coll dbColl) {
+		if seen[coll] || s.excludes(coll) {
+			return
+		}
+		seen[coll] = true
+		selected = append(selected, coll)
+	}
+	for _, entry := range s.include {
+		if !isPattern(entry.database) && !isPattern(entry.collection) {
+			add(entry)
+			continue
+		}
+		for _, coll := range existing {
+			if entry.matches(coll) {
+				add(coll)
+			}
+		}
+	}
+	return selected
+}
+
+func (s collectionSelection) excludes(coll dbColl) bool {
+	for _, entry := range s.exclude {
+		if entry.matches(coll) {
+			return true
+		}
+	}
+	return false
+}
+
+// String returns the selection as it was given.
+func (s collectionSelection) String() string {
+	entries := make([]string, 0, len(s.include)+len(s.exclude))
+	for _, coll := range s.include {
+		entries = append(entries, coll.String())
+	}
+	for _, coll := range s.exclude {
+		entries = append(entries, "!"+coll.String())
+	}
+	return strings.Join(entries, ",")
+}
+
+// matches reports whether coll is matched by the selection entry c.
+func (c dbColl) matches(coll dbColl) bool {
+	if isPattern(c.database) && systemDatabases[coll.database] {
+		return false
+	}
+	return matchName(c.database, coll.database) && matchName(c.collection, coll.collection)
+}
+
+func (c dbColl) String() string {
+	return c.database + "/" + c.collection
+}
+
+func matchName(pattern, name string) bool {
+	matched, _ := path.Match(pattern, name)
+	return matched
+}
+
+func isPattern(name string) bool {
+	return strings.ContainsAny(name, `*?[\`)
+}
+
+// isSystemCollection reports whether a collection is used internally by
+// MongoDB, such as system.profile or system.js.
+func isSystemCollection(collection string) bool {
+	return strings.HasPrefix(collection, "system.")
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCollectionSelection(t *testing.T) {
+	selection, err := parseCollectionSelection("upp-store/*, !upp-store/tmp_*,*/pages")
+
+	assert.NoError(t, err)
+	assert.Equal(t, []dbColl{{"upp-store", "*"}, {"*", "pages"}}, selection.include)
+	assert.Equal(t, []dbColl{{"upp-store", "tmp_*"}}, selection.exclude)
+	assert.True(t, selection.hasPatterns())
+	assert.Equal(t, "upp-store/*,*/pages,!upp-store/tmp_*", selection.String())
+
+	selection, err = parseCollectionSelection("foo/content,foo/bar")
+	assert.NoError(t, err)
+	assert.False(t, selection.hasPatterns())
+
+	_, err = parseCollectionSelection("foo")
+	assert.EqualError(t, err, "failed to parse collection: foo")
+	_, err = parseCollectionSelection("foo/[bar")
+	assert.Error(t, err)
+	_, err = parseCollectionSelection("!foo/bar")
+	assert.EqualError(t, err, "no collections selected: !foo/bar")
+}
+
+func TestCollectionSelection_Match(t *testing.T) {
+	existing := []dbColl{
+		{"upp-store", "pages"},
+		{"upp-store", "tmp_import"},
+		{"upp-store", "content"},
+		{"other", "pages"},
+		{"other", "lists"},
+		{"admin", "users"},
+		{"local", "startup_log"},
+	}
+
+	selection, _ := parseCollectionSelection("*/*,!*/tmp_*")
+	assert.Equal(t, []dbColl{
+		{"other", "lists"},
+		{"other", "pages"},
+		{"upp-store", "content"},
+		{"upp-store", "pages"},
+	}, selection.match(existing))
+
+	selection, _ = parseCollectionSelection("upp-store/pages,*/pages,admin/*,missing/coll")
+	assert.Equal(t, []dbColl{
+		{"upp-store", "pages"},
+		{"other", "pages"},
+		{"admin", "users"},
+		{"missing", "coll"},
+	}, selection.match(existing))
+
+	selection, _ = parseCollectionSelection("upp-store/[pc]*")
+	assert.Equal(t, []dbColl{{"upp-store", "content"}, {"upp-store", "pages"}}, selection.match(existing))
+}
+
+func TestCollectionSelection_ResolveListsOnlyForPatterns(t *testing.T) {
+	listed := false
+	list := func(ctx context.Context) ([]dbColl, error) {
+		listed = true
+		return nil, fmt.Errorf("listing failed")
+	}
+
+	colls, err := selectCollections(dbColl{"foo", "bar"}).resolve(context.Background(), list)
+	assert.NoError(t, err)
+	assert.Equal(t, []dbColl{{"foo", "bar"}}, colls)
+	assert.False(t, listed)
+
+	selection, _ := parseCollectionSelection("foo/*")
+	_, err = selection.resolve(context.Background(), list)
+	assert.EqualError(t, err, "couldn't list collections: listing failed")
+	assert.True(t, listed)
+}
@@ -1,9 +1,16 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"fmt"
 	"io"
+	"io/fs"
+	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
@@ -19,9 +26,18 @@ const (
 	downloadOperation
 )
 
+// storageService keeps backup objects under a base directory. Paths are
+// relative to that directory, e.g. as built by collectionFilePath.
 type storageService interface {
-	Upload(ctx context.Context, date, database, collection string, reader io.Reader) error
-	Download(ctx context.Context, date, database, collection string, writer io.Writer) error
+	Upload(ctx context.Context, path string, reader io.Reader) error
+	Download(ctx context.Context, path string, writer io.Writer) error
+	List(ctx context.Context, prefix string) ([]storedObject, error)
+	Delete(ctx context.Context, paths []string) error
+}
+
+type storedObject struct {
+	Path string
+	Size int64
 }
 
 type s3StorageService struct {
@@ -38,14 +54,176 @@ func newS3StorageService(bucket, dir string, session *session.Session) *s3Storag
 	}
 }
 
-func (s *s3StorageService) getFilePath(date, database, collection string) string {
-	const extension = ".bson.snappy"
+func collectionFilePath(date, database, collection string, c codec) string {
+	return filepath.Join(date, database, collection+c.extension())
+}
+
+const partSeparator = ".part-"
+
+// collectionPartPath names one part of a partitioned collection, e.g.
+// <date>/<database>/<collection>.part-0003.bson.snappy.
+func collectionPartPath(date, database, collection string, part int, c codec) string {
+	return filepath.Join(date, database, fmt.Sprintf("%s%s%04d%s", collection, partSeparator, part, c.extension()))
+}
+
+// parseCollectionFilePath is the reverse of collectionFilePath and
+// collectionPartPath. For parts it returns the name of the whole collection.
+func parseCollectionFilePath(path string) (date, database, collection string, ok bool) {
+	parts := strings.Split(filepath.ToSlash(path), "/")
+	if len(parts) != 3 {
+		return "", "", "", false
+	}
+	c, ok := codecOfFile(parts[2])
+	if !ok {
+		return "", "", "", false
+	}
+	collection, _, _ = splitCollectionPart(strings.TrimSuffix(parts[2], c.extension()))
+	return parts[0], parts[1], collection, true
+}
 
-	return filepath.Join(s.dir, date, database, collection+extension)
+// collectionPart returns the part number of an object holding a part of a
+// partitioned collection.
+func collectionPart(path string) (int, bool) {
+	name := filepath.Base(path)
+	c, ok := codecOfFile(name)
+	if !ok {
+		return 0, false
+	}
+	_, part, ok := splitCollectionPart(strings.TrimSuffix(name, c.extension()))
+	return part, ok
 }
 
-func (s *s3StorageService) Upload(ctx context.Context, date, database, collection string, reader io.Reader) error {
-	path := s.getFilePath(date, database, collection)
+func splitCollectionPart(name string) (collection string, part int, ok bool) {
+	i := strings.LastIndex(name, partSeparator)
+	if i < 0 {
+		return name, 0, false
+	}
+	digits := name[i+len(partSeparator):]
+	part, err := strconv.Atoi(digits)
+	if err != nil || len(digits) < 4 || part < 0 {
+		return name, 0, false
+	}
+	return name[:i], part, true
+}
+
+// findCollectionFiles returns the paths of the objects holding a collection
+// of the backup taken at date, whichever codec it was stored with. That is a
+// single object, or all parts in order if the collection was partitioned.
+func findCollectionFiles(ctx context.Context, storageService storageService, date, database, collection string) ([]string, codec, error) {
+	objects, err := storageService.List(ctx, filepath.Join(date, database))
+	if err != nil {
+		return nil, "", err
+	}
+
+	var paths []string
+	var c codec
+	for _, obj := range objects {
+		path := filepath.Clean(obj.Path)
+		if d, db, coll, ok := parseCollectionFilePath(path); ok && d == date && db == database && coll == collection {
+			paths = append(paths, path)
+			c, _ = codecOfFile(path)
+		}
+	}
+	if len(paths) == 0 {
+		return nil, "", fmt.Errorf("no backup of %s/%s found for date %s", database, collection, date)
+	}
+	sort.Strings(paths)
+	return paths, c, nil
+}
+
+// storedCollections returns the collections of the backup taken at date.
+func storedCollections(ctx context.Context, storageService storageService, date string) ([]dbColl, error) {
+	objects, err := storageService.List(ctx, date)
+	if err != nil {
+		return nil, err
+	}
+
+	var colls []dbColl
+	seen := map[dbColl]bool{}
+	for _, obj := range objects {
+		d, database, collection, ok := parseCollectionFilePath(filepath.Clean(obj.Path))
+		coll := dbColl{database, collection}
+		if ok && d == date && !seen[coll] {
+			seen[coll] = true
+			colls = append(colls, coll)
+		}
+	}
+	if len(colls) == 0 {
+		return nil, fmt.Errorf("no backup found for date %s", date)
+	}
+	return colls, nil
+}
+
+// uploadMetadata stores the metadata of a collection next to its documents.
+func uploadMetadata(ctx context.Context, storageService storageService, date string, coll dbColl, metadata collectionMetadata) error {
+	data, err := marshalMetadata(metadata)
+	if err != nil {
+		return fmt.Errorf("couldn't marshal collection metadata: %v", err)
+	}
+
+	if err = storageService.Upload(ctx, metadataFilePath(date, coll.database, coll.collection), bytes.NewReader(data)); err != nil {
+		return fmt.Errorf("couldn't upload collection metadata: %v", err)
+	}
+	return nil
+}
+
+// downloadMetadata downloads the metadata of a collection. It returns nil if
+// the backup has none, which is the case for backups taken by older versions.
+func downloadMetadata(ctx context.Context, storageService storageService, date string, coll dbColl) (*collectionMetadata, error) {
+	path := metadataFilePath(date, coll.database, coll.collection)
+	found, err := objectExists(ctx, storageService, path)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't look up collection metadata: %v", err)
+	}
+	if !found {
+		return nil, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err = storageService.Download(ctx, path, buf); err != nil {
+		return nil, fmt.Errorf("couldn't download collection metadata: %v", err)
+	}
+	metadata, err := unmarshalMetadata(buf.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	return &metadata, nil
+}
+
+// collectionEncryption returns the encryption to read the objects of a
+// collection of the backup taken at date with. Collections its manifest
+// records as encrypted must be, so an unencrypted object put in their place
+// fails to read instead of being restored.
+func collectionEncryption(ctx context.Context, storageService storageService, provider keyProvider, date string, coll dbColl) (*encryption, error) {
+	manifest, err := newCatalogService(storageService).Manifest(ctx, date)
+	if err != nil && err != errManifestNotFound {
+		return nil, err
+	}
+	enc := &encryption{provider: provider}
+	if manifest != nil {
+		if entry := manifest.collection(coll.database, coll.collection); entry != nil {
+			enc.required = entry.Encryption == aesGCMEncryption
+		}
+	}
+	return enc, nil
+}
+
+// objectExists reports whether an object is stored at the given path.
+func objectExists(ctx context.Context, storageService storageService, path string) (bool, error) {
+	objects, err := storageService.List(ctx, filepath.Dir(path))
+	if err != nil {
+		return false, err
+	}
+	for _, obj := range objects {
+		if filepath.Clean(obj.Path) == path {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func (s *s3StorageService) Upload(ctx context.Context, path string, reader io.Reader) error {
+	path = filepath.Join(s.dir, path)
 
 	uploader := s3manager.NewUploader(s.session)
 
@@ -58,8 +236,8 @@ func (s *s3StorageService) Upload(ctx context.Context, date, database, collectio
 	return err
 }
 
-func (s *s3StorageService) Download(ctx context.Context, date, database, collection string, writer io.Writer) error {
-	path := s.getFilePath(date, database, collection)
+func (s *s3StorageService) Download(ctx context.Context, path string, writer io.Writer) error {
+	path = filepath.Join(s.dir, path)
 
 	downloader := s3manager.NewDownloader(s.session, func(d *s3manager.Downloader) {
 		d.Concurrency = 1
@@ -90,14 +268,204 @@ func (s *s3StorageService) Download(ctx context.Context, date, database, collect
 	}
 }
 
-func newPipe(op operation) (io.ReadCloser, io.WriteCloser) {
+func (s *s3StorageService) List(ctx context.Context, prefix string) ([]storedObject, error) {
+	base := strings.TrimPrefix(filepath.Join(s.dir, prefix), "/")
+	if base != "" && base != "." {
+		base += "/"
+	}
+
+	var objects []storedObject
+	err := s3.New(s.session).ListObjectsV2PagesWithContext(ctx, &s3.ListObjectsV2Input{
+		Bucket: aws.String(s.bucket),
+		Prefix: aws.String(base),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			objects = append(objects, storedObject{
+				Path: filepath.Join(prefix, strings.TrimPrefix(aws.StringValue(obj.Key), base)),
+				Size: aws.Int64Value(obj.Size),
+			})
+		}
+		return true
+	})
+	return objects, err
+}
+
+// s3DeleteBatchSize is the most keys a single DeleteObjects request accepts.
+const s3DeleteBatchSize = 1000
+
+func (s *s3StorageService) Delete(ctx context.Context, paths []string) error {
+	svc := s3.New(s.session)
+
+	for len(paths) > 0 {
+		n := len(paths)
+		if n > s3DeleteBatchSize {
+			n = s3DeleteBatchSize
+		}
+
+		var objects []*s3.ObjectIdentifier
+		for _, path := range paths[:n] {
+			objects = append(objects, &s3.ObjectIdentifier{
+				Key: aws.String(strings.TrimPrefix(filepath.Join(s.dir, path), "/")),
+			})
+		}
+
+		out, err := svc.DeleteObjectsWithContext(ctx, &s3.DeleteObjectsInput{
+			Bucket: aws.String(s.bucket),
+			Delete: &s3.Delete{Objects: objects, Quiet: aws.Bool(true)},
+		})
+		if err != nil {
+			return err
+		}
+		if len(out.Errors) > 0 {
+			return fmt.Errorf("couldn't delete %s: %s", aws.StringValue(out.Errors[0].Key), aws.StringValue(out.Errors[0].Message))
+		}
+
+		paths = paths[n:]
+	}
+	return nil
+}
+
+type fsStorageService struct {
+	dir string
+}
+
+func newFSStorageService(dir string) *fsStorageService {
+	return &fsStorageService{
+		dir: dir,
+	}
+}
+
+func (s *fsStorageService) Upload(ctx context.Context, path string, reader io.Reader) error {
+	path = filepath.Join(s.dir, path)
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		return err
+	}
+
+	// Write into a temporary file first, so a failed or cancelled upload never
+	// leaves a truncated backup behind under the final name.
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = os.Remove(tmp.Name())
+	}()
+
+	if _, err = io.Copy(tmp, &contextReader{ctx: ctx, reader: reader}); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	if err = ctx.Err(); err != nil {
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
+
+func (s *fsStorageService) Download(ctx context.Context, path string, writer io.Writer) error {
+	path = filepath.Join(s.dir, path)
+
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		_ = file.Close()
+	}()
+
+	_, err = io.Copy(writer, &contextReader{ctx: ctx, reader: file})
+	return err
+}
+
+func (s *fsStorageService) List(ctx context.Context, prefix string) ([]storedObject, error) {
+	var objects []storedObject
+	err := filepath.WalkDir(filepath.Join(s.dir, prefix), func(path string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		// Skip directories and uploads which are still in progress.
+		if entry.IsDir() || strings.Contains(entry.Name(), ".tmp-") {
+			return nil
+		}
+
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(s.dir, path)
+		if err != nil {
+			return err
+		}
+		objects = append(objects, storedObject{Path: filepath.ToSlash(rel), Size: info.Size()})
+		return nil
+	})
+	return objects, err
+}
+
+// Delete removes the files, and the directories which are left empty by it.
+func (s *fsStorageService) Delete(ctx context.Context, paths []string) error {
+	for _, path := range paths {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+
+		path = filepath.Join(s.dir, path)
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		for dir := filepath.Dir(path); dir != filepath.Clean(s.dir) && strings.HasPrefix(dir, filepath.Clean(s.dir)); dir = filepath.Dir(dir) {
+			// Fails, and so stops, at the first directory which isn't empty.
+			if err := os.Remove(dir); err != nil {
+				break
+			}
+		}
+	}
+	return nil
+}
+
+// contextReader stops a copy as soon as the context is done.
+type contextReader struct {
+	ctx    context.Context
+	reader io.Reader
+}
+
+func (cr *contextReader) Read(p []byte) (int, error) {
+	if err := cr.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return cr.reader.Read(p)
+}
+
+// newPipe connects a stream of BSON documents with its stored form. Uploads
+// are compressed with c and, if enc holds a data key, encrypted. Downloads
+// are decrypted if they turn out to be encrypted, then decompressed with the
+// codec of c.
+func newPipe(op operation, c compression, enc *encryption) (io.ReadCloser, io.WriteCloser) {
 	reader, writer := io.Pipe()
 
 	if op == uploadOperation {
-		return reader, newSnappyWriteCloser(writer)
+		if enc != nil && enc.dataKey != nil {
+			return reader, c.newWriteCloser(newEncryptWriteCloser(writer, enc.dataKey))
+		}
+		return reader, c.newWriteCloser(writer)
 	}
 
-	return newSnappyReadCloser(reader), writer
+	return c.codec.newReadCloser(newDecryptReadCloser(reader, enc.keyProvider(), enc.isRequired())), writer
 }
 
 type snappyWriteCloser struct {
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+)
+
+func TestFSStorageService_UploadAndDownload(t *testing.T) {
+	dir := t.TempDir()
+	storageService := newFSStorageService(dir)
+
+	err := storageService.Upload(context.Background(), collectionFilePath("2017-09-04T12-40-36", "database1", "collection1", snappyCodec), strings.NewReader("data"))
+	assert.NoError(t, err, "Error wasn't expected during upload.")
+
+	_, err = os.Stat(filepath.Join(dir, "2017-09-04T12-40-36", "database1", "collection1.bson.snappy"))
+	assert.NoError(t, err, "Uploaded file should follow the <date>/<database>/<collection> layout.")
+
+	buf := new(bytes.Buffer)
+	err = storageService.Download(context.Background(), collectionFilePath("2017-09-04T12-40-36", "database1", "collection1", snappyCodec), buf)
+	assert.NoError(t, err, "Error wasn't expected during download.")
+	assert.Equal(t, "data", buf.String())
+}
+
+func TestFSStorageService_DownloadMissing(t *testing.T) {
+	storageService := newFSStorageService(t.TempDir())
+
+	err := storageService.Download(context.Background(), collectionFilePath("2017-09-04T12-40-36", "database1", "collection1", snappyCodec), new(bytes.Buffer))
+
+	assert.Error(t, err, "Error was expected for missing backup.")
+}
+
+func TestFSStorageService_CancelledUploadLeavesNothing(t *testing.T) {
+	dir := t.TempDir()
+	storageService := newFSStorageService(dir)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := storageService.Upload(ctx, collectionFilePath("2017-09-04T12-40-36", "database1", "collection1", snappyCodec), strings.NewReader("data"))
+	assert.Error(t, err, "Error was expected for cancelled upload.")
+
+	entries, err := os.ReadDir(filepath.Join(dir, "2017-09-04T12-40-36", "database1"))
+	assert.NoError(t, err)
+	assert.Empty(t, entries, "No file should be left behind after a cancelled upload.")
+}
+
+func TestBackupAndRestore_FSRoundTrip(t *testing.T) {
+	ctx := context.Background()
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+
+	index, _ := bson.Marshal(bson.D{
+		{Key: "v", Value: int32(2)},
+		{Key: "key", Value: bson.D{{Key: "lastModified", Value: int32(1)}}},
+		{Key: "name", Value: "lastModified_1"},
+		{Key: "expireAfterSeconds", Value: int32(3600)},
+	})
+	metadata := collectionMetadata{Options: emptyDocument(), Indexes: []bson.Raw{index}, CollectionName: "collection1", Type: "collection"}
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").Return(metadata, nil)
+	mockedMongoService.On("SaveCollection", mock.Anything, "database1", "collection1", collectionQuery{}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			writer := args.Get(4).(io.Writer)
+			_, _ = writer.Write(doc)
+			_, _ = writer.Write(doc)
+		}).
+		Return(nil)
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", metadata).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", []bson.Raw{index}).Return(nil)
+	restored := new(bytes.Buffer)
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			reader := args.Get(3).(io.Reader)
+			_, _ = io.Copy(restored, reader)
+		}).
+		Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.MatchedBy(func(result backupResult) bool { return result.Success })).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{})
+	err := backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"}))
+	assert.NoError(t, err, "Error wasn't expected during backup.")
+
+	dates, err := os.ReadDir(storageService.dir)
+	assert.NoError(t, err)
+	assert.Len(t, dates, 1)
+
+	var manifest backupManifest
+	data, err := os.ReadFile(filepath.Join(storageService.dir, manifestFilePath(dates[0].Name())))
+	assert.NoError(t, err, "Manifest should be written next to the backup.")
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+	assert.True(t, manifest.Complete)
+	assert.Equal(t, int64(2), manifest.Collections[0].Documents)
+
+	err = backupService.Restore(ctx, dates[0].Name(), []dbColl{{"database1", "collection1"}}, restoreOptions{})
+	assert.NoError(t, err, "Error wasn't expected during restore.")
+	assert.Equal(t, append(doc, doc...), restored.Bytes())
+	mockedMongoService.AssertExpectations(t)
+}
+
+func TestBackup_FSRecordsQuery(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	queries, err := parseCollectionQueries(`{"database1/collection1": {"filter": {"type": "article"}, "projection": {"body": 0}}}`)
+	assert.NoError(t, err)
+	query := queries.lookup(dbColl{"database1", "collection1"})
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").Return(collectionMetadata{Options: emptyDocument(), Type: "collection"}, nil)
+	mockedMongoService.On("SaveCollection", mock.Anything, "database1", "collection1", query, mock.Anything).Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{queries: queries})
+	assert.NoError(t, backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"})))
+
+	dates, err := os.ReadDir(storageService.dir)
+	assert.NoError(t, err)
+	var manifest backupManifest
+	data, err := os.ReadFile(filepath.Join(storageService.dir, manifestFilePath(dates[0].Name())))
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(data, &manifest))
+	assert.True(t, manifest.Collections[0].Partial)
+
+	data, err = os.ReadFile(filepath.Join(storageService.dir, metadataFilePath(dates[0].Name(), "database1", "collection1")))
+	assert.NoError(t, err)
+	metadata, err := unmarshalMetadata(data)
+	assert.NoError(t, err)
+	assert.True(t, metadata.partial())
+	assert.Equal(t, query.filter, metadata.Filter)
+	assert.Equal(t, query.projection, metadata.Projection)
+	mockedMongoService.AssertExpectations(t)
+
+	// Replacing the collection with the extract would lose everything else.
+	err = backupService.Restore(ctx, dates[0].Name(), []dbColl{{"database1", "collection1"}}, restoreOptions{mode: restoreReplace})
+	assert.EqualError(t, err, `backup of database1/collection1 is partial, restoring it in replace mode would remove what its filter {"type": "article"} and projection {"body": {"$numberInt":"0"}} left out, use upsert or insert-missing mode or allow partial restores`)
+	mockedMongoService.AssertNotCalled(t, "RestoreCollection", mock.Anything, mock.Anything, mock.Anything, mock.Anything, mock.Anything)
+}
+
+func TestBackupAndRestore_FSRoundTripEncrypted(t *testing.T) {
+	ctx := context.Background()
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	keyProvider := newTestKeyProvider(t)
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").Return(collectionMetadata{}, nil)
+	mockedMongoService.On("SaveCollection", mock.Anything, "database1", "collection1", collectionQuery{}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = args.Get(4).(io.Writer).Write(doc)
+		}).
+		Return(nil)
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	restored := new(bytes.Buffer)
+	var restoreErr error
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, restoreErr = io.Copy(restored, args.Get(3).(io.Reader))
+		}).
+		Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{keyProvider: keyProvider})
+	assert.NoError(t, backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"})))
+
+	dates, err := os.ReadDir(storageService.dir)
+	assert.NoError(t, err)
+	date := dates[0].Name()
+	stored, err := os.ReadFile(filepath.Join(storageService.dir, collectionFilePath(date, "database1", "collection1", snappyCodec)))
+	assert.NoError(t, err)
+	assert.True(t, bytes.HasPrefix(stored, []byte(encryptionMagic)), "Stored object should be encrypted.")
+
+	manifest, err := newCatalogService(storageService).Manifest(ctx, date)
+	assert.NoError(t, err)
+	assert.Equal(t, aesGCMEncryption, manifest.Collections[0].Encryption)
+
+	err = newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{}).
+		Restore(ctx, date, []dbColl{{"database1", "collection1"}}, restoreOptions{})
+	assert.NoError(t, err)
+	assert.EqualError(t, restoreErr, "stream is encrypted, but no encryption key provider is configured")
+
+	restored.Reset()
+	err = backupService.Restore(ctx, date, []dbColl{{"database1", "collection1"}}, restoreOptions{})
+	assert.NoError(t, err)
+	assert.NoError(t, restoreErr)
+	assert.Equal(t, doc, restored.Bytes())
+
+	// An unencrypted object put in place of the encrypted one isn't read.
+	plain := newFSStorageService(t.TempDir())
+	plainDate := backupTestCollection(t, plain, doc)
+	stored, err = os.ReadFile(filepath.Join(plain.dir, collectionFilePath(plainDate, "database1", "collection1", snappyCodec)))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(storageService.dir, collectionFilePath(date, "database1", "collection1", snappyCodec)), stored, 0600))
+
+	restored.Reset()
+	err = backupService.Restore(ctx, date, []dbColl{{"database1", "collection1"}}, restoreOptions{})
+	assert.NoError(t, err)
+	assert.EqualError(t, restoreErr, "stream isn't encrypted, but the backup records it as encrypted")
+	assert.Empty(t, restored.Bytes())
+
+	exportService := newExportService(storageService, &defaultBsonService{}, keyProvider)
+	_, err = exportService.Export(ctx, date, dbColl{"database1", "collection1"}, exportOptions{}, io.Discard)
+	assert.Error(t, err)
+	assert.Error(t, exportService.Archive(ctx, date, []dbColl{{"database1", "collection1"}}, io.Discard))
+
+	results, err := newVerifyService(storageService, &defaultBsonService{}, keyProvider).Verify(ctx, date)
+	assert.NoError(t, err)
+	assert.False(t, results[0].OK())
+}
+
+func TestBackupAndRestore_FSMasking(t *testing.T) {
+	ctx := context.Background()
+	doc, err := bson.Marshal(bson.D{{Key: "name", Value: "Jane"}, {Key: "email", Value: "jane@example.org"}, {Key: "notes", Value: "likes cats"}})
+	assert.NoError(t, err)
+	storageService := newFSStorageService(t.TempDir())
+	masking, err := parseMaskingRules(`{"database1/collection1": {"email": "hash"}}`, "salt")
+	assert.NoError(t, err)
+	restoreMasking, err := parseMaskingRules(`{"database1/*": {"notes": "drop"}}`, "salt")
+	assert.NoError(t, err)
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").Return(collectionMetadata{Options: emptyDocument(), Type: "collection"}, nil)
+	mockedMongoService.On("SaveCollection", mock.Anything, "database1", "collection1", collectionQuery{}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = args.Get(4).(io.Writer).Write(doc)
+		}).
+		Return(nil)
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	restored := new(bytes.Buffer)
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = io.Copy(restored, args.Get(3).(io.Reader))
+		}).
+		Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{masking: masking})
+	assert.NoError(t, backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"})))
+
+	dates, err := os.ReadDir(storageService.dir)
+	assert.NoError(t, err)
+	date := dates[0].Name()
+	manifest, err := newCatalogService(storageService).Manifest(ctx, date)
+	assert.NoError(t, err)
+	assert.True(t, manifest.Collections[0].Masked)
+	assert.Equal(t, int64(1), manifest.Collections[0].Documents)
+	data, err := os.ReadFile(filepath.Join(storageService.dir, metadataFilePath(date, "database1", "collection1")))
+	assert.NoError(t, err)
+	metadata, err := unmarshalMetadata(data)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"email": "hash"}`, metadata.Masking)
+
+	err = backupService.Restore(ctx, date, []dbColl{{"database1", "collection1"}}, restoreOptions{masking: restoreMasking})
+	assert.NoError(t, err)
+
+	result := bson.Raw(restored.Bytes())
+	assert.NoError(t, result.Validate())
+	assert.Equal(t, "Jane", result.Lookup("name").StringValue())
+	assert.Len(t, result.Lookup("email").StringValue(), 64)
+	_, err = result.LookupErr("notes")
+	assert.Error(t, err)
+}
+
+func TestBackupAndRestore_FSRoundTripDetectsCodec(t *testing.T) {
+	ctx := context.Background()
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").Return(collectionMetadata{}, nil)
+	mockedMongoService.On("SaveCollection", mock.Anything, "database1", "collection1", collectionQuery{}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = args.Get(4).(io.Writer).Write(doc)
+		}).
+		Return(nil)
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	restored := new(bytes.Buffer)
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, mock.Anything).
+		Run(func(args mock.Arguments) {
+			_, _ = io.Copy(restored, args.Get(3).(io.Reader))
+		}).
+		Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{compression: compression{codec: zstdCodec, level: 3}})
+	assert.NoError(t, backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"})))
+
+	dates, err := os.ReadDir(storageService.dir)
+	assert.NoError(t, err)
+	date := dates[0].Name()
+	_, err = os.Stat(filepath.Join(storageService.dir, date, "database1", "collection1.bson.zst"))
+	assert.NoError(t, err, "Object name should carry the codec.")
+
+	manifest, err := newCatalogService(storageService).Manifest(ctx, date)
+	assert.NoError(t, err)
+	assert.Equal(t, zstdCodec, manifest.Collections[0].Codec)
+
+	err = newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{}).
+		Restore(ctx, date, []dbColl{{"database1", "collection1"}}, restoreOptions{})
+	assert.NoError(t, err)
+	assert.Equal(t, doc, restored.Bytes())
+
+	results, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(ctx, date)
+	assert.NoError(t, err)
+	assert.True(t, results[0].OK(), results[0].Problems)
+}
+
+func TestCollectionPartPath(t *testing.T) {
+	path := collectionPartPath("2017-09-04T12-40-36", "database1", "pages", 3, snappyCodec)
+	assert.Equal(t, "2017-09-04T12-40-36/database1/pages.part-0003.bson.snappy", path)
+
+	date, database, collection, ok := parseCollectionFilePath(path)
+	assert.True(t, ok)
+	assert.Equal(t, []string{"2017-09-04T12-40-36", "database1", "pages"}, []string{date, database, collection})
+	part, ok := collectionPart(path)
+	assert.True(t, ok)
+	assert.Equal(t, 3, part)
+
+	_, ok = collectionPart(collectionFilePath("2017-09-04T12-40-36", "database1", "pages", snappyCodec))
+	assert.False(t, ok)
+}
+
+func TestStoredCollections(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	for _, path := range []string{
+		collectionFilePath("2017-09-04T12-40-36", "database1", "collection1", zstdCodec),
+		metadataFilePath("2017-09-04T12-40-36", "database1", "collection1"),
+		collectionPartPath("2017-09-04T12-40-36", "database2", "collection2", 0, snappyCodec),
+		collectionPartPath("2017-09-04T12-40-36", "database2", "collection2", 1, snappyCodec),
+		manifestFilePath("2017-09-04T12-40-36"),
+	} {
+		assert.NoError(t, storageService.Upload(ctx, path, strings.NewReader("data")))
+	}
+
+	colls, err := storedCollections(ctx, storageService, "2017-09-04T12-40-36")
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []dbColl{{"database1", "collection1"}, {"database2", "collection2"}}, colls)
+
+	_, err = storedCollections(ctx, storageService, "2017-09-05T12-40-36")
+	assert.EqualError(t, err, "no backup found for date 2017-09-05T12-40-36")
+}
+
+func TestBackupAndRestore_FSRoundTripPartitioned(t *testing.T) {
+	ctx := context.Background()
+	storageService := newFSStorageService(t.TempDir())
+	partitions := partitionRanges(int32IDs(1, 2, 3, 4, 5, 6), 3)
+	docs := [][]byte{}
+	for i := range partitions {
+		doc, _ := bson.Marshal(bson.D{{Key: "_id", Value: int32(i)}})
+		docs = append(docs, doc)
+	}
+
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").Return(collectionMetadata{}, nil)
+	mockedMongoService.On("PartitionCollection", mock.Anything, "database1", "collection1", int64(1000), 8).Return(partitions, nil)
+	mockedMongoService.On("SavePartition", mock.Anything, "database1", "collection1", partitions[1], collectionQuery{}, mock.Anything).
+		Return(fmt.Errorf("cursor killed")).Once()
+	for i := range partitions {
+		doc := docs[i]
+		mockedMongoService.On("SavePartition", mock.Anything, "database1", "collection1", partitions[i], collectionQuery{}, mock.Anything).
+			Run(func(args mock.Arguments) {
+				_, _ = args.Get(5).(io.Writer).Write(doc)
+			}).
+			Return(nil)
+	}
+	mockedMongoService.On("CreateCollection", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	mockedMongoService.On("CreateIndexes", mock.Anything, "database1", "collection1", mock.Anything).Return(nil)
+	mockedMongoService.On("PrepareRestore", mock.Anything, "database1", "collection1", restoreMode("")).Return(nil)
+	var mu sync.Mutex
+	var restored [][]byte
+	mockedMongoService.On("RestoreCollection", mock.Anything, "database1", "collection1", mock.Anything, restoreAppend).
+		Run(func(args mock.Arguments) {
+			data, _ := io.ReadAll(args.Get(3).(io.Reader))
+			mu.Lock()
+			restored = append(restored, data)
+			mu.Unlock()
+		}).
+		Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{partitionSize: 1000, maxPartitions: 8})
+	assert.NoError(t, backupService.Backup(ctx, selectCollections(dbColl{"database1", "collection1"})))
+
+	dates, err := os.ReadDir(storageService.dir)
+	assert.NoError(t, err)
+	date := dates[0].Name()
+	for i := range partitions {
+		_, err = os.Stat(filepath.Join(storageService.dir, collectionPartPath(date, "database1", "collection1", i, snappyCodec)))
+		assert.NoError(t, err, "Every part should be stored in its own object.")
+	}
+
+	manifest, err := newCatalogService(storageService).Manifest(ctx, date)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(3), manifest.Collections[0].Documents)
+	assert.Len(t, manifest.Collections[0].Parts, 3)
+
+	listings, err := newCatalogService(storageService).List(ctx)
+	assert.NoError(t, err)
+	assert.Len(t, listings[0].Collections, 1, "Parts should be listed as one collection.")
+
+	results, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(ctx, date)
+	assert.NoError(t, err)
+	assert.True(t, results[0].OK(), results[0].Problems)
+	assert.Equal(t, int64(3), results[0].Documents)
+
+	err = backupService.Restore(ctx, date, []dbColl{{"database1", "collection1"}}, restoreOptions{})
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, docs, restored)
+	mockedMongoService.AssertNumberOfCalls(t, "PrepareRestore", 1)
+}
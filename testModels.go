@@ -7,6 +7,8 @@ import (
 	"io"
 
 	"github.com/stretchr/testify/mock"
+	"go.mongodb.org/mongo-driver/bson"
+	"go.mongodb.org/mongo-driver/bson/primitive"
 	"go.mongodb.org/mongo-driver/mongo"
 )
 
@@ -14,11 +16,26 @@ type mockMongoSession struct {
 	mock.Mock
 }
 
-func (m *mockMongoSession) FindAll(ctx context.Context, database, collection string) (mongoCursor, error) {
-	args := m.Called(ctx, database, collection)
+func (m *mockMongoSession) FindAll(ctx context.Context, database, collection string, query collectionQuery) (mongoCursor, error) {
+	args := m.Called(ctx, database, collection, query)
+	return args.Get(0).(mongoCursor), args.Error(1)
+}
+
+func (m *mockMongoSession) FindRange(ctx context.Context, database, collection string, partition idRange, query collectionQuery) (mongoCursor, error) {
+	args := m.Called(ctx, database, collection, partition, query)
 	return args.Get(0).(mongoCursor), args.Error(1)
 }
 
+func (m *mockMongoSession) CollectionSize(ctx context.Context, database, collection string) (int64, error) {
+	args := m.Called(ctx, database, collection)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (m *mockMongoSession) SampleIDs(ctx context.Context, database, collection string, size int) ([]bson.RawValue, error) {
+	args := m.Called(ctx, database, collection, size)
+	return args.Get(0).([]bson.RawValue), args.Error(1)
+}
+
 func (m *mockMongoSession) Close(ctx context.Context) error {
 	args := m.Called(ctx)
 	return args.Error(0)
@@ -34,6 +51,81 @@ func (m *mockMongoSession) RemoveAll(ctx context.Context, database, collection s
 	return args.Error(0)
 }
 
+func (m *mockMongoSession) HasDocuments(ctx context.Context, database, collection string) (bool, error) {
+	args := m.Called(ctx, database, collection)
+	return args.Bool(0), args.Error(1)
+}
+
+func (m *mockMongoSession) TailOplog(ctx context.Context, namespaces []string, after primitive.Timestamp) (mongoCursor, error) {
+	args := m.Called(ctx, namespaces, after)
+	return args.Get(0).(mongoCursor), args.Error(1)
+}
+
+func (m *mockMongoSession) LastOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(primitive.Timestamp), args.Error(1)
+}
+
+func (m *mockMongoSession) FirstOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(primitive.Timestamp), args.Error(1)
+}
+
+func (m *mockMongoSession) ApplyOps(ctx context.Context, ops []bson.Raw) error {
+	args := m.Called(ctx, ops)
+	return args.Error(0)
+}
+
+func (m *mockMongoSession) StartSnapshot(ctx context.Context) (context.Context, snapshot, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(context.Context), args.Get(1).(snapshot), args.Error(2)
+}
+
+func (m *mockMongoSession) CollectionSpec(ctx context.Context, database, collection string) (bson.Raw, error) {
+	args := m.Called(ctx, database, collection)
+	return args.Get(0).(bson.Raw), args.Error(1)
+}
+
+func (m *mockMongoSession) ListIndexes(ctx context.Context, database, collection string) ([]bson.Raw, error) {
+	args := m.Called(ctx, database, collection)
+	return args.Get(0).([]bson.Raw), args.Error(1)
+}
+
+func (m *mockMongoSession) CreateCollection(ctx context.Context, database, collection string, options bson.Raw) error {
+	args := m.Called(ctx, database, collection, options)
+	return args.Error(0)
+}
+
+func (m *mockMongoSession) CreateIndexes(ctx context.Context, database, collection string, indexes []bson.Raw) error {
+	args := m.Called(ctx, database, collection, indexes)
+	return args.Error(0)
+}
+
+func (m *mockMongoSession) DropCollection(ctx context.Context, database, collection string) error {
+	args := m.Called(ctx, database, collection)
+	return args.Error(0)
+}
+
+func (m *mockMongoSession) RenameCollection(ctx context.Context, database, from, to string) error {
+	args := m.Called(ctx, database, from, to)
+	return args.Error(0)
+}
+
+func (m *mockMongoSession) ClusterHealth(ctx context.Context) (clusterHealth, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(clusterHealth), args.Error(1)
+}
+
+func (m *mockMongoSession) ListDatabases(ctx context.Context) ([]string, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]string), args.Error(1)
+}
+
+func (m *mockMongoSession) ListCollections(ctx context.Context, database string) ([]string, error) {
+	args := m.Called(ctx, database)
+	return args.Get(0).([]string), args.Error(1)
+}
+
 type mockMongoCur struct {
 	mock.Mock
 }
@@ -88,13 +180,97 @@ type mockMongoService struct {
 	mock.Mock
 }
 
-func (m *mockMongoService) SaveCollection(ctx context.Context, database, collection string, writer io.Writer) error {
-	args := m.Called(ctx, database, collection, writer)
+func (m *mockMongoService) SaveCollection(ctx context.Context, database, collection string, query collectionQuery, writer io.Writer) error {
+	args := m.Called(ctx, database, collection, query, writer)
 	return args.Error(0)
 }
 
-func (m *mockMongoService) RestoreCollection(ctx context.Context, database, collection string, reader io.Reader) error {
-	args := m.Called(ctx, database, collection, reader)
+func (m *mockMongoService) PartitionCollection(ctx context.Context, database, collection string, partitionSize int64, maxPartitions int) ([]idRange, error) {
+	args := m.Called(ctx, database, collection, partitionSize, maxPartitions)
+	return args.Get(0).([]idRange), args.Error(1)
+}
+
+func (m *mockMongoService) SavePartition(ctx context.Context, database, collection string, partition idRange, query collectionQuery, writer io.Writer) error {
+	args := m.Called(ctx, database, collection, partition, query, writer)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) PrepareRestore(ctx context.Context, database, collection string, mode restoreMode) error {
+	args := m.Called(ctx, database, collection, mode)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) RestoreCollection(ctx context.Context, database, collection string, reader io.Reader, mode restoreMode) error {
+	args := m.Called(ctx, database, collection, reader, mode)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) TailOplog(ctx context.Context, namespaces []string, after primitive.Timestamp, entries chan<- []byte) error {
+	args := m.Called(ctx, namespaces, after, entries)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) LastOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(primitive.Timestamp), args.Error(1)
+}
+
+func (m *mockMongoService) FirstOplogTimestamp(ctx context.Context) (primitive.Timestamp, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(primitive.Timestamp), args.Error(1)
+}
+
+func (m *mockMongoService) ApplyOplog(ctx context.Context, reader io.Reader) error {
+	args := m.Called(ctx, reader)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) StartSnapshot(ctx context.Context) (context.Context, snapshot, error) {
+	args := m.Called(ctx)
+	return args.Get(0).(context.Context), args.Get(1).(snapshot), args.Error(2)
+}
+
+func (m *mockMongoService) CollectionMetadata(ctx context.Context, database, collection string) (collectionMetadata, error) {
+	args := m.Called(ctx, database, collection)
+	return args.Get(0).(collectionMetadata), args.Error(1)
+}
+
+func (m *mockMongoService) CreateCollection(ctx context.Context, database, collection string, metadata collectionMetadata) error {
+	args := m.Called(ctx, database, collection, metadata)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) CreateIndexes(ctx context.Context, database, collection string, indexes []bson.Raw) error {
+	args := m.Called(ctx, database, collection, indexes)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) DropCollection(ctx context.Context, database, collection string) error {
+	args := m.Called(ctx, database, collection)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) RenameCollection(ctx context.Context, database, from, to string) error {
+	args := m.Called(ctx, database, from, to)
+	return args.Error(0)
+}
+
+func (m *mockMongoService) ListCollections(ctx context.Context) ([]dbColl, error) {
+	args := m.Called(ctx)
+	return args.Get(0).([]dbColl), args.Error(1)
+}
+
+type mockSnapshot struct {
+	mock.Mock
+}
+
+func (m *mockSnapshot) ClusterTime() (primitive.Timestamp, bool) {
+	args := m.Called()
+	return args.Get(0).(primitive.Timestamp), args.Bool(1)
+}
+
+func (m *mockSnapshot) Close(ctx context.Context) error {
+	args := m.Called(ctx)
 	return args.Error(0)
 }
 
@@ -102,13 +278,23 @@ type mockStorageService struct {
 	mock.Mock
 }
 
-func (m *mockStorageService) Upload(ctx context.Context, date, database, collection string, reader io.Reader) error {
-	args := m.Called(ctx, date, database, collection, reader)
+func (m *mockStorageService) Upload(ctx context.Context, path string, reader io.Reader) error {
+	args := m.Called(ctx, path, reader)
+	return args.Error(0)
+}
+
+func (m *mockStorageService) Download(ctx context.Context, path string, writer io.Writer) error {
+	args := m.Called(ctx, path, writer)
 	return args.Error(0)
 }
 
-func (m *mockStorageService) Download(ctx context.Context, date, database, collection string, writer io.Writer) error {
-	args := m.Called(ctx, date, database, collection, writer)
+func (m *mockStorageService) List(ctx context.Context, prefix string) ([]storedObject, error) {
+	args := m.Called(ctx, prefix)
+	return args.Get(0).([]storedObject), args.Error(1)
+}
+
+func (m *mockStorageService) Delete(ctx context.Context, paths []string) error {
+	args := m.Called(ctx, paths)
 	return args.Error(0)
 }
 
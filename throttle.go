@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"golang.org/x/time/rate"
+)
+
+const (
+	// throttleMinStep is the shortest interval the adaptive throttle slows
+	// down to from an unlimited rate.
+	throttleMinStep = 100 * time.Millisecond
+	// throttleMaxInterval is the longest interval between two bulk writes
+	// of the adaptive throttle, short of pausing.
+	throttleMaxInterval = 10 * time.Second
+	// throttlePollInterval is how often the adaptive throttle checks the
+	// cluster.
+	throttlePollInterval = time.Second
+)
+
+// restoreThrottle holds back the bulk writes of restores.
+type restoreThrottle interface {
+	Wait(ctx context.Context) error
+}
+
+// clusterHealth is the load of the replica set a restore writes to.
+type clusterHealth struct {
+	// ReplicationLag is how far the furthest secondary is behind the primary.
+	ReplicationLag time.Duration
+	// WriteQueue is the number of operations queued for a write lock on the
+	// primary.
+	WriteQueue int64
+}
+
+// throttleOptions enable the adaptive throttle. Zero values disable the
+// corresponding check.
+type throttleOptions struct {
+	maxLag        time.Duration
+	maxWriteQueue int64
+}
+
+func parseThrottleOptions(maxLag string, maxWriteQueue int) (throttleOptions, error) {
+	options := throttleOptions{maxWriteQueue: int64(maxWriteQueue)}
+	if maxWriteQueue < 0 {
+		return options, fmt.Errorf("negative write queue limit: %d", maxWriteQueue)
+	}
+	if maxLag == "" {
+		return options, nil
+	}
+	lag, err := time.ParseDuration(maxLag)
+	if err != nil {
+		return options, fmt.Errorf("invalid replication lag limit: %v", err)
+	}
+	options.maxLag = lag
+	return options, nil
+}
+
+func (o throttleOptions) adaptive() bool {
+	return o.maxLag > 0 || o.maxWriteQueue > 0
+}
+
+// newRestoreThrottle spaces out bulk writes by rateLimit, or adapts the
+// interval to the health of the cluster if the options ask for it.
+func newRestoreThrottle(session mongoSession, rateLimit time.Duration, options throttleOptions) restoreThrottle {
+	limiter := rate.NewLimiter(rate.Every(rateLimit), 1)
+	if !options.adaptive() {
+		return limiter
+	}
+	return &adaptiveThrottle{
+		session:      session,
+		limiter:      limiter,
+		options:      options,
+		minInterval:  rateLimit,
+		pollInterval: throttlePollInterval,
+		interval:     rateLimit,
+	}
+}
+
+// adaptiveThrottle checks the replication lag and write queue between bulk
+// writes. It doubles the interval between writes while either is over its
+// threshold, pauses writes while either is over twice its threshold, and
+// halves the interval again, down to the rate limit, while the cluster is
+// healthy.
+type adaptiveThrottle struct {
+	session      mongoSession
+	limiter      *rate.Limiter
+	options      throttleOptions
+	minInterval  time.Duration
+	pollInterval time.Duration
+
+	lock      sync.Mutex
+	interval  time.Duration
+	lastCheck time.Time
+}
+
+func (t *adaptiveThrottle) Wait(ctx context.Context) error {
+	if err := t.adjust(ctx); err != nil {
+		return err
+	}
+	return t.limiter.Wait(ctx)
+}
+
+// adjust checks the cluster if the last check is older than pollInterval,
+// and sets the interval accordingly. It only returns once the cluster is
+// healthy enough to write to.
+func (t *adaptiveThrottle) adjust(ctx context.Context) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	if time.Since(t.lastCheck) < t.pollInterval {
+		return nil
+	}
+
+	for {
+		health, err := t.session.ClusterHealth(ctx)
+		t.lastCheck = time.Now()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			log.WithError(err).Warn("Couldn't check the health of the cluster, keeping the restore rate")
+			return nil
+		}
+
+		load := t.load(health)
+		switch {
+		case load <= 1:
+			t.speedUp(health)
+			return nil
+		case load <= 2:
+			t.slowDown(health)
+			return nil
+		}
+
+		t.slowDown(health)
+		log.Warnf("Pausing restore, replication lag is %v and write queue %d", health.ReplicationLag, health.WriteQueue)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(t.pollInterval):
+		}
+	}
+}
+
+// load is the highest ratio of a measure to its threshold.
+func (t *adaptiveThrottle) load(health clusterHealth) float64 {
+	var load float64
+	if t.options.maxLag > 0 {
+		load = float64(health.ReplicationLag) / float64(t.options.maxLag)
+	}
+	if t.options.maxWriteQueue > 0 {
+		if queueLoad := float64(health.WriteQueue) / float64(t.options.maxWriteQueue); queueLoad > load {
+			load = queueLoad
+		}
+	}
+	return load
+}
+
+func (t *adaptiveThrottle) slowDown(health clusterHealth) {
+	interval := t.interval * 2
+	if interval < throttleMinStep {
+		interval = throttleMinStep
+	}
+	if interval > throttleMaxInterval {
+		interval = throttleMaxInterval
+	}
+	if interval > t.interval {
+		t.setInterval(interval, health)
+	}
+}
+
+func (t *adaptiveThrottle) speedUp(health clusterHealth) {
+	interval := t.interval / 2
+	if interval < throttleMinStep || interval < t.minInterval {
+		interval = t.minInterval
+	}
+	if interval < t.interval {
+		t.setInterval(interval, health)
+	}
+}
+
+func (t *adaptiveThrottle) setInterval(interval time.Duration, health clusterHealth) {
+	log.Infof("Restore bulk write interval is now %v, replication lag is %v and write queue %d", interval, health.ReplicationLag, health.WriteQueue)
+	t.interval = interval
+	t.limiter.SetLimit(rate.Every(interval))
+}
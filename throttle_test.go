@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+	"golang.org/x/time/rate"
+)
+
+func newTestThrottle(session mongoSession, rateLimit time.Duration) *adaptiveThrottle {
+	throttle := newRestoreThrottle(session, rateLimit, throttleOptions{maxLag: 10 * time.Second, maxWriteQueue: 100}).(*adaptiveThrottle)
+	throttle.pollInterval = time.Millisecond
+	return throttle
+}
+
+func TestAdaptiveThrottle_SlowsDownAndSpeedsUp(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ClusterHealth", ctx).Times(2).Return(clusterHealth{ReplicationLag: 15 * time.Second}, nil)
+	mockedMongoSession.On("ClusterHealth", ctx).Times(1).Return(clusterHealth{WriteQueue: 150}, nil)
+	mockedMongoSession.On("ClusterHealth", ctx).Return(clusterHealth{ReplicationLag: time.Second, WriteQueue: 5}, nil)
+	throttle := newTestThrottle(mockedMongoSession, 0)
+
+	var intervals []time.Duration
+	for i := 0; i < 6; i++ {
+		throttle.lastCheck = time.Time{}
+		assert.NoError(t, throttle.adjust(ctx))
+		intervals = append(intervals, throttle.interval)
+	}
+
+	ms := time.Millisecond
+	assert.Equal(t, []time.Duration{100 * ms, 200 * ms, 400 * ms, 200 * ms, 100 * ms, 0}, intervals)
+}
+
+func TestAdaptiveThrottle_KeepsRateLimitAsFloor(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ClusterHealth", ctx).Return(clusterHealth{}, nil)
+	throttle := newTestThrottle(mockedMongoSession, time.Second)
+	throttle.interval = 3 * time.Second
+
+	assert.NoError(t, throttle.adjust(ctx))
+	assert.Equal(t, 1500*time.Millisecond, throttle.interval)
+	throttle.lastCheck = time.Time{}
+	assert.NoError(t, throttle.adjust(ctx))
+	assert.Equal(t, time.Second, throttle.interval)
+}
+
+func TestAdaptiveThrottle_PausesOverTwiceThreshold(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ClusterHealth", ctx).Times(2).Return(clusterHealth{ReplicationLag: 25 * time.Second}, nil)
+	mockedMongoSession.On("ClusterHealth", ctx).Return(clusterHealth{}, nil)
+	throttle := newTestThrottle(mockedMongoSession, 0)
+
+	assert.NoError(t, throttle.Wait(ctx))
+	mockedMongoSession.AssertNumberOfCalls(t, "ClusterHealth", 3)
+	assert.Equal(t, 100*time.Millisecond, throttle.interval)
+}
+
+func TestAdaptiveThrottle_PauseStopsOnCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ClusterHealth", mock.Anything).Return(clusterHealth{WriteQueue: 1000}, nil).Run(func(mock.Arguments) {
+		cancel()
+	})
+	throttle := newTestThrottle(mockedMongoSession, 0)
+
+	assert.Equal(t, context.Canceled, throttle.Wait(ctx))
+}
+
+func TestAdaptiveThrottle_KeepsRateOnError(t *testing.T) {
+	ctx := context.Background()
+	mockedMongoSession := new(mockMongoSession)
+	mockedMongoSession.On("ClusterHealth", ctx).Return(clusterHealth{}, fmt.Errorf("not running with --replSet"))
+	throttle := newTestThrottle(mockedMongoSession, 0)
+	throttle.interval = time.Second
+
+	assert.NoError(t, throttle.adjust(ctx))
+	assert.Equal(t, time.Second, throttle.interval)
+}
+
+func TestNewRestoreThrottle_FixedRate(t *testing.T) {
+	throttle := newRestoreThrottle(new(mockMongoSession), time.Second, throttleOptions{})
+	assert.IsType(t, &rate.Limiter{}, throttle)
+}
+
+func TestParseThrottleOptions(t *testing.T) {
+	options, err := parseThrottleOptions("", 0)
+	assert.NoError(t, err)
+	assert.False(t, options.adaptive())
+
+	options, err = parseThrottleOptions("10s", 50)
+	assert.NoError(t, err)
+	assert.Equal(t, throttleOptions{maxLag: 10 * time.Second, maxWriteQueue: 50}, options)
+
+	_, err = parseThrottleOptions("ten seconds", 0)
+	assert.Error(t, err)
+	_, err = parseThrottleOptions("", -1)
+	assert.EqualError(t, err, "negative write queue limit: -1")
+}
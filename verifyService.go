@@ -0,0 +1,293 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	log "github.com/sirupsen/logrus"
+	"go.mongodb.org/mongo-driver/bson"
+	"golang.org/x/sync/errgroup"
+)
+
+type verifyResult struct {
+	Database    string
+	Collection  string
+	Documents   int64
+	BSONBytes   int64
+	StoredBytes int64
+	SHA256      string
+	// Parts is set for partitioned collections, which have no SHA256 of
+	// their own.
+	Parts    []partManifest
+	Problems []string
+}
+
+func (r verifyResult) OK() bool {
+	return len(r.Problems) == 0
+}
+
+// verifyService checks that a stored backup can be read back document by
+// document, without restoring it into MongoDB.
+type verifyService struct {
+	catalogService *catalogService
+	storageService storageService
+	bsonService    bsonService
+	keyProvider    keyProvider
+}
+
+func newVerifyService(storageService storageService, bsonService bsonService, keyProvider keyProvider) *verifyService {
+	return &verifyService{
+		catalogService: newCatalogService(storageService),
+		storageService: storageService,
+		bsonService:    bsonService,
+		keyProvider:    keyProvider,
+	}
+}
+
+// Verify reads every collection of the backup taken at date, and compares
+// what it finds with the manifest of the run. Problems with the backup are
+// reported in the results, the error is only set if verifying was not possible.
+func (v *verifyService) Verify(ctx context.Context, date string) ([]verifyResult, error) {
+	manifest, err := v.catalogService.Manifest(ctx, date)
+	if err != nil && err != errManifestNotFound {
+		return nil, err
+	}
+
+	objects, err := v.storageService.List(ctx, date)
+	if err != nil {
+		return nil, fmt.Errorf("couldn't list backup %s: %v", date, err)
+	}
+
+	stored := map[dbColl][]string{}
+	for _, obj := range objects {
+		if _, database, collection, ok := parseCollectionFilePath(obj.Path); ok {
+			coll := dbColl{database, collection}
+			stored[coll] = append(stored[coll], obj.Path)
+		}
+	}
+
+	colls := map[dbColl]bool{}
+	for coll := range stored {
+		colls[coll] = true
+	}
+	if manifest != nil {
+		for _, entry := range manifest.Collections {
+			colls[dbColl{entry.Database, entry.Collection}] = true
+		}
+	}
+	if len(colls) == 0 {
+		return nil, fmt.Errorf("no backup found for date %s", date)
+	}
+
+	var results []verifyResult
+	for coll := range colls {
+		result := verifyResult{Database: coll.database, Collection: coll.collection}
+
+		if paths, ok := stored[coll]; ok {
+			// Collections the manifest records as encrypted must be.
+			enc := &encryption{provider: v.keyProvider}
+			if manifest != nil {
+				if entry := manifest.collection(coll.database, coll.collection); entry != nil {
+					enc.required = entry.Encryption == aesGCMEncryption
+				}
+			}
+			result = v.verifyCollection(ctx, coll, paths, enc)
+		} else {
+			result.Problems = append(result.Problems, "object is missing from storage")
+		}
+
+		if manifest != nil {
+			entry := manifest.collection(coll.database, coll.collection)
+			result.Problems = append(result.Problems, compareWithManifest(result, entry)...)
+			if manifest.format() == mongodumpFormat {
+				result.Problems = append(result.Problems, mongodumpProblems(stored[coll], entry)...)
+			}
+		}
+		switch {
+		case manifest == nil:
+			result.Problems = append(result.Problems, "backup has no manifest")
+		case !manifest.Complete:
+			result.Problems = append(result.Problems, "manifest marks the backup as incomplete")
+		}
+
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Database != results[j].Database {
+			return results[i].Database < results[j].Database
+		}
+		return results[i].Collection < results[j].Collection
+	})
+	return results, nil
+}
+
+// verifyCollection verifies the object of a collection, or each of its parts
+// if it was partitioned.
+func (v *verifyService) verifyCollection(ctx context.Context, coll dbColl, paths []string, enc *encryption) verifyResult {
+	sort.Strings(paths)
+	if _, partitioned := collectionPart(paths[0]); !partitioned {
+		return v.verify(ctx, paths[0], coll, enc)
+	}
+
+	result := verifyResult{Database: coll.database, Collection: coll.collection}
+	for _, path := range paths {
+		part, _ := collectionPart(path)
+		partResult := v.verify(ctx, path, coll, enc)
+		for _, problem := range partResult.Problems {
+			result.Problems = append(result.Problems, fmt.Sprintf("part %d: %s", part, problem))
+		}
+		result.Documents += partResult.Documents
+		result.BSONBytes += partResult.BSONBytes
+		result.StoredBytes += partResult.StoredBytes
+		result.Parts = append(result.Parts, partManifest{
+			Part:        part,
+			Documents:   partResult.Documents,
+			BSONBytes:   partResult.BSONBytes,
+			StoredBytes: partResult.StoredBytes,
+			SHA256:      partResult.SHA256,
+		})
+	}
+	return result
+}
+
+func (v *verifyService) verify(ctx context.Context, path string, coll dbColl, enc *encryption) verifyResult {
+	start := time.Now().UTC()
+	result := verifyResult{Database: coll.database, Collection: coll.collection}
+
+	logEntry := log.
+		WithField("database", coll.database).
+		WithField("collection", coll.collection)
+
+	logEntry.Info("Verifying collection...")
+
+	c, _ := codecOfFile(path)
+	reader, writer := newPipe(downloadOperation, compression{codec: c}, enc)
+	stored := newDigestWriter(writer)
+
+	// A framing error closes the pipe, so the download fails as well. Report
+	// the framing error, which is the actual problem.
+	var readErr error
+
+	g, gctx := errgroup.WithContext(ctx)
+
+	g.Go(func() error {
+		defer func() {
+			_ = writer.Close()
+		}()
+
+		return v.storageService.Download(gctx, path, stored)
+	})
+	g.Go(func() error {
+		defer func() {
+			_ = reader.Close()
+		}()
+
+		readErr = v.readAll(reader, &result)
+		return readErr
+	})
+
+	err := g.Wait()
+	if readErr != nil {
+		err = readErr
+	}
+	if err != nil {
+		logEntry.WithError(err).Error("Verifying collection failed")
+		result.Problems = append(result.Problems, err.Error())
+		return result
+	}
+
+	result.StoredBytes = stored.bytes
+	result.SHA256 = stored.Sum()
+
+	logEntry.Infof("Finished verification. Duration: %v", time.Since(start))
+
+	return result
+}
+
+func (v *verifyService) readAll(reader io.Reader, result *verifyResult) error {
+	for {
+		next, err := v.bsonService.ReadNextBSON(reader)
+		if err != nil {
+			return fmt.Errorf("document %d doesn't frame correctly: %v", result.Documents+1, err)
+		}
+		if next == nil {
+			return nil
+		}
+		if err = bson.Raw(next).Validate(); err != nil {
+			return fmt.Errorf("document %d is not valid bson: %v", result.Documents+1, err)
+		}
+
+		result.Documents++
+		result.BSONBytes += int64(len(next))
+	}
+}
+
+// mongodumpProblems reports why mongorestore couldn't read a collection of a
+// run recorded in the mongodump format.
+func mongodumpProblems(paths []string, entry *collectionManifest) []string {
+	var problems []string
+	if len(paths) > 1 {
+		problems = append(problems, fmt.Sprintf("stored in %d parts, but the backup is in the mongodump format", len(paths)))
+	}
+	for _, path := range paths {
+		if c, _ := codecOfFile(path); c != gzipCodec && c != noCodec {
+			problems = append(problems, fmt.Sprintf("stored with the %s codec, but the backup is in the mongodump format", c))
+			break
+		}
+	}
+	if entry != nil && entry.Encryption != "" {
+		problems = append(problems, "encrypted, but the backup is in the mongodump format")
+	}
+	return problems
+}
+
+func compareWithManifest(result verifyResult, entry *collectionManifest) []string {
+	if entry == nil {
+		return []string{"collection is not recorded in the manifest"}
+	}
+	if !result.OK() {
+		return nil
+	}
+
+	var problems []string
+	if result.Documents != entry.Documents {
+		problems = append(problems, fmt.Sprintf("found %d documents, manifest records %d", result.Documents, entry.Documents))
+	}
+	if result.BSONBytes != entry.BSONBytes {
+		problems = append(problems, fmt.Sprintf("found %d bson bytes, manifest records %d", result.BSONBytes, entry.BSONBytes))
+	}
+	if result.StoredBytes != entry.StoredBytes {
+		problems = append(problems, fmt.Sprintf("found %d stored bytes, manifest records %d", result.StoredBytes, entry.StoredBytes))
+	}
+	if result.SHA256 != entry.SHA256 {
+		problems = append(problems, fmt.Sprintf("sha256 is %s, manifest records %s", result.SHA256, entry.SHA256))
+	}
+	if len(result.Parts) != len(entry.Parts) {
+		return append(problems, fmt.Sprintf("found %d parts, manifest records %d", len(result.Parts), len(entry.Parts)))
+	}
+	for i, part := range result.Parts {
+		if part.Part != entry.Parts[i].Part || part.SHA256 != entry.Parts[i].SHA256 {
+			problems = append(problems, fmt.Sprintf("part %d: sha256 is %s, manifest records %s for part %d", part.Part, part.SHA256, entry.Parts[i].SHA256, entry.Parts[i].Part))
+		}
+	}
+	return problems
+}
+
+func printVerifyResults(w io.Writer, results []verifyResult) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "COLLECTION\tDOCUMENTS\tBSON BYTES\tRESULT")
+	for _, r := range results {
+		status := "ok"
+		if !r.OK() {
+			status = "FAILED: " + strings.Join(r.Problems, "; ")
+		}
+		fmt.Fprintf(tw, "%s/%s\t%d\t%d\t%s\n", r.Database, r.Collection, r.Documents, r.BSONBytes, status)
+	}
+	return tw.Flush()
+}
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func backupTestCollection(t *testing.T, storageService storageService, docs ...[]byte) string {
+	mockedMongoService := new(mockMongoService)
+	mockedMongoService.On("CollectionMetadata", mock.Anything, "database1", "collection1").
+		Return(collectionMetadata{CollectionName: "collection1", Type: "collection"}, nil)
+	mockedMongoService.On("SaveCollection", mock.Anything, "database1", "collection1", collectionQuery{}, mock.Anything).
+		Run(func(args mock.Arguments) {
+			writer := args.Get(4).(io.Writer)
+			for _, doc := range docs {
+				_, _ = writer.Write(doc)
+			}
+		}).
+		Return(nil)
+	mockedStatusKeeper := new(mockStatusKeeper)
+	mockedStatusKeeper.On("Save", mock.Anything).Return(nil)
+
+	backupService := newMongoBackupService(mockedMongoService, storageService, mockedStatusKeeper, backupOptions{})
+	assert.NoError(t, backupService.Backup(context.Background(), selectCollections(dbColl{"database1", "collection1"})))
+
+	listings, err := newCatalogService(storageService).List(context.Background())
+	assert.NoError(t, err)
+	assert.Len(t, listings, 1)
+	return listings[0].Date
+}
+
+func TestVerify_Ok(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, doc, doc, doc)
+
+	results, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(context.Background(), date)
+
+	assert.NoError(t, err, "Error wasn't expected during verify.")
+	assert.Len(t, results, 1)
+	assert.True(t, results[0].OK(), "Unexpected problems: %v", results[0].Problems)
+	assert.Equal(t, int64(3), results[0].Documents)
+	assert.Equal(t, int64(3*len(doc)), results[0].BSONBytes)
+}
+
+func TestVerify_InvalidDocument(t *testing.T) {
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, []byte("\x16\x00\x00\x00\x02hel-\x00\x00"))
+
+	results, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(context.Background(), date)
+
+	assert.NoError(t, err, "Error wasn't expected during verify.")
+	assert.Len(t, results, 1)
+	assert.False(t, results[0].OK())
+	assert.Equal(t, "document 1 doesn't frame correctly: error reading (partial) from buffer: unexpected EOF", results[0].Problems[0])
+}
+
+func TestVerify_ObjectDoesNotMatchManifest(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, doc, doc)
+	otherDate := backupTestCollection(t, newFSStorageService(filepath.Join(storageService.dir, "other")), doc)
+
+	// Replace the stored object with a valid object of a different backup.
+	other, err := os.ReadFile(filepath.Join(storageService.dir, "other", collectionFilePath(otherDate, "database1", "collection1", snappyCodec)))
+	assert.NoError(t, err)
+	assert.NoError(t, os.WriteFile(filepath.Join(storageService.dir, collectionFilePath(date, "database1", "collection1", snappyCodec)), other, 0644))
+
+	results, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(context.Background(), date)
+
+	assert.NoError(t, err, "Error wasn't expected during verify.")
+	assert.Len(t, results, 1)
+	assert.False(t, results[0].OK())
+	assert.Contains(t, results[0].Problems, "found 1 documents, manifest records 2")
+}
+
+func TestVerify_NotInMongodumpFormat(t *testing.T) {
+	doc := []byte("\x16\x00\x00\x00\x02hello\x00\x06\x00\x00\x00world\x00\x00")
+	storageService := newFSStorageService(t.TempDir())
+	date := backupTestCollection(t, storageService, doc)
+
+	// The manifest claims a format the snappy object isn't in.
+	manifest, err := newCatalogService(storageService).Manifest(context.Background(), date)
+	assert.NoError(t, err)
+	manifest.Format = mongodumpFormat
+	uploadTestManifest(t, storageService, *manifest)
+
+	results, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(context.Background(), date)
+
+	assert.NoError(t, err, "Error wasn't expected during verify.")
+	assert.Len(t, results, 1)
+	assert.Equal(t, []string{"stored with the snappy codec, but the backup is in the mongodump format"}, results[0].Problems)
+}
+
+func TestVerify_NoBackup(t *testing.T) {
+	storageService := newFSStorageService(t.TempDir())
+
+	_, err := newVerifyService(storageService, &defaultBsonService{}, nil).Verify(context.Background(), "2017-09-04T12-40-36")
+
+	assert.EqualError(t, err, "no backup found for date 2017-09-04T12-40-36")
+}